@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"net/http"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,14 +19,64 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// What to do once credentials from Redis are older than CREDENTIAL_MAX_AGE.
+	credentialStaleTokenMap   = "token-map"   // only accept TOKEN_MAP credentials
+	credentialStaleFailClosed = "fail-closed" // accept no credentials
+)
+
+// Number of verifications cached by a BasicAuth not made by newAuth.
+const defaultAuthCacheSize = 10000
+
+// errAuthFailed is returned by Authenticate unless the password matched a
+// credential that isn't valid now.
+var errAuthFailed = errors.New("Unable to authenticate request")
+
+// errNotRefreshed is the refresh error until credentials are first loaded.
+var errNotRefreshed = errors.New("Credentials haven't been loaded from Redis yet")
+
 // credentials are used by basic auth and include the hash of a valid password, plus
 // a "stage" string which is used to emit metrics that are useful when managing credrolls, so that
 // we can track whether or not deprecated passwords are still in use.
+//
+// LinesPerSecond and BytesPerSecond optionally limit how much the credential may send,
+// shared by every request using it or, with LimitPerDrainToken, by each Logplex drain token.
+//
+// Hmac is computed with the HMAC_KEYS key KeyID, or HMAC_KEY if it's empty.
+//
+// NotBefore, DeprecateAfter and ExpiresAt optionally schedule a credential's
+// life, so rolling it needs no further edits: it's rejected before NotBefore
+// and from ExpiresAt, and treated as Deprecated after DeprecateAfter.
 type credential struct {
-	Name       string `json:"name"`
-	Stage      string `json:"stage"`
-	Deprecated bool   `json:"deprecated"`
-	Hmac       string `json:"hmac"`
+	Name               string     `json:"name"`
+	Stage              string     `json:"stage"`
+	Deprecated         bool       `json:"deprecated"`
+	Hmac               string     `json:"hmac"`
+	LinesPerSecond     float64    `json:"lines_per_second,omitempty"`
+	BytesPerSecond     float64    `json:"bytes_per_second,omitempty"`
+	LimitPerDrainToken bool       `json:"limit_per_drain_token,omitempty"`
+	KeyID              string     `json:"key_id,omitempty"`
+	NotBefore          *time.Time `json:"not_before,omitempty"`
+	DeprecateAfter     *time.Time `json:"deprecate_after,omitempty"`
+	ExpiresAt          *time.Time `json:"expires_at,omitempty"`
+}
+
+// Check c is valid at now, returning the reason it isn't and the name of the
+// metric counting that reason.
+func (c *credential) validAt(now time.Time) (error, string) {
+	if c.NotBefore != nil && now.Before(*c.NotBefore) {
+		return fmt.Errorf("Credential not valid until %s", c.NotBefore.UTC().Format(time.RFC3339)), "not_yet_valid"
+	}
+	if c.ExpiresAt != nil && !now.Before(*c.ExpiresAt) {
+		return fmt.Errorf("Credential expired at %s", c.ExpiresAt.UTC().Format(time.RFC3339)), "expired"
+	}
+	return nil, ""
+}
+
+// deprecatedAt reports whether c is deprecated at now, either explicitly or
+// because it's past DeprecateAfter.
+func (c *credential) deprecatedAt(now time.Time) bool {
+	return c.Deprecated || (c.DeprecateAfter != nil && now.After(*c.DeprecateAfter))
 }
 
 func newAuth(config AuthConfig, registry metrics.Registry) (*BasicAuth, error) {
@@ -43,40 +94,154 @@ func newAuth(config AuthConfig, registry metrics.Registry) (*BasicAuth, error) {
 		return result, err
 	}
 
+	if result.hmacKeys, err = parseHmacKeys(config.HmacKey, config.HmacKeys); err != nil {
+		return result, err
+	}
+	result.cache = newAuthCache(config.CacheSize)
+
 	if config.RedisUrl == "" {
 		return result, err
 	}
 
-	// Parse redis db out of url
-	opt, err := redis.ParseURL(config.RedisUrl)
+	client, db, err := newRedisClient(config.RedisUrl)
 	if err != nil {
 		return result, err
 	}
-	client := redis.NewClient(opt)
+
+	// Once credentials from Redis are too stale to trust, fall back to those
+	// from TOKEN_MAP, or to none at all.
+	result.refreshes = true
+	result.maxAge = config.MaxAge
+	result.refreshed = result.now()
+	result.refreshErr = errNotRefreshed
+	if config.StalePolicy != credentialStaleFailClosed {
+		result.fallback = make(map[string][]credential, len(result.creds))
+		for user, creds := range result.creds {
+			result.fallback[user] = creds
+		}
+	}
 
 	// Refresh forever.
-	go result.startRefresh(client, config, registry)
+	go result.startRefresh(client, db, config, registry)
 
 	return result, err
 }
 
-func (auth *BasicAuth) startRefresh(client *redis.Client, config AuthConfig, registry metrics.Registry) {
+func (auth *BasicAuth) startRefresh(client redis.UniversalClient, db int, config AuthConfig, registry metrics.Registry) {
+	// Reload as soon as the hash changes, as well as on every tick. The
+	// subscription reconnects by itself if Redis goes away.
+	notify := subscribeRefresh(client, db, config)
+	ticker := time.NewTicker(config.RefreshInterval)
+	auth.refreshLoop(client, config, registry, ticker.C, notify)
+}
+
+// Subscribe to refreshChannels. Redis Cluster only publishes keyspace
+// notifications on the node holding the key, so every master is subscribed to
+// them. Masters which join the cluster later aren't, but their changes are
+// still picked up on the next tick.
+func subscribeRefresh(client redis.UniversalClient, db int, config AuthConfig) <-chan *redis.Message {
+	channels := refreshChannels(db, config)
+	cluster, ok := client.(*redis.ClusterClient)
+	if !ok {
+		return client.Subscribe(channels...).Channel()
+	}
+
+	notify := make(chan *redis.Message, 100)
+	forward := func(ps *redis.PubSub) {
+		for m := range ps.Channel() {
+			notify <- m
+		}
+	}
+	if len(channels) > 1 {
+		// Messages published to a channel reach subscribers on every node.
+		go forward(cluster.Subscribe(channels[1:]...))
+	}
+	err := cluster.ForEachMaster(func(master *redis.Client) error {
+		go forward(master.Subscribe(channels[0]))
+		return nil
+	})
+	if err != nil {
+		log.WithFields(log.Fields{"ns": "auth", "at": "error", "subscribe": true, "message": err.Error()}).Info()
+	}
+	return notify
+}
+
+// Redis channels announcing changes to the credentials: keyspace notifications
+// for REDIS_KEY, which Redis only publishes if notify-keyspace-events is
+// configured, and CREDENTIAL_REFRESH_CHANNEL if set.
+func refreshChannels(db int, config AuthConfig) []string {
+	channels := []string{fmt.Sprintf("__keyspace@%d__:%s", db, config.RedisKey)}
+	if config.RefreshChannel != "" {
+		channels = append(channels, config.RefreshChannel)
+	}
+	return channels
+}
+
+// Refresh credentials immediately, then on each tick or notification until
+// ticks is closed.
+func (auth *BasicAuth) refreshLoop(client redis.Cmdable, config AuthConfig, registry metrics.Registry, ticks <-chan time.Time, notify <-chan *redis.Message) {
 	pChanges := metrics.GetOrRegisterCounter("log-iss.auth_refresh.changes", registry)
 	pFailures := metrics.GetOrRegisterCounter("log-iss.auth_refresh.failures", registry)
 	pSuccesses := metrics.GetOrRegisterCounter("log-iss.auth_refresh.successes", registry)
-	ticker := time.NewTicker(config.RefreshInterval)
+	pNotifications := metrics.GetOrRegisterCounter("log-iss.auth_refresh.notifications", registry)
+	age := registry.GetOrRegister("log-iss.auth_refresh.age", newAgeGauge()).(*ageGauge)
+	counts := make(map[string]metrics.Gauge)
 
-	for ; true; <-ticker.C {
+	for {
 		changed, err := auth.refresh(client, config.HmacKey, config.RedisKey, config.Tokens)
+		auth.recordRefresh(err)
 		if err == nil {
 			pSuccesses.Inc(1)
+			age.Update(time.Now().UnixNano())
 			if changed {
 				pChanges.Inc(1)
 			}
-			continue
+			auth.countCredentials(counts)
+		} else {
+			log.WithFields(log.Fields{"ns": "auth", "at": "error", "refresh": true, "message": err.Error(), "stale": auth.Stale()}).Info()
+			pFailures.Inc(1)
+		}
+
+		select {
+		case _, ok := <-ticks:
+			if !ok {
+				return
+			}
+		case m, ok := <-notify:
+			if !ok {
+				// Polling carries on if the subscription is closed.
+				notify = nil
+				continue
+			}
+			pNotifications.Inc(1)
+			log.WithFields(log.Fields{"ns": "auth", "at": "notification", "channel": m.Channel, "payload": m.Payload}).Info()
+			// A roll may change several fields at once; one reload covers all
+			// the notifications already waiting.
+			for len(notify) > 0 {
+				<-notify
+			}
+		}
+	}
+}
+
+// Update the gauge of each user's number of credentials in counts, adding
+// gauges for new users and zeroing those of users who've been removed.
+func (ba *BasicAuth) countCredentials(counts map[string]metrics.Gauge) {
+	ba.RLock()
+	defer ba.RUnlock()
+
+	for user, g := range counts {
+		if _, ok := ba.creds[user]; !ok {
+			g.Update(0)
 		}
-		log.WithFields(log.Fields{"ns": "auth", "at": "error", "refresh": true, "message": err.Error()}).Info()
-		pFailures.Inc(1)
+	}
+	for user, creds := range ba.creds {
+		g, ok := counts[user]
+		if !ok {
+			g = metrics.GetOrRegisterGauge("log-iss.auth_refresh.credentials."+user, ba.registry)
+			counts[user] = g
+		}
+		g.Update(int64(len(creds)))
 	}
 }
 
@@ -115,18 +280,84 @@ func (ba *BasicAuth) refresh(client redis.Cmdable, hmacKey string, redisKey stri
 		ba.Lock()
 		defer ba.Unlock()
 		ba.creds = nba.creds
+		ba.cache.Clear()
 		return true, nil
 	}
 	return false, nil
 }
 
+// Record the outcome of a refresh, for judging how stale credentials are.
+func (ba *BasicAuth) recordRefresh(err error) {
+	ba.Lock()
+	defer ba.Unlock()
+	if err == nil {
+		ba.refreshed = ba.now()
+	}
+	ba.refreshErr = err
+}
+
+// Stale reports whether credentials haven't been refreshed for longer than
+// CREDENTIAL_MAX_AGE, in which case the fallback credentials are used instead.
+func (ba *BasicAuth) Stale() bool {
+	ba.RLock()
+	defer ba.RUnlock()
+	return ba.stale()
+}
+
+func (ba *BasicAuth) stale() bool {
+	return ba.refreshes && ba.maxAge > 0 && ba.now().Sub(ba.refreshed) > ba.maxAge
+}
+
+// credentialHealth describes the state of the credentials in use.
+type credentialHealth struct {
+	Status string  `json:"status"` // ok, degraded or stale
+	Source string  `json:"source"` // redis, token_map or none
+	Age    float64 `json:"age_seconds,omitempty"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// Health returns the state of the credentials in use: ok if they were loaded
+// by the last refresh, degraded if it failed and the last good credentials
+// are in use, or stale if they've been abandoned for the fallback.
+func (ba *BasicAuth) Health() credentialHealth {
+	ba.RLock()
+	defer ba.RUnlock()
+
+	if !ba.refreshes {
+		return credentialHealth{Status: "ok", Source: "token_map"}
+	}
+	h := credentialHealth{Status: "ok", Source: "redis", Age: ba.now().Sub(ba.refreshed).Seconds()}
+	if ba.refreshErr != nil {
+		h.Status = "degraded"
+		h.Error = ba.refreshErr.Error()
+	}
+	if ba.stale() {
+		h.Status = "stale"
+		h.Source = "token_map"
+		if ba.fallback == nil {
+			h.Source = "none"
+		}
+	}
+	return h
+}
+
 // BasicAuth handles normal user/password Basic Auth requests, multiple
 // password for the same user and is safe for concurrent use.
 type BasicAuth struct {
 	sync.RWMutex
 	creds    map[string][]credential
-	hmacKey  string
+	hmacKeys map[string]string // by key ID, HMAC_KEY's being empty
+	cache    *authCache
 	registry metrics.Registry
+
+	// When credentials are refreshed from Redis, fallback replaces them once
+	// they haven't been refreshed for maxAge. A nil fallback fails closed.
+	refreshes  bool
+	maxAge     time.Duration
+	fallback   map[string][]credential
+	refreshed  time.Time // of the last successful refresh
+	refreshErr error     // of the last refresh
+	now        func() time.Time
 }
 
 // NewBasicAuthFromString creates and populates a BasicAuth from the provided
@@ -151,6 +382,23 @@ func NewBasicAuthFromString(creds string, hmacKey string, registry metrics.Regis
 	return ba, nil
 }
 
+// Parse HMAC_KEYS, key_id:key pairs, into keys by ID along with HMAC_KEY,
+// whose ID is empty.
+func parseHmacKeys(hmacKey string, pairs []string) (map[string]string, error) {
+	keys := map[string]string{"": hmacKey}
+	for _, p := range pairs {
+		kv := strings.SplitN(p, ":", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("HMAC_KEYS entries must be key_id:key")
+		}
+		if _, ok := keys[kv[0]]; ok {
+			return nil, fmt.Errorf("HMAC_KEYS has key_id %q more than once", kv[0])
+		}
+		keys[kv[0]] = kv[1]
+	}
+	return keys, nil
+}
+
 func hmacEncode(key string, message string) string {
 	hash := hmac.New(sha512.New, []byte(key))
 	hash.Write([]byte(message))
@@ -160,8 +408,10 @@ func hmacEncode(key string, message string) string {
 func NewBasicAuth(registry metrics.Registry, hmacKey string) *BasicAuth {
 	return &BasicAuth{
 		creds:    make(map[string][]credential),
-		hmacKey:  hmacKey,
+		hmacKeys: map[string]string{"": hmacKey},
+		cache:    newAuthCache(defaultAuthCacheSize),
 		registry: registry,
+		now:      time.Now,
 	}
 }
 
@@ -174,36 +424,115 @@ func (ba *BasicAuth) AddPrincipal(user string, hmac string, stage string) {
 		u = make([]credential, 0, 1)
 	}
 	ba.creds[user] = append(u, credential{Stage: stage, Hmac: hmac})
+	ba.cache.Clear()
 }
 
 // Authenticate returns the credential used to authenticate if the Request has a valid BasicAuth signature and
-// that signature encodes a known username/password combo.
-func (ba *BasicAuth) Authenticate(r *http.Request) *credential {
+// that signature encodes a known username/password combo. Otherwise it returns why the request wasn't
+// authenticated: errAuthFailed, or the reason the credential matching the password isn't valid now.
+//
+// The credential returned is a copy, with Deprecated set if it's past DeprecateAfter.
+func (ba *BasicAuth) Authenticate(r *http.Request) (*credential, error) {
 	user, pass, ok := r.BasicAuth()
 	if !ok {
 		log.WithFields(log.Fields{"ns": "auth", "at": "failure", "no_basic_auth": true}).Info()
-		return nil
+		return nil, errAuthFailed
 	}
 
 	ba.RLock()
 	defer ba.RUnlock()
 
-	credentials, exists := ba.creds[user]
+	// Verifications of fallback credentials aren't cached, so the cache only
+	// has to be cleared when the credentials from Redis change.
+	stale := ba.stale()
+	creds := ba.creds
+	if stale {
+		creds = ba.fallback
+	}
+	credentials, exists := creds[user]
 	if !exists {
 		log.WithFields(log.Fields{"ns": "auth", "at": "failure", "user": user}).Info()
-		return nil
+		return nil, errAuthFailed
 	}
 
+	now := ba.now()
+	digest := ba.cache.Digest(user, pass)
+	if !stale {
+		if e, ok := ba.cache.Get(digest); ok {
+			if err, _ := e.cred.validAt(now); err == nil {
+				return ba.authenticated(user, e, now), nil
+			}
+			// Let the credential's expiry be reported below.
+			ba.cache.Delete(digest)
+		}
+	}
+
+	sums := make(map[string]string, 1) // HMACs of pass, by key ID
+	var invalid error
 	for _, c := range credentials {
-		if c.Hmac == hmacEncode(ba.hmacKey, pass) {
-			countName := fmt.Sprintf("log-iss.auth.%s.%s.successes", user, c.Stage)
-			counter := metrics.GetOrRegisterCounter(countName, ba.registry)
-			counter.Inc(1)
-			return &c
+		sum, ok := sums[c.KeyID]
+		if !ok {
+			key, known := ba.hmacKeys[c.KeyID]
+			if !known {
+				log.WithFields(log.Fields{"ns": "auth", "at": "unknown_key", "user": user, "stage": c.Stage, "key_id": c.KeyID}).Warn()
+				continue
+			}
+			sum = hmacEncode(key, pass)
+			sums[c.KeyID] = sum
+		}
+		if !hmac.Equal([]byte(c.Hmac), []byte(sum)) {
+			continue
 		}
+
+		me := fmt.Sprintf("log-iss.auth.%s.%s", user, c.Stage)
+		if err, reason := c.validAt(now); err != nil {
+			// Another credential may share the password, e.g. while rolling it.
+			metrics.GetOrRegisterCounter(me+"."+reason, ba.registry).Inc(1)
+			log.WithFields(log.Fields{"ns": "auth", "at": "failure", "user": user, "stage": c.Stage, "credential_name": c.Name, "reason": reason}).Info()
+			invalid = err
+			continue
+		}
+
+		e := authCacheEntry{cred: c, successes: metrics.GetOrRegisterCounter(me+".successes", ba.registry)}
+		if !stale {
+			ba.cache.Put(digest, e)
+		}
+		return ba.authenticated(user, e, now), nil
 	}
+	if invalid != nil {
+		return nil, invalid
+	}
+
 	countName := fmt.Sprintf("log-iss.auth.%s.failures", user)
 	counter := metrics.GetOrRegisterCounter(countName, ba.registry)
 	counter.Inc(1)
-	return nil
+	return nil, errAuthFailed
+}
+
+// Count a successful authentication with e's credential, returning a copy of
+// it marked Deprecated if it's deprecated at now.
+func (ba *BasicAuth) authenticated(user string, e authCacheEntry, now time.Time) *credential {
+	c := e.cred
+	e.successes.Inc(1)
+	if c.deprecatedAt(now) {
+		c.Deprecated = true
+		metrics.GetOrRegisterCounter(fmt.Sprintf("log-iss.auth.%s.%s.deprecated", user, c.Stage), ba.registry).Inc(1)
+	}
+	return &c
+}
+
+// Describe the deprecation of cred to the client in the Deprecation, Sunset and
+// Warning response headers.
+func setDeprecationHeaders(h http.Header, cred *credential) {
+	warning := "Credential is deprecated"
+	if cred.DeprecateAfter != nil {
+		h.Set("Deprecation", "@"+strconv.FormatInt(cred.DeprecateAfter.Unix(), 10))
+	} else {
+		h.Set("Deprecation", "true")
+	}
+	if cred.ExpiresAt != nil {
+		h.Set("Sunset", cred.ExpiresAt.UTC().Format(http.TimeFormat))
+		warning += " and expires at " + cred.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	h.Set("Warning", fmt.Sprintf("299 log-iss %q", warning))
 }
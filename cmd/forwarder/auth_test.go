@@ -2,14 +2,17 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/elliotchance/redismock"
 	"github.com/go-redis/redis"
 	metrics "github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -220,7 +223,352 @@ func TestAuthenticate(t *testing.T) {
 				panic(err.Error())
 			}
 			r.SetBasicAuth("user", test.password)
-			assert.Equal(t, test.cred, auth.Authenticate(r))
+			cred, _ := auth.Authenticate(r)
+			assert.Equal(t, test.cred, cred)
 		})
 	}
 }
+
+func TestRefreshChannels(t *testing.T) {
+	assert.Equal(t, []string{"__keyspace@2__:creds"}, refreshChannels(2, AuthConfig{RedisKey: "creds"}))
+	assert.Equal(t, []string{"__keyspace@0__:creds", "creds-changed"}, refreshChannels(0, AuthConfig{RedisKey: "creds", RefreshChannel: "creds-changed"}))
+}
+
+func TestRefreshLoop(t *testing.T) {
+	assert := assert.New(t)
+	r := redismock.NewMock()
+	r.On("HGetAll").Return(redis.NewStringStringMapCmd("HGetAll")).Once()
+	r.On("HGetAll").Return(redis.NewStringStringMapResult(map[string]string{
+		"newuser": marshal([]credential{{Stage: "current", Hmac: hmacEncode("hmacKey", "newpassword")}}),
+	}, nil))
+
+	registry := metrics.NewRegistry()
+	auth := defaultCreds()
+	auth.registry = registry
+	ticks := make(chan time.Time)
+	notify := make(chan *redis.Message)
+	done := make(chan struct{})
+	go func() {
+		auth.refreshLoop(r, AuthConfig{HmacKey: "hmacKey", RedisKey: "key", Tokens: "user:password"}, registry, ticks, notify)
+		close(done)
+	}()
+
+	notify <- &redis.Message{Channel: "__keyspace@0__:key", Payload: "hset"}
+	close(ticks)
+	<-done
+
+	assert.Equal(newSecretCreds().creds, auth.creds, "credentials are reloaded when notified")
+	counter := func(name string) int64 {
+		return registry.Get(name).(metrics.Counter).Count()
+	}
+	assert.Equal(int64(1), counter("log-iss.auth_refresh.notifications"))
+	assert.Equal(int64(2), counter("log-iss.auth_refresh.successes"))
+	assert.Equal(int64(1), counter("log-iss.auth_refresh.changes"))
+	assert.Equal(int64(0), registry.Get("log-iss.auth_refresh.age").(metrics.Gauge).Value())
+	assert.Equal(int64(1), registry.Get("log-iss.auth_refresh.credentials.newuser").(metrics.Gauge).Value())
+
+	name, labels := prometheusName("log-iss.auth_refresh.credentials.newuser")
+	assert.Equal("log_iss_auth_refresh_credentials", name)
+	assert.Equal(map[string]string{"user": "newuser"}, labels)
+}
+
+func TestCountCredentials(t *testing.T) {
+	assert := assert.New(t)
+	auth := newSecretCreds()
+	auth.AddPrincipal("user", hmacEncode("hmacKey", "other"), "next")
+	counts := make(map[string]metrics.Gauge)
+
+	auth.countCredentials(counts)
+	assert.Equal(int64(2), counts["user"].Value())
+	assert.Equal(int64(1), counts["newuser"].Value())
+
+	delete(auth.creds, "newuser")
+	auth.countCredentials(counts)
+	assert.Equal(int64(0), counts["newuser"].Value(), "removed users are reported with no credentials")
+}
+
+func TestAgeGauge(t *testing.T) {
+	now := time.Unix(1000, 0)
+	g := newAgeGauge()
+	g.now = func() time.Time { return now }
+	g.Update(time.Unix(900, 500).UnixNano())
+	assert.Equal(t, int64(99), g.Value())
+	assert.Equal(t, int64(99), g.Snapshot().Value())
+}
+
+// A BasicAuth refreshed from Redis, with user:password from TOKEN_MAP and
+// newuser:newpassword from Redis, last refreshed at now.
+func refreshedCreds(now time.Time, policy string) *BasicAuth {
+	ba, err := newAuth(AuthConfig{Tokens: "user:password", HmacKey: "hmacKey"}, metrics.NewRegistry())
+	if err != nil {
+		panic(err)
+	}
+	ba.refreshes = true
+	ba.maxAge = time.Hour
+	ba.refreshed = now
+	ba.now = func() time.Time { return now }
+	if policy != credentialStaleFailClosed {
+		ba.fallback = defaultCreds().creds
+	}
+	ba.creds = newSecretCreds().creds
+	return ba
+}
+
+func TestStaleCredentials(t *testing.T) {
+	tests := map[string]struct {
+		policy   string
+		age      time.Duration
+		user     string
+		password string
+		ok       bool
+	}{
+		"fresh Redis credential":         {age: time.Minute, user: "newuser", password: "newpassword", ok: true},
+		"stale Redis credential":         {age: 2 * time.Hour, user: "newuser", password: "newpassword"},
+		"stale TOKEN_MAP credential":     {age: 2 * time.Hour, user: "user", password: "password", ok: true},
+		"stale, failing closed":          {policy: credentialStaleFailClosed, age: 2 * time.Hour, user: "user", password: "password"},
+		"fresh, with fail closed policy": {policy: credentialStaleFailClosed, age: time.Minute, user: "user", password: "password", ok: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			now := time.Unix(10000, 0)
+			ba := refreshedCreds(now.Add(-test.age), test.policy)
+			ba.now = func() time.Time { return now }
+			r, _ := http.NewRequest("POST", "http://localhost", nil)
+			r.SetBasicAuth(test.user, test.password)
+			cred, err := ba.Authenticate(r)
+			assert.Equal(t, test.ok, cred != nil)
+			assert.Equal(t, test.ok, err == nil)
+		})
+	}
+}
+
+func TestCredentialHealth(t *testing.T) {
+	now := time.Unix(10000, 0)
+	tests := map[string]struct {
+		policy   string
+		age      time.Duration
+		err      error
+		expected credentialHealth
+	}{
+		"refreshed": {
+			age:      time.Minute,
+			expected: credentialHealth{Status: "ok", Source: "redis", Age: 60},
+		},
+		"refresh failing": {
+			age:      time.Minute,
+			err:      errors.New("connection refused"),
+			expected: credentialHealth{Status: "degraded", Source: "redis", Age: 60, Error: "connection refused"},
+		},
+		"stale": {
+			age:      2 * time.Hour,
+			err:      errors.New("connection refused"),
+			expected: credentialHealth{Status: "stale", Source: "token_map", Age: 7200, Error: "connection refused"},
+		},
+		"stale, failing closed": {
+			policy:   credentialStaleFailClosed,
+			age:      2 * time.Hour,
+			err:      errors.New("connection refused"),
+			expected: credentialHealth{Status: "stale", Source: "none", Age: 7200, Error: "connection refused"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ba := refreshedCreds(now.Add(-test.age), test.policy)
+			ba.now = func() time.Time { return now }
+			if test.err != nil {
+				ba.recordRefresh(test.err)
+			}
+			assert.Equal(t, test.expected, ba.Health())
+		})
+	}
+
+	assert.Equal(t, credentialHealth{Status: "ok", Source: "token_map"}, defaultCreds().Health(), "without Redis")
+}
+
+func TestNewAuthConfigStalePolicy(t *testing.T) {
+	os.Setenv("HMAC_KEY", "hmacKey")
+	defer os.Unsetenv("HMAC_KEY")
+	defer os.Unsetenv("CREDENTIAL_STALE_POLICY")
+
+	for policy, ok := range map[string]bool{"": true, "token-map": true, "fail-closed": true, "open": false} {
+		os.Setenv("CREDENTIAL_STALE_POLICY", policy)
+		_, err := NewAuthConfig()
+		assert.Equal(t, ok, err == nil, policy)
+	}
+}
+
+func TestAuthenticateSchedule(t *testing.T) {
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	before, after := now.Add(-time.Hour), now.Add(time.Hour)
+	tests := map[string]struct {
+		cred       credential
+		err        string
+		deprecated bool
+		metric     string
+	}{
+		"unscheduled":      {cred: credential{}, metric: "successes"},
+		"started":          {cred: credential{NotBefore: &before}, metric: "successes"},
+		"not started":      {cred: credential{NotBefore: &after}, err: "Credential not valid until 2026-06-01T13:00:00Z", metric: "not_yet_valid"},
+		"expired":          {cred: credential{ExpiresAt: &before}, err: "Credential expired at 2026-06-01T11:00:00Z", metric: "expired"},
+		"expires at now":   {cred: credential{ExpiresAt: &now}, err: "Credential expired at 2026-06-01T12:00:00Z", metric: "expired"},
+		"not expired":      {cred: credential{ExpiresAt: &after}, metric: "successes"},
+		"deprecated after": {cred: credential{DeprecateAfter: &before}, deprecated: true, metric: "deprecated"},
+		"not deprecated":   {cred: credential{DeprecateAfter: &after}, metric: "successes"},
+		"deprecated":       {cred: credential{Deprecated: true, DeprecateAfter: &after}, deprecated: true, metric: "deprecated"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			registry := metrics.NewRegistry()
+			ba := NewBasicAuth(registry, "hmacKey")
+			ba.now = func() time.Time { return now }
+			c := test.cred
+			c.Stage = "current"
+			c.Hmac = hmacEncode("hmacKey", "password")
+			ba.creds["user"] = []credential{c}
+
+			r, _ := http.NewRequest("POST", "http://localhost", nil)
+			r.SetBasicAuth("user", "password")
+			cred, err := ba.Authenticate(r)
+			if test.err != "" {
+				assert.EqualError(err, test.err)
+				assert.Nil(cred)
+			} else if assert.NoError(err) {
+				assert.Equal(test.deprecated, cred.Deprecated)
+				assert.False(ba.creds["user"][0].Deprecated && !test.cred.Deprecated, "the stored credential isn't changed")
+			}
+			counter, ok := registry.Get("log-iss.auth.user.current." + test.metric).(metrics.Counter)
+			if assert.True(ok) {
+				assert.Equal(int64(1), counter.Count())
+			}
+		})
+	}
+}
+
+func TestAuthenticateSharedPassword(t *testing.T) {
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	expired := now.Add(-time.Hour)
+	ba := NewBasicAuth(metrics.NewRegistry(), "hmacKey")
+	ba.now = func() time.Time { return now }
+	ba.creds["user"] = []credential{
+		{Stage: "previous", Hmac: hmacEncode("hmacKey", "password"), ExpiresAt: &expired},
+		{Stage: "current", Hmac: hmacEncode("hmacKey", "password")},
+	}
+
+	r, _ := http.NewRequest("POST", "http://localhost", nil)
+	r.SetBasicAuth("user", "password")
+	cred, err := ba.Authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "current", cred.Stage)
+
+	r.SetBasicAuth("user", "wrong")
+	_, err = ba.Authenticate(r)
+	assert.Equal(t, errAuthFailed, err)
+}
+
+func TestCredentialScheduleJSON(t *testing.T) {
+	var creds []credential
+	err := json.Unmarshal([]byte(`[{"name":"a","hmac":"x","not_before":"2026-06-01T00:00:00Z","deprecate_after":"2026-07-01T00:00:00Z","expires_at":"2026-08-01T00:00:00+02:00"}]`), &creds)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC), creds[0].NotBefore.UTC())
+	assert.Equal(t, time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC), creds[0].DeprecateAfter.UTC())
+	assert.Equal(t, time.Date(2026, 7, 31, 22, 0, 0, 0, time.UTC), creds[0].ExpiresAt.UTC())
+}
+
+func TestSetDeprecationHeaders(t *testing.T) {
+	deprecate := time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC)
+	expires := time.Date(2026, 8, 1, 0, 0, 0, 0, time.UTC)
+
+	h := make(http.Header)
+	setDeprecationHeaders(h, &credential{Deprecated: true})
+	assert.Equal(t, "true", h.Get("Deprecation"))
+	assert.Equal(t, "", h.Get("Sunset"))
+	assert.Equal(t, `299 log-iss "Credential is deprecated"`, h.Get("Warning"))
+
+	h = make(http.Header)
+	setDeprecationHeaders(h, &credential{Deprecated: true, DeprecateAfter: &deprecate, ExpiresAt: &expires})
+	assert.Equal(t, "@1782864000", h.Get("Deprecation"))
+	assert.Equal(t, "Sat, 01 Aug 2026 00:00:00 GMT", h.Get("Sunset"))
+	assert.Equal(t, `299 log-iss "Credential is deprecated and expires at 2026-08-01T00:00:00Z"`, h.Get("Warning"))
+
+	name, labels := prometheusName("log-iss.auth.user.current.expired")
+	assert.Equal(t, "log_iss_auth_credential_expired", name)
+	assert.Equal(t, map[string]string{"user": "user", "stage": "current"}, labels)
+}
+
+func TestParseHmacKeys(t *testing.T) {
+	keys, err := parseHmacKeys("old", []string{"2:new", "3:newer:with:colons"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"": "old", "2": "new", "3": "newer:with:colons"}, keys)
+
+	_, err = parseHmacKeys("old", []string{"secret"})
+	assert.EqualError(t, err, "HMAC_KEYS entries must be key_id:key")
+	_, err = parseHmacKeys("old", []string{"2:a", "2:b"})
+	assert.EqualError(t, err, `HMAC_KEYS has key_id "2" more than once`)
+}
+
+func TestAuthenticateKeyID(t *testing.T) {
+	tests := map[string]struct {
+		cred credential
+		ok   bool
+	}{
+		"HMAC_KEY":               {cred: credential{Hmac: hmacEncode("old", "password")}, ok: true},
+		"HMAC_KEYS":              {cred: credential{KeyID: "2", Hmac: hmacEncode("new", "password")}, ok: true},
+		"wrong key":              {cred: credential{KeyID: "2", Hmac: hmacEncode("old", "password")}},
+		"unknown key":            {cred: credential{KeyID: "3", Hmac: hmacEncode("new", "password")}},
+		"HMAC_KEY without an ID": {cred: credential{Hmac: hmacEncode("new", "password")}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ba, err := newAuth(AuthConfig{HmacKey: "old", HmacKeys: []string{"2:new"}, Tokens: "env:token"}, metrics.NewRegistry())
+			if !assert.NoError(t, err) {
+				return
+			}
+			ba.creds["user"] = []credential{test.cred}
+			r, _ := http.NewRequest("POST", "http://localhost", nil)
+			r.SetBasicAuth("user", "password")
+			cred, _ := ba.Authenticate(r)
+			assert.Equal(t, test.ok, cred != nil)
+		})
+	}
+}
+
+func BenchmarkAuthenticate(b *testing.B) {
+	benchmarkAuthenticate(b, "password", defaultAuthCacheSize)
+}
+
+func BenchmarkAuthenticateUncached(b *testing.B) {
+	benchmarkAuthenticate(b, "password", 0)
+}
+
+func BenchmarkAuthenticateFailure(b *testing.B) {
+	benchmarkAuthenticate(b, "wrong", defaultAuthCacheSize)
+}
+
+// Benchmark authenticating with the last of a user's three credentials, as
+// during a roll, from as many goroutines as GOMAXPROCS. Run with -cpu to
+// compare throughput per core.
+func benchmarkAuthenticate(b *testing.B, password string, cacheSize int) {
+	ba := NewBasicAuth(metrics.NewRegistry(), "hmacKey")
+	ba.cache = newAuthCache(cacheSize)
+	ba.AddPrincipal("user", hmacEncode("hmacKey", "previous"), "previous")
+	ba.AddPrincipal("user", hmacEncode("hmacKey", "next"), "next")
+	ba.AddPrincipal("user", hmacEncode("hmacKey", "password"), "current")
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(log.InfoLevel)
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		r, _ := http.NewRequest("POST", "http://localhost", nil)
+		r.SetBasicAuth("user", password)
+		for pb.Next() {
+			ba.Authenticate(r)
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// authCache remembers recent successful verifications, so a client's password
+// isn't hashed again on every request. Entries are keyed by a digest of the
+// user and password keyed with a secret random to the process, so the cache
+// holds nothing that could be checked against guesses offline. It holds up to
+// size entries, evicting an arbitrary one when full, and must be cleared
+// whenever the credentials change.
+type authCache struct {
+	mu      sync.Mutex
+	size    int
+	secret  [32]byte
+	entries map[[sha256.Size]byte]authCacheEntry
+}
+
+type authCacheEntry struct {
+	cred      credential
+	successes metrics.Counter // the credential's successes counter
+}
+
+func newAuthCache(size int) *authCache {
+	c := &authCache{size: size, entries: make(map[[sha256.Size]byte]authCacheEntry)}
+	if _, err := rand.Read(c.secret[:]); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// Digest returns the key user and pass are cached under. Each is prefixed
+// with its length, so no other user and password have the same digest.
+func (c *authCache) Digest(user, pass string) [sha256.Size]byte {
+	var buf [256]byte
+	b := append(buf[:0], c.secret[:]...)
+	b = appendLengthPrefixed(b, user)
+	b = appendLengthPrefixed(b, pass)
+	return sha256.Sum256(b)
+}
+
+func appendLengthPrefixed(b []byte, s string) []byte {
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], uint64(len(s)))
+	return append(append(b, n[:]...), s...)
+}
+
+func (c *authCache) Get(digest [sha256.Size]byte) (authCacheEntry, bool) {
+	if c.size <= 0 {
+		return authCacheEntry{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[digest]
+	return e, ok
+}
+
+func (c *authCache) Put(digest [sha256.Size]byte, e authCacheEntry) {
+	if c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[digest]; !ok && len(c.entries) >= c.size {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[digest] = e
+}
+
+func (c *authCache) Delete(digest [sha256.Size]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, digest)
+}
+
+// Clear forgets every verification, for when credentials change.
+func (c *authCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[[sha256.Size]byte]authCacheEntry)
+}
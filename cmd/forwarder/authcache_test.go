@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/elliotchance/redismock"
+	"github.com/go-redis/redis"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func authRequest(user, password string) *http.Request {
+	r, _ := http.NewRequest("POST", "http://localhost", nil)
+	r.SetBasicAuth(user, password)
+	return r
+}
+
+func TestAuthCache(t *testing.T) {
+	assert := assert.New(t)
+	c := newAuthCache(2)
+	a, b := c.Digest("user", "a"), c.Digest("user", "b")
+	assert.NotEqual(a, b)
+	assert.NotEqual(c.Digest("usera", ""), c.Digest("user", "a"), "user and password are delimited")
+	assert.NotEqual(c.Digest("a\x00b", "c"), c.Digest("a", "b\x00c"), "delimiters in the user and password are unambiguous")
+	assert.NotEqual(a, newAuthCache(2).Digest("user", "a"), "digests are keyed")
+
+	c.Put(a, authCacheEntry{cred: credential{Stage: "a"}})
+	c.Put(b, authCacheEntry{cred: credential{Stage: "b"}})
+	e, ok := c.Get(a)
+	assert.True(ok)
+	assert.Equal("a", e.cred.Stage)
+
+	c.Put(c.Digest("user", "c"), authCacheEntry{})
+	assert.Equal(2, len(c.entries), "the cache is bounded")
+
+	c.Clear()
+	_, ok = c.Get(a)
+	assert.False(ok)
+
+	disabled := newAuthCache(0)
+	disabled.Put(a, authCacheEntry{})
+	_, ok = disabled.Get(a)
+	assert.False(ok)
+}
+
+func TestAuthenticateCaches(t *testing.T) {
+	assert := assert.New(t)
+	registry := metrics.NewRegistry()
+	ba := NewBasicAuth(registry, "hmacKey")
+	ba.AddPrincipal("user", hmacEncode("hmacKey", "password"), "current")
+
+	for i := 0; i < 2; i++ {
+		cred, err := ba.Authenticate(authRequest("user", "password"))
+		assert.NoError(err)
+		assert.Equal("current", cred.Stage)
+	}
+	assert.Equal(1, len(ba.cache.entries))
+	assert.Equal(int64(2), registry.Get("log-iss.auth.user.current.successes").(metrics.Counter).Count(), "cached verifications are counted")
+
+	cred, _ := ba.Authenticate(authRequest("user", "password"))
+	cred.Stage = "changed"
+	cred, _ = ba.Authenticate(authRequest("user", "password"))
+	assert.Equal("current", cred.Stage, "callers get a copy of the cached credential")
+
+	_, err := ba.Authenticate(authRequest("user", "wrong"))
+	assert.Equal(errAuthFailed, err)
+	assert.Equal(1, len(ba.cache.entries), "failures aren't cached")
+}
+
+func TestAuthenticateCacheInvalidation(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	expires := now.Add(time.Hour)
+	ba := NewBasicAuth(metrics.NewRegistry(), "hmacKey")
+	ba.now = func() time.Time { return now }
+	ba.creds["user"] = []credential{{Stage: "current", Hmac: hmacEncode("hmacKey", "password"), ExpiresAt: &expires}}
+
+	_, err := ba.Authenticate(authRequest("user", "password"))
+	assert.NoError(err)
+	now = expires
+	_, err = ba.Authenticate(authRequest("user", "password"))
+	assert.EqualError(err, "Credential expired at 2026-06-01T13:00:00Z", "cached credentials still expire")
+
+	now = time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	_, err = ba.Authenticate(authRequest("user", "password"))
+	assert.NoError(err)
+	r := redismock.NewMock()
+	r.On("HGetAll").Return(redis.NewStringStringMapResult(map[string]string{
+		"user": marshal([]credential{{Stage: "current", Hmac: hmacEncode("hmacKey", "rolled")}}),
+	}, nil))
+	changed, err := ba.refresh(r, "hmacKey", "key", "")
+	assert.True(changed)
+	assert.NoError(err)
+	_, err = ba.Authenticate(authRequest("user", "password"))
+	assert.Equal(errAuthFailed, err, "refreshing credentials clears the cache")
+	_, err = ba.Authenticate(authRequest("user", "rolled"))
+	assert.NoError(err)
+}
+
+func TestAuthenticateStaleIsntCached(t *testing.T) {
+	now := time.Unix(10000, 0)
+	ba := refreshedCreds(now.Add(-2*time.Hour), "")
+	ba.now = func() time.Time { return now }
+	ba.cache = newAuthCache(defaultAuthCacheSize)
+
+	_, err := ba.Authenticate(authRequest("user", "password"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(ba.cache.entries))
+}
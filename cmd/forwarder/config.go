@@ -15,10 +15,26 @@ import (
 
 type IssConfig struct {
 	Deploy                    string        `env:"DEPLOY,required"`
-	ForwardDest               string        `env:"FORWARD_DEST,required"`
+	ForwardDest               []string      `env:"FORWARD_DEST,required"`
+	ForwardDestPolicy         string        `env:"FORWARD_DEST_POLICY,default=failover"`
 	ForwardDestConnectTimeout time.Duration `env:"FORWARD_DEST_CONNECT_TIMEOUT,default=10s"`
 	ForwardCount              int           `env:"FORWARD_COUNT,default=4"`
+	ForwardProtocol           string        `env:"FORWARD_PROTOCOL,default=tcp"`
+	ForwardRELPWindow         int           `env:"FORWARD_RELP_WINDOW,default=128"`
+	ForwardRELPTimeout        time.Duration `env:"FORWARD_RELP_TIMEOUT,default=10s"`
+	ForwardFormat             string        `env:"FORWARD_FORMAT,default=rfc5424"`
+	ForwardFraming            string        `env:"FORWARD_FRAMING"`
 	HttpPort                  string        `env:"PORT,required"`
+	AdminPort                 string        `env:"ADMIN_PORT"`
+	RateLimitRedisUrl         string        `env:"RATE_LIMIT_REDIS_URL"`
+	DedupRedisUrl             string        `env:"DEDUP_REDIS_URL"`
+	DedupTTL                  time.Duration `env:"LOG_ISS_DEDUP_TTL"`
+	DedupSize                 int           `env:"LOG_ISS_DEDUP_SIZE,default=100000"`
+	DedupBodyHash             bool          `env:"LOG_ISS_DEDUP_BODY_HASH"`
+	LoadShedInboxFill         float64       `env:"LOAD_SHED_INBOX_FILL"`
+	LoadShedLatency           time.Duration `env:"LOAD_SHED_LATENCY"`
+	LoadShedStatus            int           `env:"LOAD_SHED_STATUS,default=503"`
+	LoadShedRetryAfter        time.Duration `env:"LOAD_SHED_RETRY_AFTER,default=5s"`
 	EnforceSsl                bool          `env:"ENFORCE_SSL,default=false"`
 	PemFile                   string        `env:"PEMFILE"`
 	LibratoSource             string        `env:"LIBRATO_SOURCE"`
@@ -29,22 +45,63 @@ type IssConfig struct {
 	Debug                     bool          `env:"LOG_ISS_DEBUG"`
 	QueryFieldParams          []string      `env:"LOG_ISS_FIELD_PARAMS"`
 	QueryParams               []string      `env:"LOG_ISS_QUERY_PARAMS"`
+	LenientParsing            bool          `env:"LOG_ISS_LENIENT_PARSING"`
+	ChunkBytes                int           `env:"LOG_ISS_CHUNK_BYTES,default=1048576"`
+	MaxFrameBytes             int           `env:"LOG_ISS_MAX_FRAME_BYTES"`
+	LegacyStructuredData      bool          `env:"LOG_ISS_LEGACY_SD"`
+	Pipeline                  []string      `env:"LOG_ISS_PIPELINE,default=hostname;truncate;origin;metadata;filter;redact"`
+	FilterRules               string        `env:"LOG_ISS_FILTER_RULES"`
+	L2metSink                 string        `env:"L2MET_SINK,default=registry"`
+	L2metStatsdAddr           string        `env:"L2MET_STATSD_ADDR"`
+	L2metFlushInterval        time.Duration `env:"L2MET_FLUSH_INTERVAL,default=60s"`
+	L2metMaxSeries            int           `env:"L2MET_MAX_SERIES,default=10000"`
+	L2metSeriesIdle           time.Duration `env:"L2MET_SERIES_IDLE,default=10m"`
+	RedactRules               string        `env:"LOG_ISS_REDACT_RULES"`
+	RedactHashKey             string        `env:"LOG_ISS_REDACT_HASH_KEY"`
+	SyslogTCPPort             string        `env:"SYSLOG_TCP_PORT"`
+	SyslogTCPToken            string        `env:"SYSLOG_TCP_TOKEN"`
+	SyslogTLSPort             string        `env:"SYSLOG_TLS_PORT"`
+	SyslogTLSToken            string        `env:"SYSLOG_TLS_TOKEN"`
+	SyslogTLSCert             string        `env:"SYSLOG_TLS_CERT"`
+	SyslogTLSKey              string        `env:"SYSLOG_TLS_KEY"`
+	SyslogTLSClientCA         string        `env:"SYSLOG_TLS_CLIENT_CA"`
+	SyslogUDPPort             string        `env:"SYSLOG_UDP_PORT"`
+	SyslogUDPToken            string        `env:"SYSLOG_UDP_TOKEN"`
+	SyslogHandshakeTimeout    time.Duration `env:"SYSLOG_HANDSHAKE_TIMEOUT,default=10s"`
+	SyslogIdleTimeout         time.Duration `env:"SYSLOG_IDLE_TIMEOUT,default=5m"`
+	Routes                    string        `env:"LOG_ISS_ROUTES"`
+	SpoolDir                  string        `env:"SPOOL_DIR"`
+	SpoolMaxBytes             int64         `env:"SPOOL_MAX_BYTES,default=1073741824"`
+	SpoolSegmentBytes         int64         `env:"SPOOL_SEGMENT_BYTES,default=67108864"`
+	SpoolPolicy               string        `env:"SPOOL_POLICY,default=reject"`
 	TlsConfig                 *tls.Config
+	SyslogTlsConfig           *tls.Config
 	MetricsRegistry           metrics.Registry
 }
 
 type AuthConfig struct {
 	HmacKey         string        `env:"HMAC_KEY,required"`
+	HmacKeys        []string      `env:"HMAC_KEYS"`
+	CacheSize       int           `env:"CREDENTIAL_CACHE_SIZE,default=10000"`
 	RedisUrl        string        `env:"REDIS_URL"`
 	RedisKey        string        `env:"REDIS_KEY"`
 	RefreshInterval time.Duration `env:"CREDENTIAL_REFRESH_INTERVAL,default=1m,strict"`
+	RefreshChannel  string        `env:"CREDENTIAL_REFRESH_CHANNEL"`
+	MaxAge          time.Duration `env:"CREDENTIAL_MAX_AGE"`
+	StalePolicy     string        `env:"CREDENTIAL_STALE_POLICY,default=token-map"`
 	Tokens          string        `env:"TOKEN_MAP"`
 }
 
 func NewAuthConfig() (AuthConfig, error) {
 	var config AuthConfig
-	err := envdecode.Decode(&config)
-	return config, err
+	if err := envdecode.Decode(&config); err != nil {
+		return config, err
+	}
+
+	if config.StalePolicy != credentialStaleTokenMap && config.StalePolicy != credentialStaleFailClosed {
+		return config, fmt.Errorf("CREDENTIAL_STALE_POLICY must be one of %s or %s", credentialStaleTokenMap, credentialStaleFailClosed)
+	}
+	return config, nil
 }
 
 func NewIssConfig() (IssConfig, error) {
@@ -68,6 +125,61 @@ func NewIssConfig() (IssConfig, error) {
 		config.TlsConfig = &tls.Config{RootCAs: cp}
 	}
 
+	if config.SyslogTLSCert != "" || config.SyslogTLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(config.SyslogTLSCert, config.SyslogTLSKey)
+		if err != nil {
+			return config, fmt.Errorf("Unable to load syslog TLS certificate: %s", err)
+		}
+
+		config.SyslogTlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+		if config.SyslogTLSClientCA != "" {
+			caData, err := ioutil.ReadFile(config.SyslogTLSClientCA)
+			if err != nil {
+				return config, fmt.Errorf("Unable to read syslog client CA: %s", err)
+			}
+
+			cp := x509.NewCertPool()
+			if ok := cp.AppendCertsFromPEM(caData); !ok {
+				return config, fmt.Errorf("Error parsing PEM: %s", config.SyslogTLSClientCA)
+			}
+
+			config.SyslogTlsConfig.ClientCAs = cp
+			config.SyslogTlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			if config.SyslogTLSToken != "" {
+				// Clients without a certificate authenticate with the token.
+				config.SyslogTlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+		}
+	}
+
+	if config.SpoolPolicy != spoolPolicyReject && config.SpoolPolicy != spoolPolicyDropOldest {
+		return config, fmt.Errorf("SPOOL_POLICY must be one of %s or %s", spoolPolicyReject, spoolPolicyDropOldest)
+	}
+
+	if config.ForwardProtocol != forwardProtocolTCP && config.ForwardProtocol != forwardProtocolRELP {
+		return config, fmt.Errorf("FORWARD_PROTOCOL must be one of %s or %s", forwardProtocolTCP, forwardProtocolRELP)
+	}
+
+	if !config.LegacyStructuredData {
+		if config.MetadataId != "" && !validSDName(config.MetadataId) {
+			return config, fmt.Errorf("METADATA_ID %q is not a valid SD-ID", config.MetadataId)
+		}
+		for _, p := range config.QueryParams {
+			if !validSDName(p) {
+				return config, fmt.Errorf("LOG_ISS_QUERY_PARAMS entry %q is not a valid PARAM-NAME", p)
+			}
+		}
+	}
+
+	if config.LoadShedStatus != 503 && config.LoadShedStatus != 429 {
+		return config, fmt.Errorf("LOAD_SHED_STATUS must be 503 or 429")
+	}
+
+	if config.ForwardRELPWindow < 1 {
+		return config, fmt.Errorf("FORWARD_RELP_WINDOW must be at least 1")
+	}
+
 	sp := make([]string, 0, 2)
 	if config.LibratoSource != "" {
 		sp = append(sp, config.LibratoSource)
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	metrics "github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const dedupRedisPrefix = "log-iss:dedup"
+
+// dedupStore remembers the chunks of requests which have been delivered, so
+// they aren't forwarded again when a client retries the request. A chunk is
+// claimed before it's delivered, so concurrent retries can't both deliver it.
+type dedupStore interface {
+	// Claim remembers key for the TTL, reporting false if it already was.
+	Claim(key string) bool
+	// Release forgets key, for when delivering its chunk failed.
+	Release(key string)
+}
+
+// newDedupStore returns a store shared between all instances through Redis if
+// DEDUP_REDIS_URL is set, or one local to this process otherwise. It returns
+// nil if LOG_ISS_DEDUP_TTL is 0, the default, disabling deduplication.
+func newDedupStore(config IssConfig) (dedupStore, error) {
+	if config.DedupTTL <= 0 {
+		return nil, nil
+	}
+	if config.DedupRedisUrl == "" {
+		return newLocalDedupStore(config.DedupSize, config.DedupTTL), nil
+	}
+
+	client, _, err := newRedisClient(config.DedupRedisUrl)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse DEDUP_REDIS_URL: %s", err)
+	}
+	return newRedisDedupStore(client, config.DedupTTL, config.MetricsRegistry), nil
+}
+
+// requestDedup names the chunks of one request. Chunks are remembered
+// individually, so retrying a request that failed part way through only
+// forwards the chunks that weren't delivered. Keys are scoped by the Basic
+// Auth user and drain token, so different tenants' requests never match.
+//
+// A request is identified by its Logplex-Frame-Id, which logplex and
+// log-shuttle keep the same when retrying. Without one, a chunk is identified
+// by a hash of the request's frames up to and including it, but only if
+// bodyHash is set: a body sent again on purpose would be dropped as well.
+type requestDedup struct {
+	scope   string
+	frameID string
+	n       int
+	hash    hash.Hash
+}
+
+// newRequestDedup returns nil if req's chunks can't be identified.
+func newRequestDedup(req *http.Request, logplexDrainToken string, bodyHash bool) *requestDedup {
+	d := &requestDedup{frameID: req.Header.Get(logplexFrameIDHeader)}
+	if d.frameID == "" {
+		if !bodyHash {
+			return nil
+		}
+		d.hash = sha256.New()
+	}
+	user, _, _ := req.BasicAuth()
+	d.scope = url.PathEscape(user) + "/" + url.PathEscape(logplexDrainToken) + "/"
+	return d
+}
+
+// Key returns the key for the request's next chunk, b.
+func (d *requestDedup) Key(b []byte) string {
+	if d.hash != nil {
+		d.hash.Write(b)
+		return d.scope + hex.EncodeToString(d.hash.Sum(nil))
+	}
+	key := d.scope + d.frameID + "/" + strconv.Itoa(d.n)
+	d.n++
+	return key
+}
+
+// localDedupStore remembers up to size keys, forgetting the least recently
+// used first.
+type localDedupStore struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	order *list.List // of *dedupEntry, most recently used first
+	keys  map[string]*list.Element
+	now   func() time.Time
+}
+
+type dedupEntry struct {
+	key     string
+	expires time.Time
+}
+
+func newLocalDedupStore(size int, ttl time.Duration) *localDedupStore {
+	return &localDedupStore{
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		keys:  make(map[string]*list.Element),
+		now:   time.Now,
+	}
+}
+
+func (s *localDedupStore) Claim(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if e, ok := s.keys[key]; ok {
+		if now.Before(e.Value.(*dedupEntry).expires) {
+			s.order.MoveToFront(e)
+			return false
+		}
+		s.remove(e)
+	}
+	s.keys[key] = s.order.PushFront(&dedupEntry{key: key, expires: now.Add(s.ttl)})
+	for s.order.Len() > s.size {
+		s.remove(s.order.Back())
+	}
+	return true
+}
+
+func (s *localDedupStore) Release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.keys[key]; ok {
+		s.remove(e)
+	}
+}
+
+func (s *localDedupStore) remove(e *list.Element) {
+	s.order.Remove(e)
+	delete(s.keys, e.Value.(*dedupEntry).key)
+}
+
+// redisDedupStore remembers keys in Redis so retries are recognised by any
+// instance. If Redis is unavailable, every claim succeeds, preferring
+// duplicates to lost logs.
+type redisDedupStore struct {
+	client redis.Cmdable
+	ttl    time.Duration
+	errors metrics.Counter // counts failures talking to Redis
+}
+
+func newRedisDedupStore(client redis.Cmdable, ttl time.Duration, registry metrics.Registry) *redisDedupStore {
+	return &redisDedupStore{
+		client: client,
+		ttl:    ttl,
+		errors: metrics.GetOrRegisterCounter("log-iss.dedup.redis.errors", registry),
+	}
+}
+
+func (s *redisDedupStore) Claim(key string) bool {
+	claimed, err := s.client.SetNX(dedupRedisPrefix+":"+key, 1, s.ttl).Result()
+	if err != nil {
+		s.error(err)
+		return true
+	}
+	return claimed
+}
+
+func (s *redisDedupStore) Release(key string) {
+	if err := s.client.Del(dedupRedisPrefix + ":" + key).Err(); err != nil {
+		s.error(err)
+	}
+}
+
+func (s *redisDedupStore) error(err error) {
+	s.errors.Inc(1)
+	log.WithFields(log.Fields{"ns": "dedup", "at": "error", "message": err}).Error()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elliotchance/redismock"
+	"github.com/go-redis/redis"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyDeliverer records payloads, failing each one listed in fail, counting
+// from 1.
+type flakyDeliverer struct {
+	recordingDeliverer
+	n    int
+	fail map[int]bool
+}
+
+func (d *flakyDeliverer) Deliver(p payload) error {
+	d.n++
+	if d.fail[d.n] {
+		return errors.New("Timed out")
+	}
+	return d.recordingDeliverer.Deliver(p)
+}
+
+func TestLocalDedupStore(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Unix(1000, 0)
+	s := newLocalDedupStore(2, time.Minute)
+	s.now = func() time.Time { return now }
+
+	assert.True(s.Claim("a"))
+	assert.False(s.Claim("a"), "a key can only be claimed once")
+
+	assert.True(s.Claim("b"))
+	s.Release("b")
+	assert.True(s.Claim("b"), "released keys can be claimed again")
+
+	s.Claim("a")
+	assert.True(s.Claim("c"))
+	assert.True(s.Claim("b"), "the least recently used key is forgotten")
+	assert.False(s.Claim("c"))
+
+	now = now.Add(time.Minute)
+	assert.True(s.Claim("c"), "keys are forgotten after the TTL")
+}
+
+func TestLocalDedupStoreConcurrentClaims(t *testing.T) {
+	s := newLocalDedupStore(100, time.Minute)
+	var claimed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s.Claim("a") {
+				atomic.AddInt32(&claimed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), claimed)
+}
+
+func TestRedisDedupStore(t *testing.T) {
+	assert := assert.New(t)
+	r := redismock.NewMock()
+	r.On("SetNX").Return(redis.NewBoolResult(true, nil)).Once()
+	r.On("SetNX").Return(redis.NewBoolResult(false, nil)).Once()
+	r.On("Del").Return(redis.NewIntResult(1, nil)).Once()
+	r.On("SetNX").Return(redis.NewBoolResult(false, errors.New("connection refused"))).Once()
+
+	registry := metrics.NewRegistry()
+	s := newRedisDedupStore(r, time.Minute, registry)
+	assert.True(s.Claim("a"))
+	assert.False(s.Claim("a"))
+	s.Release("a")
+	assert.True(s.Claim("a"), "claims succeed when Redis is unavailable")
+	assert.Equal(int64(1), s.errors.Count())
+	r.AssertExpectations(t)
+}
+
+func TestProcessWithoutFrameID(t *testing.T) {
+	assert := assert.New(t)
+	config := *getConfig()
+	config.MetricsRegistry = metrics.NewRegistry()
+	p, err := newPipeline(config)
+	if !assert.NoError(err) {
+		return
+	}
+	d := &recordingDeliverer{}
+	s := newHTTPServer(config, nil, nil, newLocalDedupStore(100, time.Minute), p.Fix, d)
+
+	body := logplexBody(5)
+	for i := 0; i < 2; i++ {
+		_, err, status := s.process(simpleHttpRequest(), bytes.NewReader(body), "", "", "", "", nil)
+		assert.NoError(err)
+		assert.Equal(200, status)
+	}
+	assert.Equal(string(body)+string(body), d.bodies(), "bodies sent again aren't dropped by default")
+}
+
+func TestRequestDedupKey(t *testing.T) {
+	assert := assert.New(t)
+	request := func(user string) *http.Request {
+		req := simpleHttpRequest()
+		req.SetBasicAuth(user, "pass")
+		return req
+	}
+
+	req := request("shuttle")
+	req.Header.Set(logplexFrameIDHeader, "frame-1")
+	d := newRequestDedup(req, "d.1234", false)
+	assert.Equal("shuttle/d.1234/frame-1/0", d.Key([]byte("a")))
+	assert.Equal("shuttle/d.1234/frame-1/1", d.Key([]byte("b")))
+
+	req = request("other")
+	req.Header.Set(logplexFrameIDHeader, "frame-1")
+	assert.Equal("other/d.1234/frame-1/0", newRequestDedup(req, "d.1234", false).Key([]byte("a")),
+		"keys are scoped by user")
+
+	assert.Nil(newRequestDedup(request("shuttle"), "", false), "body hashes are only used when enabled")
+
+	a := newRequestDedup(request("shuttle"), "", true)
+	b := newRequestDedup(request("shuttle"), "", true)
+	assert.Equal(a.Key([]byte("a")), b.Key([]byte("a")))
+	assert.NotEqual(a.Key([]byte("b")), b.Key([]byte("c")))
+	assert.NotEqual(a.Key([]byte("d")), newRequestDedup(request("shuttle"), "", true).Key([]byte("d")),
+		"without a frame ID, a chunk's key covers the chunks before it")
+	assert.NotEqual(newRequestDedup(request("other"), "", true).Key([]byte("a")),
+		newRequestDedup(request("shuttle"), "", true).Key([]byte("a")))
+}
+
+func TestProcessSkipsDeliveredChunks(t *testing.T) {
+	tests := map[string]string{
+		"frame ID":  "frame-1",
+		"body hash": "",
+	}
+
+	for name, frameID := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			config := *getConfig()
+			config.ChunkBytes = 1000
+			config.DedupBodyHash = true
+			config.MetricsRegistry = metrics.NewRegistry()
+			p, err := newPipeline(config)
+			if !assert.NoError(err) {
+				return
+			}
+			d := &flakyDeliverer{fail: map[int]bool{2: true}}
+			s := newHTTPServer(config, nil, nil, newLocalDedupStore(100, time.Minute), p.Fix, d)
+
+			body := logplexBody(25)
+			req := simpleHttpRequest()
+			req.Header.Set(logplexFrameIDHeader, frameID)
+			_, err, status := s.process(req, bytes.NewReader(body), "", "", "", "", nil)
+			assert.Error(err)
+			assert.Equal(504, status)
+			assert.Equal(1, len(d.payloads))
+
+			r, err, status := s.process(req, bytes.NewReader(body), "", "", "", "", nil)
+			assert.NoError(err)
+			assert.Equal(200, status)
+			assert.True(r.duplicates > 0)
+			retried := r.duplicates
+			assert.Equal(string(body), d.bodies(), "the retry only forwards chunks which weren't delivered")
+
+			r, err, status = s.process(req, bytes.NewReader(body), "", "", "", "", nil)
+			assert.NoError(err)
+			assert.Equal(200, status)
+			assert.Equal(int64(25), r.duplicates)
+			assert.Equal(string(body), d.bodies(), "a delivered request isn't forwarded again")
+			assert.Equal(retried+25, s.pDuplicates.Count())
+		})
+	}
+}
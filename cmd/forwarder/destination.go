@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	destinationPolicyFailover         = "failover"
+	destinationPolicyRoundRobin       = "round-robin"
+	destinationPolicyLeastOutstanding = "least-outstanding"
+
+	minDestinationBackoff = 200 * time.Millisecond
+	maxDestinationBackoff = 30 * time.Second
+)
+
+var destinationPolicies = []string{destinationPolicyFailover, destinationPolicyRoundRobin, destinationPolicyLeastOutstanding}
+
+// destination is one of the hosts logs are forwarded to. A destination is
+// unhealthy after a connection or write error and isn't tried again until its
+// backoff, which doubles with each consecutive failure, has elapsed.
+type destination struct {
+	Addr        string
+	mu          sync.Mutex
+	failures    uint
+	retryAt     time.Time
+	outstanding int64
+
+	healthy     metrics.Gauge   // 1 if the destination is healthy, 0 otherwise
+	inflight    metrics.Gauge   // tracks the number of writes in progress
+	cErrors     metrics.Counter // counts connection errors
+	cSuccesses  metrics.Counter // counts connection successes
+	wErrors     metrics.Counter // counts write errors
+	wSuccesses  metrics.Counter // counts write successes
+	transitions metrics.Counter // counts changes between healthy and unhealthy
+}
+
+func newDestination(addr string, registry metrics.Registry) *destination {
+	me := "log-iss.destination." + strings.NewReplacer(".", "_", ":", "_").Replace(addr)
+	d := &destination{
+		Addr:        addr,
+		healthy:     metrics.GetOrRegisterGauge(me+".healthy", registry),
+		inflight:    metrics.GetOrRegisterGauge(me+".outstanding", registry),
+		cErrors:     metrics.GetOrRegisterCounter(me+".connect.errors", registry),
+		cSuccesses:  metrics.GetOrRegisterCounter(me+".connect.successes", registry),
+		wErrors:     metrics.GetOrRegisterCounter(me+".write.errors", registry),
+		wSuccesses:  metrics.GetOrRegisterCounter(me+".write.successes", registry),
+		transitions: metrics.GetOrRegisterCounter(me+".transitions", registry),
+	}
+	d.healthy.Update(1)
+	return d
+}
+
+// Available reports whether the destination is healthy or due to be retried.
+func (d *destination) Available(now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !now.Before(d.retryAt)
+}
+
+// MarkFailure marks the destination unhealthy and extends its backoff.
+func (d *destination) MarkFailure() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	backoff := maxDestinationBackoff
+	if d.failures < 16 {
+		if b := minDestinationBackoff << d.failures; b < maxDestinationBackoff {
+			backoff = b
+		}
+	}
+	d.failures++
+	d.retryAt = time.Now().Add(backoff)
+
+	if d.failures == 1 {
+		d.transitions.Inc(1)
+		log.WithFields(log.Fields{"ns": "destination", "at": "unhealthy", "dest": d.Addr}).Warn()
+	}
+	d.healthy.Update(0)
+}
+
+// MarkSuccess marks the destination healthy and resets its backoff.
+func (d *destination) MarkSuccess() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.failures > 0 {
+		d.transitions.Inc(1)
+		log.WithFields(log.Fields{"ns": "destination", "at": "healthy", "dest": d.Addr}).Info()
+	}
+	d.failures = 0
+	d.retryAt = time.Time{}
+	d.healthy.Update(1)
+}
+
+func (d *destination) begin() {
+	d.inflight.Update(atomic.AddInt64(&d.outstanding, 1))
+}
+
+func (d *destination) end() {
+	d.inflight.Update(atomic.AddInt64(&d.outstanding, -1))
+}
+
+func (d *destination) Outstanding() int64 {
+	return atomic.LoadInt64(&d.outstanding)
+}
+
+func (d *destination) nextRetry() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.retryAt
+}
+
+// destinationPool picks which destination each payload is written to.
+//   - failover: the first available destination in the order configured, so
+//     traffic moves back to the primary as soon as it recovers.
+//   - round-robin: rotate through available destinations.
+//   - least-outstanding: the available destination with the fewest writes in
+//     progress.
+type destinationPool struct {
+	policy       string
+	destinations []*destination
+	next         uint64
+}
+
+func newDestinationPool(addrs []string, policy string, registry metrics.Registry) (*destinationPool, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("At least one destination is required")
+	}
+	if !containsString(destinationPolicies, policy) {
+		return nil, fmt.Errorf("Unknown destination policy %q, must be one of %s", policy, strings.Join(destinationPolicies, ", "))
+	}
+
+	dp := &destinationPool{policy: policy}
+	for _, addr := range addrs {
+		dp.destinations = append(dp.destinations, newDestination(addr, registry))
+	}
+	return dp, nil
+}
+
+// Pick returns the destination to write the next payload to, or nil if all
+// destinations are backing off.
+func (dp *destinationPool) Pick() *destination {
+	now := time.Now()
+
+	switch dp.policy {
+	case destinationPolicyRoundRobin:
+		n := uint64(len(dp.destinations))
+		start := atomic.AddUint64(&dp.next, 1) - 1
+		for i := uint64(0); i < n; i++ {
+			if d := dp.destinations[(start+i)%n]; d.Available(now) {
+				return d
+			}
+		}
+
+	case destinationPolicyLeastOutstanding:
+		var best *destination
+		for _, d := range dp.destinations {
+			if d.Available(now) && (best == nil || d.Outstanding() < best.Outstanding()) {
+				best = d
+			}
+		}
+		return best
+
+	default:
+		for _, d := range dp.destinations {
+			if d.Available(now) {
+				return d
+			}
+		}
+	}
+
+	return nil
+}
+
+// Wait blocks until the first destination is due to be retried or ctx is done.
+func (dp *destinationPool) Wait(ctx context.Context) {
+	var first time.Time
+	for _, d := range dp.destinations {
+		if r := d.nextRetry(); first.IsZero() || r.Before(first) {
+			first = r
+		}
+	}
+	if wait := time.Until(first); wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDestinationPoolPick(t *testing.T) {
+	assert := assert.New(t)
+	addrs := []string{"a:1", "b:1", "c:1"}
+
+	failover, err := newDestinationPool(addrs, destinationPolicyFailover, metrics.NewRegistry())
+	assert.NoError(err)
+	assert.Equal("a:1", failover.Pick().Addr)
+	failover.destinations[0].MarkFailure()
+	assert.Equal("b:1", failover.Pick().Addr)
+	failover.destinations[0].MarkSuccess()
+	assert.Equal("a:1", failover.Pick().Addr, "traffic should fail back to the primary")
+
+	rr, err := newDestinationPool(addrs, destinationPolicyRoundRobin, metrics.NewRegistry())
+	assert.NoError(err)
+	rr.destinations[1].MarkFailure()
+	picked := []string{}
+	for i := 0; i < 4; i++ {
+		picked = append(picked, rr.Pick().Addr)
+	}
+	assert.Equal([]string{"a:1", "c:1", "c:1", "a:1"}, picked)
+
+	lo, err := newDestinationPool(addrs, destinationPolicyLeastOutstanding, metrics.NewRegistry())
+	assert.NoError(err)
+	lo.destinations[0].begin()
+	lo.destinations[1].begin()
+	assert.Equal("c:1", lo.Pick().Addr)
+	lo.destinations[2].MarkFailure()
+	lo.destinations[1].end()
+	assert.Equal("b:1", lo.Pick().Addr)
+
+	for _, d := range lo.destinations {
+		d.MarkFailure()
+	}
+	assert.Nil(lo.Pick())
+
+	_, err = newDestinationPool(addrs, "random", metrics.NewRegistry())
+	assert.Error(err)
+	_, err = newDestinationPool(nil, destinationPolicyFailover, metrics.NewRegistry())
+	assert.Error(err)
+}
+
+func TestDestinationBackoff(t *testing.T) {
+	assert := assert.New(t)
+	d := newDestination("a:1", metrics.NewRegistry())
+
+	d.MarkFailure()
+	first := d.nextRetry()
+	assert.False(d.Available(time.Now()))
+	assert.True(d.Available(first))
+	assert.Equal(int64(0), d.healthy.Value())
+
+	d.MarkFailure()
+	assert.True(d.nextRetry().After(first))
+
+	for i := 0; i < 100; i++ {
+		d.MarkFailure()
+	}
+	assert.True(time.Until(d.nextRetry()) <= maxDestinationBackoff)
+
+	d.MarkSuccess()
+	assert.True(d.Available(time.Now()))
+	assert.Equal(int64(1), d.healthy.Value())
+	assert.Equal(int64(2), d.transitions.Count())
+}
+
+func TestForwarderFailsOver(t *testing.T) {
+	assert := assert.New(t)
+
+	// Reserve an address for the primary, then close it so connections fail.
+	primary, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		assert.FailNow(err.Error())
+	}
+	primaryAddr := primary.Addr().String()
+	primary.Close()
+
+	secondary, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		assert.FailNow(err.Error())
+	}
+	defer secondary.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		c, err := secondary.Accept()
+		if err != nil {
+			return
+		}
+		line, _ := bufio.NewReader(c).ReadString('\n')
+		received <- line
+	}()
+
+	config := *getConfig()
+	config.ForwardDestConnectTimeout = time.Second
+	pool, err := newDestinationPool([]string{primaryAddr, secondary.Addr().String()}, destinationPolicyFailover, config.MetricsRegistry)
+	assert.NoError(err)
+
+	f := newForwarder(config, nil, pool, "", 0)
+	f.write(NewPayload("", "", []byte("hello\n")))
+
+	select {
+	case line := <-received:
+		assert.Equal("hello\n", line)
+	case <-time.After(time.Second):
+		assert.Fail("secondary never received the payload")
+	}
+	assert.Equal(int64(1), pool.destinations[0].cErrors.Count())
+	assert.False(pool.destinations[0].Available(time.Now()))
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	outputFormatRFC5424 = "rfc5424"
+	outputFormatRFC3164 = "rfc3164"
+	outputFormatJSON    = "json"
+	outputFormatGELF    = "gelf"
+
+	outputFramingOctet = "octet"
+	outputFramingLF    = "lf"
+	outputFramingNull  = "null"
+
+	// RFC3164 limits the TAG to 32 characters.
+	maxRFC3164TagLength = 32
+)
+
+// The framing used for each format when none is configured.
+var defaultOutputFraming = map[string]string{
+	outputFormatRFC5424: outputFramingOctet,
+	outputFormatRFC3164: outputFramingOctet,
+	outputFormatJSON:    outputFramingLF,
+	outputFormatGELF:    outputFramingNull,
+}
+
+// encoder converts payload bodies, which are always octet-counted RFC5424
+// frames, to the format and framing a destination expects.
+type encoder struct {
+	format  string
+	framing string
+}
+
+// newEncoder returns an encoder for format and framing, or nil if payloads
+// can be forwarded as they are.
+func newEncoder(format, framing string) (*encoder, error) {
+	if format == "" {
+		format = outputFormatRFC5424
+	}
+	def, ok := defaultOutputFraming[format]
+	if !ok {
+		return nil, fmt.Errorf("Unknown output format %q", format)
+	}
+	switch framing {
+	case "":
+		framing = def
+	case outputFramingOctet, outputFramingLF, outputFramingNull:
+	default:
+		return nil, fmt.Errorf("Unknown output framing %q", framing)
+	}
+
+	if format == outputFormatRFC5424 && framing == outputFramingOctet {
+		return nil, nil
+	}
+	return &encoder{format: format, framing: framing}, nil
+}
+
+// outputFrame is a frame split into its parts.
+type outputFrame struct {
+	priority  int
+	timestamp string
+	hostname  string
+	appName   string
+	procid    string
+	msgid     string
+	sd        []sdElement
+	rawSD     []byte // the STRUCTURED-DATA as it was in the frame
+	msg       []byte
+}
+
+// Encode converts every frame in body.
+func (e *encoder) Encode(body []byte) ([]byte, error) {
+	var out bytes.Buffer
+	out.Grow(len(body))
+	var b bytes.Buffer
+	for len(body) > 0 {
+		msg, n, err := nextFrame(body)
+		if err != nil {
+			return nil, err
+		}
+		body = body[n:]
+
+		b.Reset()
+		if e.format == outputFormatRFC5424 {
+			b.Write(msg)
+		} else {
+			f, err := parseOutputFrame(msg)
+			if err != nil {
+				return nil, err
+			}
+			switch e.format {
+			case outputFormatRFC3164:
+				f.writeRFC3164(&b)
+			case outputFormatJSON:
+				err = f.writeJSON(&b)
+			case outputFormatGELF:
+				err = f.writeGELF(&b)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		switch e.framing {
+		case outputFramingOctet:
+			writeSyslogFrame(&out, b.Bytes())
+		case outputFramingLF:
+			// Logplex MSGs usually end in a newline, and any others would
+			// split the record.
+			writeEscaped(&out, bytes.TrimRight(b.Bytes(), "\r\n"), '\n')
+			out.WriteByte('\n')
+		case outputFramingNull:
+			writeEscaped(&out, b.Bytes(), 0)
+			out.WriteByte(0)
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// Write record to out with each occurrence of the delimiter escaped as an
+// octal #ooo sequence, as rsyslog escapes control characters.
+func writeEscaped(out *bytes.Buffer, record []byte, delim byte) {
+	for {
+		i := bytes.IndexByte(record, delim)
+		if i < 0 {
+			out.Write(record)
+			return
+		}
+		out.Write(record[:i])
+		fmt.Fprintf(out, "#%03o", delim)
+		record = record[i+1:]
+	}
+}
+
+func parseOutputFrame(msg []byte) (*outputFrame, error) {
+	header, rest, ok := splitSyslogHeader(msg)
+	if !ok {
+		return nil, errSyslogFrame
+	}
+	fields := bytes.Fields(header)
+	pri := parsePriority(fields[0])
+	if pri < 0 {
+		return nil, errSyslogFrame
+	}
+
+	f := &outputFrame{
+		priority:  pri,
+		timestamp: string(fields[1]),
+		hostname:  string(fields[2]),
+		appName:   string(fields[3]),
+		procid:    string(fields[4]),
+		msgid:     string(fields[5]),
+	}
+
+	elements, _, m := splitStructuredData(rest)
+	for _, e := range elements {
+		f.sd = append(f.sd, parseSDElement(e))
+	}
+	if len(elements) > 0 {
+		f.rawSD = rest[:len(rest)-len(m)]
+		f.rawSD = bytes.TrimSuffix(f.rawSD, []byte(" "))
+	}
+	f.msg = m
+	return f, nil
+}
+
+// Write the frame as a BSD syslog message. It has nowhere for STRUCTURED-DATA
+// or MSGID, so STRUCTURED-DATA is kept at the start of the message.
+func (f *outputFrame) writeRFC3164(b *bytes.Buffer) {
+	ts := time.Now().UTC()
+	if t, err := time.Parse(time.RFC3339Nano, f.timestamp); err == nil {
+		ts = t
+	}
+
+	b.WriteString("<" + strconv.Itoa(f.priority) + ">")
+	b.WriteString(ts.Format(time.Stamp))
+	b.WriteString(" ")
+	b.WriteString(f.hostname)
+	b.WriteString(" ")
+	tag := f.appName
+	if len(tag) > maxRFC3164TagLength {
+		tag = tag[:maxRFC3164TagLength]
+	}
+	b.WriteString(tag)
+	if f.procid != "-" {
+		b.WriteString("[" + f.procid + "]")
+	}
+	b.WriteString(":")
+	if len(f.rawSD) > 0 {
+		b.WriteString(" ")
+		b.Write(f.rawSD)
+	}
+	if len(f.msg) > 0 {
+		b.WriteString(" ")
+		b.Write(f.msg)
+	}
+}
+
+// Write the frame as a JSON object in the format accepted by /logs as
+// application/x-ndjson.
+func (f *outputFrame) writeJSON(b *bytes.Buffer) error {
+	jf := jsonFrame{
+		Priority:  &f.priority,
+		Timestamp: emptyValue(f.timestamp),
+		Hostname:  emptyValue(f.hostname),
+		App:       emptyValue(f.appName),
+		Procid:    emptyValue(f.procid),
+		Msgid:     emptyValue(f.msgid),
+		Message:   string(f.msg),
+	}
+	if len(f.sd) > 0 {
+		jf.StructuredData = make(map[string]map[string]string, len(f.sd))
+		for _, e := range f.sd {
+			params := make(map[string]string, len(e.Params))
+			for _, p := range e.Params {
+				params[p.Name] = p.Value
+			}
+			jf.StructuredData[e.ID] = params
+		}
+	}
+	return writeOutputJSON(b, &jf)
+}
+
+// Write the frame as a GELF 1.1 message. Header fields and STRUCTURED-DATA
+// become additional fields, e.g. _app_name and _origin_ip.
+func (f *outputFrame) writeGELF(b *bytes.Buffer) error {
+	m := map[string]interface{}{
+		"version":       "1.1",
+		"host":          f.hostname,
+		"short_message": string(f.msg),
+		"level":         f.priority % 8,
+		"_facility":     f.priority / 8,
+	}
+	if len(f.msg) == 0 {
+		m["short_message"] = "-"
+	}
+	if t, err := time.Parse(time.RFC3339Nano, f.timestamp); err == nil {
+		m["timestamp"] = float64(t.UnixNano()/int64(time.Millisecond)) / 1000
+	}
+	for k, v := range map[string]string{"_app_name": f.appName, "_procid": f.procid, "_msgid": f.msgid} {
+		if v != "-" {
+			m[k] = v
+		}
+	}
+	for _, e := range f.sd {
+		for _, p := range e.Params {
+			m[gelfFieldName(e.ID+"_"+p.Name)] = p.Value
+		}
+	}
+	return writeOutputJSON(b, m)
+}
+
+// Returns "" in place of a NILVALUE header field, the opposite of nilValue.
+func emptyValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
+
+// Write v to b as JSON without a trailing newline, leaving that to the framing.
+func writeOutputJSON(b *bytes.Buffer, v interface{}) error {
+	enc := json.NewEncoder(b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	b.Truncate(b.Len() - 1)
+	return nil
+}
+
+// GELF additional field names are '_' followed by letters, digits, '_', '.'
+// and '-'.
+func gelfFieldName(s string) string {
+	return "_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '.', r == '-':
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Convert the fixer's output for each fixture to JSON, feed that back through
+// the fixer as application/x-ndjson and check nothing was lost.
+func TestEncodeJSONRoundTrip(t *testing.T) {
+	enc, err := newEncoder(outputFormatJSON, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for i, in := range input {
+		r, err := fix(httpRequestWithParams(), bytes.NewReader(in), "1.2.3.4", "", "metadata@123", nil, getConfig())
+		assert.NoError(t, err)
+
+		js, err := enc.Encode(r.bytes)
+		assert.NoError(t, err)
+		assert.True(t, bytes.HasSuffix(js, []byte("\n")), "fixture %d is LF framed", i)
+
+		req, _ := http.NewRequest("POST", "/logs?index=i&source=s&sourcetype=st", nil)
+		req.Header.Set("Content-Type", ndjsonContentType)
+		rr, err := fix(req, bytes.NewReader(js), "1.2.3.4", "", "metadata@123", nil, getConfig())
+		assert.NoError(t, err)
+		assert.Equal(t, r.numLogs, rr.numLogs, "fixture %d", i)
+
+		again, err := enc.Encode(rr.bytes)
+		assert.NoError(t, err)
+		assert.Equal(t, string(js), string(again), "fixture %d", i)
+	}
+}
+
+func TestEncodeJSON(t *testing.T) {
+	enc, _ := newEncoder(outputFormatJSON, "")
+	r, _ := fix(simpleHttpRequest(), bytes.NewReader(input[1]), "1.2.3.4", "", "", nil, getConfig())
+	out, err := enc.Encode(r.bytes)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"priority":13,"timestamp":"2013-06-07T13:17:49.468822+00:00","hostname":"host","app":"heroku","procid":"web.7","structured_data":{"foo":{"bar":"baz"},"meta":{"sequenceId":"hello"},"origin":{"ip":"1.2.3.4"}},"message":"hello\n"}`+"\n", string(out))
+}
+
+func TestEncodeRFC3164(t *testing.T) {
+	enc, _ := newEncoder(outputFormatRFC3164, outputFramingLF)
+	var in bytes.Buffer
+	in.Write(input[0])
+	in.Write(input[1])
+	r, _ := fix(simpleHttpRequest(), &in, "1.2.3.4", "", "", nil, getConfig())
+	out, err := enc.Encode(r.bytes)
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Join([]string{
+		`<13>Jun  7 13:17:49 host heroku[web.7]: [origin ip="1.2.3.4"] hi`,
+		`<13>Jun  7 13:17:49 host heroku[web.7]: [origin ip="1.2.3.4"] hello`,
+		`<13>Jun  7 13:17:49 host heroku[web.7]: [origin ip="1.2.3.4"][meta sequenceId="hello"][foo bar="baz"] hello`,
+	}, "\n")+"\n", string(out), "one line per frame")
+}
+
+func TestEncodeGELF(t *testing.T) {
+	assert := assert.New(t)
+	enc, _ := newEncoder(outputFormatGELF, "")
+	msg := []byte(`<11>1 2013-06-07T13:17:49.468+00:00 host app web.7 - [origin ip="1.2.3.4"][x@1 a.b="c\"d"] oops`)
+	var body bytes.Buffer
+	writeSyslogFrame(&body, msg)
+	out, err := enc.Encode(body.Bytes())
+	assert.NoError(err)
+	if !assert.True(bytes.HasSuffix(out, []byte{0}), "null terminated") {
+		return
+	}
+
+	var m map[string]interface{}
+	assert.NoError(json.Unmarshal(out[:len(out)-1], &m))
+	assert.Equal(map[string]interface{}{
+		"version":       "1.1",
+		"host":          "host",
+		"short_message": "oops",
+		"timestamp":     1370611069.468,
+		"level":         3.0,
+		"_facility":     1.0,
+		"_app_name":     "app",
+		"_procid":       "web.7",
+		"_origin_ip":    "1.2.3.4",
+		"_x_1_a.b":      `c"d`,
+	}, m)
+}
+
+func TestEncodeFraming(t *testing.T) {
+	var body bytes.Buffer
+	writeSyslogFrame(&body, []byte("<13>1 - host app - - - hi\n"))
+	writeSyslogFrame(&body, []byte("<13>1 - host app - - - two\nlines\x00\r\n"))
+
+	tests := map[string]string{
+		outputFramingOctet: "",
+		outputFramingLF:    "<13>1 - host app - - - hi\n<13>1 - host app - - - two#012lines\x00\n",
+		outputFramingNull:  "<13>1 - host app - - - hi\n\x00<13>1 - host app - - - two\nlines#000\r\n\x00",
+	}
+	for framing, expected := range tests {
+		enc, err := newEncoder(outputFormatRFC5424, framing)
+		assert.NoError(t, err)
+		if framing == outputFramingOctet {
+			assert.Nil(t, enc, "rfc5424 octet counted frames are forwarded as they are")
+			continue
+		}
+		out, err := enc.Encode(body.Bytes())
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(out), framing)
+	}
+}
+
+func TestNewEncoderErrors(t *testing.T) {
+	_, err := newEncoder("cef", "")
+	assert.EqualError(t, err, `Unknown output format "cef"`)
+	_, err = newEncoder(outputFormatJSON, "crlf")
+	assert.EqualError(t, err, `Unknown output framing "crlf"`)
+
+	config := *getConfig()
+	config.ForwardProtocol = forwardProtocolRELP
+	enc, _ := newEncoder(outputFormatJSON, "")
+	_, err = newForwarderSet("", config, config.ForwardDest, config.ForwardDestPolicy, enc)
+	assert.EqualError(t, err, "RELP requires octet framing")
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+const (
+	filterKeep   = "keep"
+	filterDrop   = "drop"
+	filterSample = "sample"
+)
+
+// filterConfig is the list of filter rules, read as JSON from
+// LOG_ISS_FILTER_RULES. For example:
+//
+//	{
+//	  "rules": [
+//	    {"name": "audit", "match": {"app_name": ["audit*"]}, "action": "keep"},
+//	    {"name": "health", "match": {"message": "path=\"?/health"}, "action": "drop"},
+//	    {"name": "debug", "match": {"severity": [7]}, "action": "sample", "sample": 100}
+//	  ]
+//	}
+//
+// Rules are evaluated in order for each frame and the first match wins. Frames
+// matching no rule are kept.
+type filterConfig struct {
+	Rules []filterRuleConfig `json:"rules"`
+}
+
+type filterRuleConfig struct {
+	Name   string      `json:"name"`
+	Match  filterMatch `json:"match"`
+	Action string      `json:"action"` // keep, drop or sample
+	Sample uint64      `json:"sample"` // for sample, keep 1 in this many frames
+}
+
+// filterMatch holds the conditions of a rule, all of which must match. String
+// values are shell patterns as accepted by path.Match; any of the listed
+// values may match.
+type filterMatch struct {
+	Credential []string `json:"credential"`
+	AppName    []string `json:"app_name"`
+	Procid     []string `json:"procid"`
+	Hostname   []string `json:"hostname"`
+	Severity   []int    `json:"severity"`
+	Message    string   `json:"message"` // regular expression matched against MSG
+}
+
+type filterRule struct {
+	seen uint64 // frames matched, for sampling; first for 64-bit alignment
+	filterRuleConfig
+	message *regexp.Regexp
+	matched metrics.Counter // tracks the number of frames matching the rule
+	dropped metrics.Counter // tracks the number of frames the rule discarded
+}
+
+// filter is a processor which drops or samples frames matching its rules.
+type filter struct {
+	rules []*filterRule
+}
+
+func newFilter(config IssConfig) (*filter, error) {
+	fl := &filter{}
+	if config.FilterRules == "" {
+		return fl, nil
+	}
+
+	var fc filterConfig
+	if err := json.Unmarshal([]byte(config.FilterRules), &fc); err != nil {
+		return nil, fmt.Errorf("Unable to parse LOG_ISS_FILTER_RULES: %s", err)
+	}
+
+	names := make(map[string]bool)
+	for _, c := range fc.Rules {
+		if c.Name == "" || strings.ContainsAny(c.Name, ". ") {
+			return nil, fmt.Errorf("Filter rule name %q must be non-empty and contain no dots or spaces", c.Name)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("Duplicate filter rule %q", c.Name)
+		}
+		names[c.Name] = true
+
+		switch c.Action {
+		case filterKeep, filterDrop:
+		case filterSample:
+			if c.Sample < 1 {
+				return nil, fmt.Errorf("Filter rule %q samples but sample isn't at least 1", c.Name)
+			}
+		default:
+			return nil, fmt.Errorf("Filter rule %q has unknown action %q", c.Name, c.Action)
+		}
+
+		rule := &filterRule{
+			filterRuleConfig: c,
+			matched:          metrics.GetOrRegisterCounter("log-iss.filter."+c.Name+".matched", config.MetricsRegistry),
+			dropped:          metrics.GetOrRegisterCounter("log-iss.filter."+c.Name+".dropped", config.MetricsRegistry),
+		}
+		if c.Match.Message != "" {
+			re, err := regexp.Compile(c.Match.Message)
+			if err != nil {
+				return nil, fmt.Errorf("Filter rule %q has an invalid message pattern: %s", c.Name, err)
+			}
+			rule.message = re
+		}
+		fl.rules = append(fl.rules, rule)
+	}
+
+	return fl, nil
+}
+
+func (fl *filter) Process(b *batch, f *frame) bool {
+	for _, rule := range fl.rules {
+		if !rule.matches(b, f) {
+			continue
+		}
+
+		rule.matched.Inc(1)
+		switch rule.Action {
+		case filterDrop:
+			rule.dropped.Inc(1)
+			return false
+		case filterSample:
+			// Keep the first of every Sample frames.
+			if (atomic.AddUint64(&rule.seen, 1)-1)%rule.Sample != 0 {
+				rule.dropped.Inc(1)
+				return false
+			}
+		}
+		return true
+	}
+	return true
+}
+
+func (rule *filterRule) matches(b *batch, f *frame) bool {
+	m := &rule.Match
+	if len(m.Credential) > 0 {
+		if b.Credential == nil || !matchAny(m.Credential, b.Credential.Name) {
+			return false
+		}
+	}
+	if len(m.AppName) > 0 && !matchAny(m.AppName, string(f.Header.Name)) {
+		return false
+	}
+	if len(m.Procid) > 0 && !matchAny(m.Procid, string(f.Header.Procid)) {
+		return false
+	}
+	if len(m.Hostname) > 0 && !matchAny(m.Hostname, string(f.Header.Hostname)) {
+		return false
+	}
+	if len(m.Severity) > 0 && !containsInt(m.Severity, prioritySeverity(f.Header.PrivalVersion)) {
+		return false
+	}
+	if rule.message != nil {
+		_, _, msg := splitStructuredData(f.Data)
+		if !rule.message.Match(msg) {
+			return false
+		}
+	}
+	return true
+}
+
+// Decode the severity from the PRI at the start of b, which is either a bare
+// PRI or PRI followed by VERSION. Returns -1 if it can't be decoded.
+func prioritySeverity(b []byte) int {
+	pri := parsePriority(b)
+	if pri < 0 {
+		return -1
+	}
+	return pri % 8
+}
+
+// Decode the PRI at the start of b. Returns -1 if it can't be decoded.
+func parsePriority(b []byte) int {
+	if len(b) < 3 || b[0] != '<' {
+		return -1
+	}
+	end := bytes.IndexByte(b, '>')
+	if end < 2 {
+		return -1
+	}
+	pri, err := strconv.Atoi(string(b[1:end]))
+	if err != nil || pri < 0 || pri > maxPriority {
+		return -1
+	}
+	return pri
+}
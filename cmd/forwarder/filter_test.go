@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bmizerany/lpx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterProcess(t *testing.T) {
+	config := *getConfig()
+	config.FilterRules = `{"rules": [
+		{"name": "audit", "match": {"app_name": ["audit*"]}, "action": "keep"},
+		{"name": "health", "match": {"procid": ["router"], "message": "path=/health"}, "action": "drop"},
+		{"name": "debug", "match": {"severity": [7]}, "action": "drop"},
+		{"name": "staging", "match": {"credential": ["staging-*"], "hostname": ["web*"]}, "action": "drop"}
+	]}`
+	fl, err := newFilter(config)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := map[string]struct {
+		pri      string
+		app      string
+		procid   string
+		hostname string
+		cred     string
+		data     string
+		kept     bool
+	}{
+		"no match":          {pri: "<13>1", app: "app", procid: "web.1", hostname: "host", data: "- hi", kept: true},
+		"health check":      {pri: "<13>1", app: "heroku", procid: "router", hostname: "host", data: "- at=info path=/health status=200"},
+		"other router line": {pri: "<13>1", app: "heroku", procid: "router", hostname: "host", data: "- at=info path=/ status=200", kept: true},
+		"debug":             {pri: "<15>1", app: "app", procid: "web.1", hostname: "host", data: "- hi"},
+		"debug audit":       {pri: "<15>1", app: "audit-log", procid: "web.1", hostname: "host", data: "- hi", kept: true},
+		"staging web":       {pri: "<13>1", app: "app", procid: "web.1", hostname: "web-1", cred: "staging-a", data: "- hi"},
+		"production web":    {pri: "<13>1", app: "app", procid: "web.1", hostname: "web-1", cred: "production", data: "- hi", kept: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			b := &batch{}
+			if test.cred != "" {
+				b.Credential = &credential{Name: test.cred}
+			}
+			f := &frame{
+				Header: lpx.Header{
+					PrivalVersion: []byte(test.pri),
+					Hostname:      []byte(test.hostname),
+					Name:          []byte(test.app),
+					Procid:        []byte(test.procid),
+				},
+				Data: []byte(test.data),
+			}
+			assert.Equal(t, test.kept, fl.Process(b, f))
+		})
+	}
+
+	assert.Equal(t, int64(1), fl.rules[1].dropped.Count(), "health")
+	assert.Equal(t, int64(1), fl.rules[0].matched.Count(), "audit")
+	assert.Equal(t, int64(0), fl.rules[0].dropped.Count(), "audit")
+}
+
+func TestFilterSample(t *testing.T) {
+	assert := assert.New(t)
+	config := *getConfig()
+	config.FilterRules = `{"rules": [{"name": "sample-debug", "match": {"severity": [7]}, "action": "sample", "sample": 3}]}`
+	config.Pipeline = []string{"filter"}
+	p, err := newPipeline(config)
+	assert.NoError(err)
+
+	var in bytes.Buffer
+	for i := 0; i < 7; i++ {
+		writeSyslogFrame(&in, []byte("<15>1 2013-06-07T13:17:49.468822+00:00 host app web.1 - - debug"))
+	}
+	writeSyslogFrame(&in, []byte("<13>1 2013-06-07T13:17:49.468822+00:00 host app web.1 - - notice"))
+
+	r, err := p.Fix(simpleHttpRequest(), &in, "", "", "", nil, &config, nil)
+	assert.NoError(err)
+	assert.Equal(int64(8), r.numLogs)
+	assert.Equal(int64(4), r.numForwarded, "debug frames 1, 4 and 7, and the notice")
+}
+
+func TestNewFilterErrors(t *testing.T) {
+	tests := map[string]struct {
+		rules string
+		err   string
+	}{
+		"bad json":       {rules: `[`, err: "Unable to parse LOG_ISS_FILTER_RULES: unexpected end of JSON input"},
+		"no name":        {rules: `{"rules": [{"action": "drop"}]}`, err: `Filter rule name "" must be non-empty and contain no dots or spaces`},
+		"duplicate":      {rules: `{"rules": [{"name": "a", "action": "drop"}, {"name": "a", "action": "keep"}]}`, err: `Duplicate filter rule "a"`},
+		"no action":      {rules: `{"rules": [{"name": "a"}]}`, err: `Filter rule "a" has unknown action ""`},
+		"no sample rate": {rules: `{"rules": [{"name": "a", "action": "sample"}]}`, err: `Filter rule "a" samples but sample isn't at least 1`},
+		"bad message":    {rules: `{"rules": [{"name": "a", "action": "drop", "match": {"message": "["}}]}`, err: "Filter rule \"a\" has an invalid message pattern: error parsing regexp: missing closing ]: `[`"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := *getConfig()
+			config.FilterRules = test.rules
+			_, err := newFilter(config)
+			assert.EqualError(t, err, test.err)
+		})
+	}
+}
+
+func TestPrioritySeverity(t *testing.T) {
+	assert.Equal(t, 5, prioritySeverity([]byte("<13>1")))
+	assert.Equal(t, 7, prioritySeverity([]byte("<191>")))
+	assert.Equal(t, -1, prioritySeverity([]byte("<>1")))
+	assert.Equal(t, -1, prioritySeverity([]byte("13")))
+}
@@ -1,9 +1,8 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
-	"io"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
@@ -12,6 +11,10 @@ import (
 )
 
 const (
+	logplexContentType = "application/logplex-1"
+	jsonContentType    = "application/json"
+	ndjsonContentType  = "application/x-ndjson"
+
 	// LogplexDefaultHost is the default host from logplex:
 	// https://github.com/heroku/logplex/blob/master/src/logplex_http_drain.erl#L443
 	logplexDefaultHost = "host"
@@ -24,170 +27,329 @@ const (
 
 var nilVal = []byte("- ")
 
+// contentType returns the media type of the request, without any parameters.
+func contentType(req *http.Request) string {
+	ct := req.Header.Get("Content-Type")
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return ct
+	}
+	return mt
+}
+
 //var queryParams = []string{"index", "source", "sourcetype", "metrics-destination", "log-destination"}
 
 // Get metadata from the http request.
-// Returns an empty byte array if there isn't any.
-func getMetadata(req *http.Request, cred *credential, metadataId string, config *IssConfig) (string, bool) {
-	var metadataWriter strings.Builder
+// Returns false if there isn't any.
+func getMetadata(req *http.Request, cred *credential, metadataId string, config *IssConfig) (sdElement, bool) {
+	if metadataId == "" {
+		return sdElement{}, false
+	}
+
 	var foundMetadata bool
+	var fieldsBuilder strings.Builder
+	fieldsBuilder.Grow(256)
+	metadata := sdElement{ID: metadataId}
 
 	// Calculate metadata query parameters
-	if metadataId != "" {
-		var fieldsBuilder strings.Builder
-
-		// Pre-grow to minimize extra slice allocations
-		metadataWriter.Grow(1024)
-		fieldsBuilder.Grow(256)
-
-		metadataWriter.WriteString("[")
-		metadataWriter.WriteString(metadataId)
-
-		for _, k := range append(config.QueryParams, config.QueryFieldParams...) {
-			v := req.FormValue(k)
-			if v != "" {
-				if containsString(config.QueryFieldParams, k) {
-					if fieldsBuilder.Len() > 0 {
-						fieldsBuilder.WriteString(",")
-					}
-					fieldsBuilder.WriteString(k)
-					fieldsBuilder.WriteString("=")
-					fieldsBuilder.WriteString(v)
-				} else {
-					metadataWriter.WriteString(" ")
-					metadataWriter.WriteString(k)
-					metadataWriter.WriteString(`="`)
-					metadataWriter.WriteString(v)
-					metadataWriter.WriteString(`"`)
+	for _, k := range append(config.QueryParams, config.QueryFieldParams...) {
+		v := req.FormValue(k)
+		if v != "" {
+			if containsString(config.QueryFieldParams, k) {
+				if fieldsBuilder.Len() > 0 {
+					fieldsBuilder.WriteString(",")
 				}
-				foundMetadata = true
+				fieldsBuilder.WriteString(k)
+				fieldsBuilder.WriteString("=")
+				fieldsBuilder.WriteString(v)
+			} else {
+				metadata.Add(k, v)
 			}
-		}
-
-		// Add metadata about the credential if it is deprecated
-		if cred != nil && cred.Deprecated {
-			if fieldsBuilder.Len() > 0 {
-				fieldsBuilder.WriteString(",")
-			}
-			fieldsBuilder.WriteString(`credential_deprecated=true,credential_name=`)
-			fieldsBuilder.WriteString(cred.Name)
 			foundMetadata = true
 		}
+	}
 
-		if foundMetadata {
-			if fieldsBuilder.Len() > 0 {
-				metadataWriter.WriteString(` fields="`)
-				metadataWriter.WriteString(fieldsBuilder.String())
-				metadataWriter.WriteString(`"`)
-			}
-
-			metadataWriter.WriteString("]")
+	// Add metadata about the credential if it is deprecated
+	if cred != nil && cred.Deprecated {
+		if fieldsBuilder.Len() > 0 {
+			fieldsBuilder.WriteString(",")
 		}
+		fieldsBuilder.WriteString(`credential_deprecated=true,credential_name=`)
+		fieldsBuilder.WriteString(cred.Name)
+		foundMetadata = true
 	}
 
-	return metadataWriter.String(), foundMetadata
+	if !foundMetadata {
+		return sdElement{}, false
+	}
+
+	if fieldsBuilder.Len() > 0 {
+		metadata.Add("fields", fieldsBuilder.String())
+	}
+	return metadata, true
 }
 
-// Write a header field into the messageWriter buffer. Truncates to maxLength
-// Returns true if the input string was truncated, and false otherwise.
-func writeField(messageWriter *bytes.Buffer, str []byte, maxLength int) bool {
-	if len(str) > maxLength {
-		messageWriter.Write(str[0:maxLength])
+// Truncate a header field to maxLength.
+// Returns true if the field was truncated, and false otherwise.
+func truncateField(field *[]byte, maxLength int) bool {
+	if len(*field) > maxLength {
+		*field = (*field)[0:maxLength]
 		return true
-	} else {
-		messageWriter.Write(str)
-		return false
 	}
+	return false
 }
 
 type fixResult struct {
 	hasMetadata    bool
-	numLogs        int64
+	numLogs        int64 // frames received
+	numForwarded   int64 // frames kept by the pipeline
 	bytes          []byte
 	hostnameTruncs int64
 	appnameTruncs  int64
 	procidTruncs   int64
 	msgidTruncs    int64
+
+	malformed       int64            // frames skipped by lenient parsing
+	malformedFrames []malformedFrame // the first maxMalformedFrames of them
+
+	logplexErrors []logplexError // L-series errors logplex embedded in the stream
+
+	duplicates int64 // frames not forwarded as they'd already been delivered
 }
 
-// Fix function to convert post data to length prefixed syslog frames
-// Returns:
-// * boolean indicating whether metadata was present in the query parameters.
-// * integer representing the number of logplex frames parsed from the HTTP request.
-// * byte array of syslog data.
-// * error if something went wrong.
-func fix(req *http.Request, r io.Reader, remoteAddr string, logplexDrainToken string, metadataId string, cred *credential, config *IssConfig) (fixResult, error) {
-	var messageWriter bytes.Buffer
-	var messageLenWriter bytes.Buffer
-
-	metadataString, hasMetadata := getMetadata(req, cred, metadataId, config)
-
-	lp := lpx.NewReader(bufio.NewReader(r))
-	numLogs := int64(0)
-	hostnameTruncs := int64(0)
-	appnameTruncs := int64(0)
-	procidTruncs := int64(0)
-	msgidTruncs := int64(0)
-	for lp.Next() {
-		numLogs++
-		header := lp.Header()
-
-		// LEN SP PRI VERSION SP TIMESTAMP SP HOSTNAME SP APP-NAME SP PROCID SP MSGID SP STRUCTURED-DATA MSG
-		messageWriter.Write(header.PrivalVersion)
-		messageWriter.WriteString(" ")
-		messageWriter.Write(header.Time)
-		messageWriter.WriteString(" ")
-		host := header.Hostname
-		if string(header.Hostname) == logplexDefaultHost && logplexDrainToken != "" {
-			host = []byte(logplexDrainToken)
-		}
-		if writeField(&messageWriter, host, maxHostnameLength) {
-			hostnameTruncs++
-		}
-		messageWriter.WriteString(" ")
-		if writeField(&messageWriter, header.Name, maxAppnameLength) {
-			appnameTruncs++
-		}
-		messageWriter.WriteString(" ")
-		if writeField(&messageWriter, header.Procid, maxProcidLength) {
-			procidTruncs++
-		}
-		messageWriter.WriteString(" ")
-		if writeField(&messageWriter, header.Msgid, maxMsgidLength) {
-			msgidTruncs++
-		}
-		messageWriter.WriteString(" ")
-		if remoteAddr != "" {
-			messageWriter.WriteString("[origin ip=\"")
-			messageWriter.WriteString(remoteAddr)
-			messageWriter.WriteString("\"]")
-		}
+// chunkFunc is given each chunk of frames as it's encoded, with the chunk in
+// bytes and the number of frames in it in numForwarded. The bytes are reused
+// once it returns, unless it returns an error.
+type chunkFunc func(chunk fixResult) error
+
+// frameWriter runs frames through a pipeline and accumulates those it keeps as
+// length prefixed syslog frames, regardless of the format they were submitted
+// in. If it has a chunkFunc, frames are handed to it whenever chunkBytes have
+// accumulated, and by Finish, rather than returned all at once by Result.
+type frameWriter struct {
+	pipeline   *pipeline
+	batch      batch
+	legacySD   bool
+	out        *bytes.Buffer
+	chunk      chunkFunc
+	chunkBytes int
+	pending    int64 // frames in out
+	result     fixResult
+
+	// Reused for each frame.
+	frame    frame
+	elements [][]byte
+	ids      [][]byte
+}
+
+func newFrameWriter(p *pipeline, b batch, chunk chunkFunc) *frameWriter {
+	out := new(bytes.Buffer)
+	if chunk != nil {
+		out = getBuffer()
+	}
+	fw := &frameWriter{
+		pipeline:   p,
+		batch:      b,
+		legacySD:   b.Config.LegacyStructuredData,
+		out:        out,
+		chunk:      chunk,
+		chunkBytes: b.Config.ChunkBytes,
+	}
+	fw.batch.result = &fw.result
+	return fw
+}
+
+// Write a single frame given its header and the remainder of the message
+// (STRUCTURED-DATA and MSG). Neither is used after write returns.
+func (fw *frameWriter) write(header *lpx.Header, b []byte) error {
+	fw.result.numLogs++
+	if e, ok := parseLogplexError(header, b); ok {
+		fw.result.addLogplexError(e)
+	}
+
+	f := &fw.frame
+	*f = frame{Header: *header, Data: b, SD: f.SD[:0]}
+	if !fw.pipeline.process(&fw.batch, f) {
+		return nil
+	}
+	fw.result.numForwarded++
+	fw.pending++
+
+	// LEN SP PRI VERSION SP TIMESTAMP SP HOSTNAME SP APP-NAME SP PROCID SP MSGID SP STRUCTURED-DATA MSG
+	start := fw.out.Len()
+	reserved := fw.reserveLength(f)
+	fw.out.Write(f.Header.PrivalVersion)
+	fw.out.WriteString(" ")
+	fw.out.Write(f.Header.Time)
+	fw.out.WriteString(" ")
+	fw.out.Write(f.Header.Hostname)
+	fw.out.WriteString(" ")
+	fw.out.Write(f.Header.Name)
+	fw.out.WriteString(" ")
+	fw.out.Write(f.Header.Procid)
+	fw.out.WriteString(" ")
+	fw.out.Write(f.Header.Msgid)
+	fw.out.WriteString(" ")
+	if fw.legacySD {
+		fw.writeLegacyStructuredData(f)
+	} else {
+		fw.writeStructuredData(f)
+	}
+	fw.writeLength(start, reserved)
 
-		// Write metadata
-		if hasMetadata {
-			messageWriter.WriteString(metadataString)
+	if fw.chunk != nil && fw.chunkBytes > 0 && fw.out.Len() >= fw.chunkBytes {
+		return fw.flush()
+	}
+	return nil
+}
+
+// Space for a frame's length prefix, a decimal number and a space.
+var lengthPadding [21]byte
+
+// Reserve room for f's length prefix, returning how much was reserved. The
+// frame is written straight after it, so it doesn't need copying once its
+// length is known. The reservation is based on the length of f before SD
+// escaping, so is almost always exact.
+func (fw *frameWriter) reserveLength(f *frame) int {
+	n := len(f.Header.PrivalVersion) + len(f.Header.Time) + len(f.Header.Hostname) +
+		len(f.Header.Name) + len(f.Header.Procid) + len(f.Header.Msgid) + 6 + len(f.Data)
+	for i := range f.SD {
+		n += f.SD[i].Size()
+	}
+	reserved := 2
+	for ; n >= 10; n /= 10 {
+		reserved++
+	}
+	fw.out.Write(lengthPadding[:reserved])
+	return reserved
+}
+
+// Fill in the length prefix of the frame written since start, moving the
+// frame if the reserved space was the wrong size.
+func (fw *frameWriter) writeLength(start, reserved int) {
+	var buf [len(lengthPadding)]byte
+	n := fw.out.Len() - start - reserved
+	prefix := append(strconv.AppendInt(buf[:0], int64(n), 10), ' ')
+
+	switch {
+	case len(prefix) > reserved:
+		fw.out.Write(lengthPadding[:len(prefix)-reserved])
+		b := fw.out.Bytes()
+		copy(b[start+len(prefix):], b[start+reserved:start+reserved+n])
+	case len(prefix) < reserved:
+		b := fw.out.Bytes()
+		copy(b[start+len(prefix):], b[start+reserved:])
+		fw.out.Truncate(start + len(prefix) + n)
+	}
+	copy(fw.out.Bytes()[start:], prefix)
+}
+
+// Hand the frames accumulated so far to the chunkFunc.
+func (fw *frameWriter) flush() error {
+	if fw.pending == 0 {
+		return nil
+	}
+	err := fw.chunk(fixResult{
+		hasMetadata:  fw.result.hasMetadata,
+		numForwarded: fw.pending,
+		bytes:        fw.out.Bytes(),
+	})
+	if err != nil {
+		// A forwarder may still be writing the chunk, so out can't be reused.
+		fw.out = new(bytes.Buffer)
+		return err
+	}
+	fw.pending = 0
+	fw.out.Reset()
+	return nil
+}
+
+// Write the SD-ELEMENTs added by the pipeline followed by those already in
+// the frame, then the MSG. Elements in the frame with the same SD-ID as an
+// added element are replaced by it.
+func (fw *frameWriter) writeStructuredData(f *frame) {
+	var msg []byte
+	fw.elements, fw.ids, msg = appendStructuredData(fw.elements, fw.ids, f.Data)
+
+	for i := range f.SD {
+		f.SD[i].Write(fw.out, false)
+	}
+	empty := len(f.SD) == 0
+	for i, e := range fw.elements {
+		if addedSD(f.SD, fw.ids[i]) {
+			continue
 		}
+		fw.out.Write(e)
+		empty = false
+	}
+	if empty {
+		fw.out.WriteString("-")
+	}
+
+	if len(msg) > 0 {
+		fw.out.WriteString(" ")
+		fw.out.Write(msg)
+	}
+}
+
+// Write the SD-ELEMENTs added by the pipeline followed by the rest of the
+// frame the way log-iss always has, without escaping or regard for
+// STRUCTURED-DATA already in the frame.
+func (fw *frameWriter) writeLegacyStructuredData(f *frame) {
+	for i := range f.SD {
+		f.SD[i].Write(fw.out, true)
+	}
 
-		b := lp.Bytes()
-		if len(b) >= 2 && bytes.Equal(b[0:2], nilVal) {
-			messageWriter.Write(b[1:])
-		} else if len(b) > 0 {
-			messageWriter.WriteString(" ")
-			messageWriter.Write(b)
+	b := f.Data
+	if len(b) >= 2 && bytes.Equal(b[0:2], nilVal) {
+		fw.out.Write(b[1:])
+	} else if len(b) > 0 {
+		fw.out.WriteString(" ")
+		fw.out.Write(b)
+	}
+}
+
+// Whether an element with SD-ID id was added by the pipeline.
+func addedSD(sd []sdElement, id []byte) bool {
+	for i := range sd {
+		if sd[i].ID == string(id) {
+			return true
 		}
+	}
+	return false
+}
 
-		messageLenWriter.WriteString(strconv.Itoa(messageWriter.Len()))
-		messageLenWriter.WriteString(" ")
-		messageWriter.WriteTo(&messageLenWriter)
+// Record a frame that couldn't be parsed.
+func (fw *frameWriter) malformed(m malformedFrame) {
+	fw.result.malformed++
+	if len(fw.result.malformedFrames) < maxMalformedFrames {
+		fw.result.malformedFrames = append(fw.result.malformedFrames, m)
 	}
+}
+
+// Finish hands any frames not yet in a chunk to the chunkFunc.
+func (fw *frameWriter) Finish() error {
+	if fw.chunk == nil {
+		return nil
+	}
+	return fw.flush()
+}
 
-	return fixResult{
-		hasMetadata:    hasMetadata,
-		numLogs:        numLogs,
-		bytes:          messageLenWriter.Bytes(),
-		hostnameTruncs: hostnameTruncs,
-		appnameTruncs:  appnameTruncs,
-		procidTruncs:   procidTruncs,
-		msgidTruncs:    msgidTruncs,
-	}, lp.Err()
+// Result returns the counters for every frame written. Without a chunkFunc,
+// it also returns the frames written.
+func (fw *frameWriter) Result() fixResult {
+	r := fw.result
+	if fw.chunk == nil {
+		r.bytes = fw.out.Bytes()
+	}
+	return r
+}
+
+// Release returns fw's buffer to the pool if it was taken from it. fw must
+// not be used afterwards.
+func (fw *frameWriter) Release() {
+	if fw.chunk != nil {
+		putBuffer(fw.out)
+	}
+	fw.out = nil
 }
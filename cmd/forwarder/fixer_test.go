@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"strings"
@@ -25,7 +26,7 @@ func TestFix(t *testing.T) {
 	assert := assert.New(t)
 	var output = [][]byte{
 		[]byte("84 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"] hi\n87 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"] hello\n"),
-		[]byte("128 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"] [meta sequenceId=\"hello\"][foo bar=\"baz\"] hello\n"),
+		[]byte("127 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"][meta sequenceId=\"hello\"][foo bar=\"baz\"] hello\n"),
 		[]byte("87 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"] hello\n"),
 		[]byte("80 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"]"),
 		[]byte("119 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"] [60607e20-f12d-483e-aa89-ffaf954e7527]"),
@@ -38,6 +39,67 @@ func TestFix(t *testing.T) {
 	}
 }
 
+func TestFixLegacyStructuredData(t *testing.T) {
+	assert := assert.New(t)
+	var output = [][]byte{
+		[]byte("84 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"] hi\n87 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"] hello\n"),
+		[]byte("128 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"] [meta sequenceId=\"hello\"][foo bar=\"baz\"] hello\n"),
+		[]byte("87 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"] hello\n"),
+		[]byte("80 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"]"),
+		[]byte("119 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"] [60607e20-f12d-483e-aa89-ffaf954e7527]"),
+	}
+
+	config := getConfig()
+	config.LegacyStructuredData = true
+	for x, in := range input {
+		r, _ := fix(simpleHttpRequest(), bytes.NewReader(in), "1.2.3.4", "", "", nil, config)
+		assert.Equal(string(output[x]), string(r.bytes))
+	}
+
+	config.QueryParams = []string{"index", "source"}
+	config.QueryFieldParams = nil
+	r, _ := fix(httpRequestWithEscapedParams(), bytes.NewReader(input[2]), "", "", "metadata@123", nil, config)
+	assert.Equal(`109 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [metadata@123 index="i"] [x]"" source="s\"] hello`+"\n", string(r.bytes))
+}
+
+func TestFixStructuredData(t *testing.T) {
+	tests := map[string]struct {
+		remoteAddr string
+		sd         string
+		expected   string
+	}{
+		"nil value":              {remoteAddr: "", sd: "- hi", expected: "- hi"},
+		"nil value without msg":  {remoteAddr: "", sd: "-", expected: "-"},
+		"existing elements kept": {remoteAddr: "", sd: `[a x="1"][b y="\]"] hi`, expected: `[a x="1"][b y="\]"] hi`},
+		"merged":                 {remoteAddr: "1.2.3.4", sd: `[a x="1"] hi`, expected: `[origin ip="1.2.3.4"][a x="1"] hi`},
+		"injected id replaces":   {remoteAddr: "1.2.3.4", sd: `[origin ip="6.6.6.6"][a x="1"] hi`, expected: `[origin ip="1.2.3.4"][a x="1"] hi`},
+		"escaped remote address": {remoteAddr: `1.2.3.4"]`, sd: "- hi", expected: `[origin ip="1.2.3.4\"\]"] hi`},
+		"invalid SD-ID is MSG":   {remoteAddr: "1.2.3.4", sd: "[a=b] hi", expected: `[origin ip="1.2.3.4"] [a=b] hi`},
+		"unterminated is MSG":    {remoteAddr: "", sd: `[a x="1] hi`, expected: `- [a x="1] hi`},
+		"no space before MSG":    {remoteAddr: "", sd: `[a x="1"]hi`, expected: `- [a x="1"]hi`},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			msg := "<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - " + test.sd
+			in := fmt.Sprintf("%d %s", len(msg), msg)
+			r, err := fix(simpleHttpRequest(), strings.NewReader(in), test.remoteAddr, "", "", nil, getConfig())
+			assert.NoError(t, err)
+
+			expected := "<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - " + test.expected
+			assert.Equal(t, fmt.Sprintf("%d %s", len(expected), expected), string(r.bytes))
+		})
+	}
+}
+
+func TestFixEscapesMetadata(t *testing.T) {
+	config := getConfig()
+	config.QueryParams = []string{"index", "source"}
+	config.QueryFieldParams = nil
+	r, _ := fix(httpRequestWithEscapedParams(), bytes.NewReader(input[2]), "", "", "metadata@123", nil, config)
+	assert.Equal(t, `114 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [metadata@123 index="i\"\] [x\]\"" source="s\\"] hello`+"\n", string(r.bytes))
+}
+
 func TestTruncationOfFields(t *testing.T) {
 	assert := assert.New(t)
 	type input struct {
@@ -52,7 +114,8 @@ func TestTruncationOfFields(t *testing.T) {
 			bytes: []byte(fmt.Sprintf("311 <13>1 2013-06-07T13:17:49.468822+00:00 %s heroku web.7 - ", strings.Repeat("a", 256))),
 			expected: fixResult{
 				numLogs:        1,
-				bytes:          []byte(fmt.Sprintf("310 <13>1 2013-06-07T13:17:49.468822+00:00 %s heroku web.7 - ", strings.Repeat("a", 255))),
+				numForwarded:   1,
+				bytes:          []byte(fmt.Sprintf("311 <13>1 2013-06-07T13:17:49.468822+00:00 %s heroku web.7 - -", strings.Repeat("a", 255))),
 				hostnameTruncs: 1,
 			},
 		},
@@ -61,7 +124,8 @@ func TestTruncationOfFields(t *testing.T) {
 			bytes: []byte(fmt.Sprintf("102 <13>1 2013-06-07T13:17:49.468822+00:00 host %s web.7 - ", strings.Repeat("a", 49))),
 			expected: fixResult{
 				numLogs:       1,
-				bytes:         []byte(fmt.Sprintf("101 <13>1 2013-06-07T13:17:49.468822+00:00 host %s web.7 - ", strings.Repeat("a", 48))),
+				numForwarded:  1,
+				bytes:         []byte(fmt.Sprintf("102 <13>1 2013-06-07T13:17:49.468822+00:00 host %s web.7 - -", strings.Repeat("a", 48))),
 				appnameTruncs: 1,
 			},
 		},
@@ -70,7 +134,8 @@ func TestTruncationOfFields(t *testing.T) {
 			bytes: []byte(fmt.Sprintf("183 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku %s - ", strings.Repeat("a", 129))),
 			expected: fixResult{
 				numLogs:      1,
-				bytes:        []byte(fmt.Sprintf("182 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku %s - ", strings.Repeat("a", 128))),
+				numForwarded: 1,
+				bytes:        []byte(fmt.Sprintf("183 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku %s - -", strings.Repeat("a", 128))),
 				procidTruncs: 1,
 			},
 		},
@@ -78,9 +143,10 @@ func TestTruncationOfFields(t *testing.T) {
 			name:  "truncate MSGID",
 			bytes: []byte(fmt.Sprintf("91 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 %s ", strings.Repeat("a", 33))),
 			expected: fixResult{
-				numLogs:     1,
-				bytes:       []byte(fmt.Sprintf("90 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 %s ", strings.Repeat("a", 32))),
-				msgidTruncs: 1,
+				numLogs:      1,
+				numForwarded: 1,
+				bytes:        []byte(fmt.Sprintf("91 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 %s -", strings.Repeat("a", 32))),
+				msgidTruncs:  1,
 			},
 		},
 	}
@@ -158,7 +224,7 @@ func TestFixWithLogplexDrainToken(t *testing.T) {
 
 	output := [][]byte{
 		[]byte("118 <13>1 2013-06-07T13:17:49.468822+00:00 d.34bc219c-983b-463e-a17d-3d34ee7db812 heroku web.7 - [origin ip=\"1.2.3.4\"] hi\n121 <13>1 2013-06-07T13:17:49.468822+00:00 d.34bc219c-983b-463e-a17d-3d34ee7db812 heroku web.7 - [origin ip=\"1.2.3.4\"] hello\n"),
-		[]byte("162 <13>1 2013-06-07T13:17:49.468822+00:00 d.34bc219c-983b-463e-a17d-3d34ee7db812 heroku web.7 - [origin ip=\"1.2.3.4\"] [meta sequenceId=\"hello\"][foo bar=\"baz\"] hello\n"),
+		[]byte("161 <13>1 2013-06-07T13:17:49.468822+00:00 d.34bc219c-983b-463e-a17d-3d34ee7db812 heroku web.7 - [origin ip=\"1.2.3.4\"][meta sequenceId=\"hello\"][foo bar=\"baz\"] hello\n"),
 		[]byte("121 <13>1 2013-06-07T13:17:49.468822+00:00 d.34bc219c-983b-463e-a17d-3d34ee7db812 heroku web.7 - [origin ip=\"1.2.3.4\"] hello\n"),
 		[]byte("114 <13>1 2013-06-07T13:17:49.468822+00:00 d.34bc219c-983b-463e-a17d-3d34ee7db812 heroku web.7 - [origin ip=\"1.2.3.4\"]"),
 		[]byte("153 <13>1 2013-06-07T13:17:49.468822+00:00 d.34bc219c-983b-463e-a17d-3d34ee7db812 heroku web.7 - [origin ip=\"1.2.3.4\"] [60607e20-f12d-483e-aa89-ffaf954e7527]"),
@@ -170,6 +236,50 @@ func TestFixWithLogplexDrainToken(t *testing.T) {
 	}
 }
 
+func TestWriteLength(t *testing.T) {
+	// Space is reserved for the length before the frame is written, and the
+	// frame is moved if that was too little or too much.
+	for reserved := 1; reserved <= 5; reserved++ {
+		fw := &frameWriter{out: new(bytes.Buffer)}
+		fw.out.WriteString("x")
+		fw.out.Write(lengthPadding[:reserved])
+		fw.out.WriteString("<13>1 - - - - - hi")
+		fw.writeLength(1, reserved)
+		assert.Equal(t, "x18 <13>1 - - - - - hi", fw.out.String(), "reserved %d", reserved)
+	}
+}
+
+func TestFixChunks(t *testing.T) {
+	assert := assert.New(t)
+	config := getConfig()
+	config.ChunkBytes = 150
+	in := bytes.Repeat(input[0], 3)
+	whole, err := fix(simpleHttpRequest(), bytes.NewReader(in), "1.2.3.4", "", "", nil, config)
+	assert.NoError(err)
+
+	var chunks []string
+	var forwarded int64
+	r, err := pipelineFix(simpleHttpRequest(), bytes.NewReader(in), "1.2.3.4", "", "", nil, config, func(c fixResult) error {
+		chunks = append(chunks, string(c.bytes))
+		forwarded += c.numForwarded
+		return nil
+	})
+	assert.NoError(err)
+	assert.Equal(int64(6), r.numForwarded)
+	assert.Equal(int64(6), forwarded)
+	assert.Nil(r.bytes)
+	assert.Equal(3, len(chunks), "two frames of about 85 bytes each")
+	assert.Equal(string(whole.bytes), strings.Join(chunks, ""))
+
+	calls := 0
+	_, err = pipelineFix(simpleHttpRequest(), bytes.NewReader(in), "1.2.3.4", "", "", nil, config, func(c fixResult) error {
+		calls++
+		return errSpoolFull
+	})
+	assert.Equal(errSpoolFull, err)
+	assert.Equal(1, calls, "parsing stops at the first error")
+}
+
 func BenchmarkGetMetadata(b *testing.B) {
 	input := []byte("106 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [meta sequenceId=\"hello\"][foo bar=\"baz\"] hello\n")
 	os.Setenv("LOG_ISS_FIELD_PARAMS", "custom1;custom2")
@@ -203,11 +313,45 @@ func BenchmarkFixSD(b *testing.B) {
 	}
 }
 
+func BenchmarkChunkedFixNoSD(b *testing.B) {
+	benchmarkChunkedFix(b, []byte("64 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi\n67 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hello\n"))
+}
+
+func BenchmarkChunkedFixSD(b *testing.B) {
+	benchmarkChunkedFix(b, []byte("106 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [meta sequenceId=\"hello\"][foo bar=\"baz\"] hello\n"))
+}
+
+// Benchmark fixing input the way the servers do, with the pipeline built once
+// and the input delivered in chunks.
+func benchmarkChunkedFix(b *testing.B, input []byte) {
+	config := getConfig()
+	p, err := newPipeline(*config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	req := simpleHttpRequest()
+	discard := func(fixResult) error { return nil }
+	r := bytes.NewReader(input)
+
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(input)
+		p.Fix(req, r, "1.2.3.4", "", "", nil, config, discard)
+	}
+}
+
 func httpRequestWithParams() *http.Request {
 	req, _ := http.NewRequest("POST", "/logs?index=i&source=s&sourcetype=st", nil)
 	return req
 }
 
+func httpRequestWithEscapedParams() *http.Request {
+	req, _ := http.NewRequest("POST", `/logs?index=i"]+[x]"&source=s\`, nil)
+	return req
+}
+
 func httpRequestWithFieldParams() *http.Request {
 	req, _ := http.NewRequest("POST", "/logs?index=i&source=s&sourcetype=st&custom1=cq1&custom2=cq2", nil)
 	return req
@@ -218,6 +362,20 @@ func simpleHttpRequest() *http.Request {
 	return req
 }
 
+// Run the request through the pipeline configured by config.
+func fix(req *http.Request, r io.Reader, remoteAddr string, logplexDrainToken string, metadataId string, cred *credential, config *IssConfig) (fixResult, error) {
+	return pipelineFix(req, r, remoteAddr, logplexDrainToken, metadataId, cred, config, nil)
+}
+
+// A FixerFunc which runs the request through the pipeline configured by config.
+func pipelineFix(req *http.Request, r io.Reader, remoteAddr string, logplexDrainToken string, metadataId string, cred *credential, config *IssConfig, chunk chunkFunc) (fixResult, error) {
+	p, err := newPipeline(*config)
+	if err != nil {
+		return fixResult{}, err
+	}
+	return p.Fix(req, r, remoteAddr, logplexDrainToken, metadataId, cred, config, chunk)
+}
+
 func getConfig() *IssConfig {
 	os.Setenv("DEPLOY", "codetest")
 	os.Setenv("FORWARD_DEST", "127.0.0.1:5001")
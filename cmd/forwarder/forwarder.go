@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
+	"path/filepath"
 	"time"
 
 	metrics "github.com/rcrowley/go-metrics"
@@ -11,46 +13,143 @@ import (
 )
 
 type deliverer interface {
+	// Deliver must not use p.Body after returning nil, as it may be reused.
 	Deliver(p payload) error
 }
 
 type forwarderSet struct {
+	Name    string
 	Config  IssConfig
 	Inbox   chan payload
+	pool    *destinationPool
+	spool   *spool
+	encoder *encoder // converts payloads to the destination's format, if set
+	latency latencyTracker
 	timeout metrics.Counter // counts how many times we times out waiting for delivery notification
 	full    metrics.Counter // counts how many times the queue was full
+	shed    metrics.Counter // counts how many payloads were turned away because we were saturated
+	delay   metrics.Timer   // tracks how long payloads take to be delivered
 }
 
-func newForwarderSet(config IssConfig) *forwarderSet {
-	return &forwarderSet{
+// newForwarderSet creates a set of forwarders writing to dests. The default
+// set has an empty name; other sets include their name in their metrics and
+// spool directory. Payloads are converted by enc, if it isn't nil.
+func newForwarderSet(name string, config IssConfig, dests []string, policy string, enc *encoder) (*forwarderSet, error) {
+	if enc != nil && enc.framing != outputFramingOctet && config.ForwardProtocol == forwardProtocolRELP {
+		return nil, fmt.Errorf("RELP requires %s framing", outputFramingOctet)
+	}
+
+	pool, err := newDestinationPool(dests, policy, config.MetricsRegistry)
+	if err != nil {
+		return nil, err
+	}
+
+	me := metricName("log-iss.forwardset", name)
+	fs := &forwarderSet{
+		Name:    name,
+		pool:    pool,
 		Config:  config,
 		Inbox:   make(chan payload, 1000),
-		timeout: metrics.GetOrRegisterCounter("log-iss.forwardset.deliver.timeout", config.MetricsRegistry),
-		full:    metrics.GetOrRegisterCounter("log-iss.forwardset.deliver.full", config.MetricsRegistry),
+		encoder: enc,
+		timeout: metrics.GetOrRegisterCounter(me+".deliver.timeout", config.MetricsRegistry),
+		full:    metrics.GetOrRegisterCounter(me+".deliver.full", config.MetricsRegistry),
+		shed:    metrics.GetOrRegisterCounter(me+".deliver.shed", config.MetricsRegistry),
+		delay:   metrics.GetOrRegisterTimer(me+".deliver.duration", config.MetricsRegistry),
 	}
+
+	if config.SpoolDir != "" {
+		s, err := openSpool(filepath.Join(config.SpoolDir, name), config.SpoolMaxBytes, config.SpoolSegmentBytes, config.SpoolPolicy, metricName("log-iss.spool", name), config.MetricsRegistry)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open spool: %s", err)
+		}
+		fs.spool = s
+	}
+
+	return fs, nil
 }
 
 func (fs *forwarderSet) Run() {
 	for i := 0; i < fs.Config.ForwardCount; i++ {
-		forwarder := newForwarder(fs.Config, fs.Inbox, i)
+		forwarder := newForwarder(fs.Config, fs.Inbox, fs.pool, fs.Name, i)
 		go forwarder.Run()
 	}
+
+	if fs.spool != nil {
+		go fs.drainSpool()
+	}
 }
 
+// Feed spooled payloads to the forwarders in order, and advance the spool's
+// checkpoint as they are delivered. At most one payload per forwarder is in
+// flight at a time.
+func (fs *forwarderSet) drainSpool() {
+	inflight := make(chan spoolEntry, fs.Config.ForwardCount)
+	go func() {
+		for e := range inflight {
+			<-e.payload.WaitCh
+			if err := fs.spool.Commit(e); err != nil {
+				log.WithFields(log.Fields{"ns": "spool", "at": "commit", "message": err}).Error()
+			}
+		}
+	}()
+
+	for {
+		e, err := fs.spool.Next()
+		if err != nil {
+			log.WithFields(log.Fields{"ns": "spool", "at": "next", "message": err}).Error()
+			time.Sleep(time.Second)
+			continue
+		}
+		fs.Inbox <- e.payload
+		inflight <- e
+	}
+}
+
+// Deliver hands p to the forwarders and waits for it to be written. When a
+// spool is configured, p is considered delivered once it's safely on disk.
+// Unless p was already admitted, it's shed if the set is saturated.
+//
+// If p isn't written within five seconds, or its context is done first, it's
+// cancelled so the forwarders abandon it rather than write it after the sender
+// has been told it failed.
 func (fs *forwarderSet) Deliver(p payload) (err error) {
-	deadline := time.After(time.Second * 5)
+	if fs.encoder != nil {
+		if p.Body, err = fs.encoder.Encode(p.Body); err != nil {
+			return fmt.Errorf("Unable to encode payload: %s", err)
+		}
+	}
+
+	if fs.spool != nil {
+		return fs.spool.Append(p)
+	}
+
+	if !p.Admitted {
+		if err := fs.saturated(); err != nil {
+			fs.shed.Inc(1)
+			return err
+		}
+	}
+
+	start := time.Now()
+	defer func() {
+		fs.latency.Update(time.Since(start))
+		fs.delay.UpdateSince(start)
+	}()
+
+	ctx, cancel := context.WithTimeout(p.Context, time.Second*5)
+	defer cancel()
+	p.Context = ctx
 
 	select {
 	case fs.Inbox <- p:
-	case <-deadline:
+	case <-ctx.Done():
 		fs.full.Inc(1)
 		return fmt.Errorf("ForwardSet queue full too long.")
 	}
 
 	select {
 	case <-p.WaitCh:
-		// FIXME: delivery duration?
-	case <-deadline:
+	case <-ctx.Done():
 		fs.timeout.Inc(1)
 		return fmt.Errorf("Timed out awaiting delivery notification for payload")
 	}
@@ -58,11 +157,22 @@ func (fs *forwarderSet) Deliver(p payload) (err error) {
 	return nil
 }
 
+// saturated returns an *overloadedError if the inbox fill level or recent
+// delivery latency is over the LOAD_SHED thresholds. Spooled sets are never
+// saturated, as their inbox is fed from disk.
+func (fs *forwarderSet) saturated() error {
+	if fs.spool != nil {
+		return nil
+	}
+	return checkSaturation(fs.Config, len(fs.Inbox), cap(fs.Inbox), fs.latency.Recent())
+}
+
 type forwarder struct {
 	ID           int
 	Config       IssConfig
 	Inbox        chan payload
-	c            net.Conn
+	pool         *destinationPool
+	conns        map[*destination]outputConn
 	duration     metrics.Timer   // tracks how long it takes to forward messages
 	cDisconnects metrics.Counter // counts disconnects
 	cSuccesses   metrics.Counter // counts connection successes
@@ -70,14 +180,17 @@ type forwarder struct {
 	wErrors      metrics.Counter // counts write errors
 	wSuccesses   metrics.Counter // counts write successes
 	wBytes       metrics.Counter // counts written bytes
+	abandoned    metrics.Counter // counts payloads given up on because their sender stopped waiting
 }
 
-func newForwarder(config IssConfig, inbox chan payload, id int) *forwarder {
-	me := fmt.Sprintf("log-iss.forwarder.%d", id)
+func newForwarder(config IssConfig, inbox chan payload, pool *destinationPool, setName string, id int) *forwarder {
+	me := fmt.Sprintf("%s.%d", metricName("log-iss.forwarder", setName), id)
 	return &forwarder{
 		ID:           id,
 		Config:       config,
 		Inbox:        inbox,
+		pool:         pool,
+		conns:        make(map[*destination]outputConn),
 		duration:     metrics.GetOrRegisterTimer(me+".duration", config.MetricsRegistry),
 		cDisconnects: metrics.GetOrRegisterCounter(me+".disconnects", config.MetricsRegistry),
 		cSuccesses:   metrics.GetOrRegisterCounter(me+".connect.successes", config.MetricsRegistry),
@@ -85,69 +198,117 @@ func newForwarder(config IssConfig, inbox chan payload, id int) *forwarder {
 		wErrors:      metrics.GetOrRegisterCounter(me+".write.errors", config.MetricsRegistry),
 		wSuccesses:   metrics.GetOrRegisterCounter(me+".write.successes", config.MetricsRegistry),
 		wBytes:       metrics.GetOrRegisterCounter(me+".write.bytes", config.MetricsRegistry),
+		abandoned:    metrics.GetOrRegisterCounter(me+".abandoned", config.MetricsRegistry),
 	}
 }
 
 func (f *forwarder) Run() {
 	for p := range f.Inbox {
 		start := time.Now()
-		f.write(p)
-		p.WaitCh <- struct{}{}
+		if f.write(p) {
+			p.WaitCh <- struct{}{}
+		}
 		f.duration.UpdateSince(start)
 	}
 }
 
-func (f *forwarder) connect() {
-	if f.c != nil {
-		return
+// Return the connection to d, dialing it if necessary.
+func (f *forwarder) connect(d *destination) (outputConn, error) {
+	if c, ok := f.conns[d]; ok {
+		return c, nil
 	}
 
-	rate := time.Tick(200 * time.Millisecond)
-	for {
-		var c net.Conn
-		var err error
+	var nc net.Conn
+	var err error
 
-		if f.Config.TlsConfig != nil {
-			c, err = tls.Dial("tcp", f.Config.ForwardDest, f.Config.TlsConfig)
-		} else {
-			c, err = net.DialTimeout("tcp", f.Config.ForwardDest, f.Config.ForwardDestConnectTimeout)
-		}
+	dialer := &net.Dialer{Timeout: f.Config.ForwardDestConnectTimeout}
+	if f.Config.TlsConfig != nil {
+		nc, err = tls.DialWithDialer(dialer, "tcp", d.Addr, f.Config.TlsConfig)
+	} else {
+		nc, err = dialer.Dial("tcp", d.Addr)
+	}
 
-		if err != nil {
-			f.cErrors.Inc(1)
-			log.WithFields(log.Fields{"id": f.ID, "message": err}).Error("Forwarder Connection Error")
-			f.disconnect()
-		} else {
-			f.cSuccesses.Inc(1)
-			log.WithFields(log.Fields{"id": f.ID, "remote_addr": c.RemoteAddr().String()}).Info("Forwarder Connection Success")
-			f.c = c
-			return
+	var c outputConn = &streamConn{Conn: nc, timeout: time.Second}
+	if err == nil && f.Config.ForwardProtocol == forwardProtocolRELP {
+		if c, err = newRELPConn(nc, f.Config.ForwardRELPWindow, f.Config.ForwardRELPTimeout); err != nil {
+			nc.Close()
 		}
-		<-rate
 	}
+
+	if err != nil {
+		f.cErrors.Inc(1)
+		d.cErrors.Inc(1)
+		log.WithFields(log.Fields{"id": f.ID, "dest": d.Addr, "message": err}).Error("Forwarder Connection Error")
+		d.MarkFailure()
+		return nil, err
+	}
+
+	f.cSuccesses.Inc(1)
+	d.cSuccesses.Inc(1)
+	log.WithFields(log.Fields{"id": f.ID, "dest": d.Addr, "remote_addr": c.RemoteAddr().String()}).Info("Forwarder Connection Success")
+	f.conns[d] = c
+	return c, nil
 }
 
-func (f *forwarder) disconnect() {
-	if f.c != nil {
-		f.c.Close()
+func (f *forwarder) disconnect(d *destination) {
+	if c, ok := f.conns[d]; ok {
+		c.Close()
+		delete(f.conns, d)
 	}
-	f.c = nil
 	f.cDisconnects.Inc(1)
 }
 
-func (f *forwarder) write(p payload) {
+// Write p to a destination, retrying until it's delivered or p's context is
+// done. With RELP, only the frames the previous destination didn't acknowledge
+// are retransmitted. Returns whether p was delivered.
+func (f *forwarder) write(p payload) bool {
+	body := p.Body
 	for {
-		f.connect()
+		if err := p.Context.Err(); err != nil {
+			f.abandoned.Inc(1)
+			log.WithFields(log.Fields{"id": f.ID, "request_id": p.RequestID, "err": err, "unwritten_bytes": len(body)}).Warn("Abandoning payload")
+			return false
+		}
+
+		d := f.pool.Pick()
+		if d == nil {
+			f.pool.Wait(p.Context)
+			continue
+		}
+
+		c, err := f.connect(d)
+		if err != nil {
+			continue
+		}
+
+		d.begin()
+		n, err := c.Write(body)
+		d.end()
+		f.wBytes.Inc(int64(n))
+		body = body[n:]
 
-		f.c.SetWriteDeadline(time.Now().Add(1 * time.Second))
-		if n, err := f.c.Write(p.Body); err != nil {
+		if err != nil {
 			f.wErrors.Inc(1)
-			log.WithFields(log.Fields{"id": f.ID, "request_id": p.RequestID, "err": err, "remote": f.c.RemoteAddr().String()}).Error("Error writing payload")
-			f.disconnect()
-		} else {
-			f.wSuccesses.Inc(1)
-			f.wBytes.Inc(int64(n))
-			return
+			d.wErrors.Inc(1)
+			log.WithFields(log.Fields{"id": f.ID, "request_id": p.RequestID, "err": err, "remote": c.RemoteAddr().String(), "unacked_bytes": len(body)}).Error("Error writing payload")
+			d.MarkFailure()
+			f.disconnect(d)
+			continue
+		}
+
+		f.wSuccesses.Inc(1)
+		d.wSuccesses.Inc(1)
+		d.MarkSuccess()
+
+		// Once traffic fails back to a preferred destination, don't hold on to
+		// idle connections to the standbys.
+		if f.pool.policy == destinationPolicyFailover {
+			for other := range f.conns {
+				if other != d {
+					f.disconnect(other)
+				}
+			}
 		}
+		return true
 	}
 }
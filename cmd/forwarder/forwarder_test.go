@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwarderAbandonsCancelledPayload(t *testing.T) {
+	assert := assert.New(t)
+
+	// Reserve an address, then close it so connections fail.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		assert.FailNow(err.Error())
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	config := *getConfig()
+	pool, err := newDestinationPool([]string{addr}, destinationPolicyFailover, config.MetricsRegistry)
+	assert.NoError(err)
+	f := newForwarder(config, nil, pool, "", 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	p := NewPayload("", "", []byte("hello\n"))
+	p.Context = ctx
+
+	start := time.Now()
+	assert.False(f.write(p))
+	assert.True(time.Since(start) < maxDestinationBackoff, "write should stop retrying once the payload is cancelled")
+	assert.Equal(int64(1), f.abandoned.Count())
+}
+
+func TestForwarderSetDeliverCancelled(t *testing.T) {
+	assert := assert.New(t)
+	config := *getConfig()
+	fs, err := newForwarderSet("", config, config.ForwardDest, config.ForwardDestPolicy, nil)
+	assert.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p := NewPayload("", "", []byte("hello\n"))
+	p.Context = ctx
+	assert.Error(fs.Deliver(p))
+
+	select {
+	case queued := <-fs.Inbox:
+		assert.Error(queued.Context.Err(), "a queued payload should be cancelled once Deliver gives up")
+	default:
+	}
+}
@@ -1,5 +1,13 @@
 package main
 
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
 // Searches a slice for a string
 func containsString(a []string, x string) bool {
 	for _, n := range a {
@@ -9,3 +17,58 @@ func containsString(a []string, x string) bool {
 	}
 	return false
 }
+
+// Searches a slice for an int
+func containsInt(a []int, x int) bool {
+	for _, n := range a {
+		if x == n {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the metric name base, qualified by name if it isn't empty
+func metricName(base string, name string) string {
+	if name == "" {
+		return base
+	}
+	return base + "." + name
+}
+
+// Make s usable as a single segment of a metric name.
+func metricSegment(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// ageGauge is the number of whole seconds since the time, in Unix nanoseconds,
+// it was last updated with. It starts out at the time it's created.
+type ageGauge struct {
+	t   int64
+	now func() time.Time
+}
+
+func newAgeGauge() *ageGauge {
+	return &ageGauge{t: time.Now().UnixNano(), now: time.Now}
+}
+
+func (g *ageGauge) Snapshot() metrics.Gauge {
+	return metrics.GaugeSnapshot(g.Value())
+}
+
+func (g *ageGauge) Update(t int64) {
+	atomic.StoreInt64(&g.t, t)
+}
+
+func (g *ageGauge) Value() int64 {
+	return int64(g.now().Sub(time.Unix(0, atomic.LoadInt64(&g.t))) / time.Second)
+}
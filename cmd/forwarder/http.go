@@ -1,11 +1,13 @@
 package main
 
 import (
-	"compress/gzip"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -18,14 +20,27 @@ type payload struct {
 	SourceAddr string
 	RequestID  string
 	Body       []byte
+	Frames     int64  // number of frames in Body
+	DedupKey   string // identifies Body when deduplicating, if enabled
+	Admitted   bool   // part of a request already partly delivered, so never shed
+	Source     payloadSource
+	Context    context.Context // done once the sender no longer waits for delivery
 	WaitCh     chan struct{}
 }
 
+// payloadSource describes who submitted a payload, for routing.
+type payloadSource struct {
+	Credential *credential
+	DrainToken string
+	Query      url.Values
+}
+
 func NewPayload(sa string, ri string, b []byte) payload {
 	return payload{
 		SourceAddr: sa,
 		RequestID:  ri,
 		Body:       b,
+		Context:    context.Background(),
 		WaitCh:     make(chan struct{}, 1),
 	}
 }
@@ -38,11 +53,25 @@ func NewPayload(sa string, ri string, b []byte) payload {
 //  * metadataId - ID to use when adding metadata to logs
 //  * credential - the credential used to authenticate
 //  * []string - a slice of custom query paramters to look for in the request
+//  * chunkFunc - given the frames in chunks of about LOG_ISS_CHUNK_BYTES, or nil
+//    to have all of them returned in the fixResult
 // FixerFunc returns:
 //  * boolean - indicating whether the request has query params (aka metadata).
 //  * int64  - number of log lines read from the stream
 //  * error - if something went wrong.
-type FixerFunc func(*http.Request, io.Reader, string, string, string, *credential, *IssConfig) (fixResult, error)
+// pipeline.Fix is the FixerFunc used by the HTTP and syslog servers.
+type FixerFunc func(*http.Request, io.Reader, string, string, string, *credential, *IssConfig, chunkFunc) (fixResult, error)
+
+// deliveryError is returned through the FixerFunc when a chunk can't be
+// delivered, with the status to respond with.
+type deliveryError struct {
+	err    error
+	status int
+}
+
+func (e *deliveryError) Error() string {
+	return e.err.Error()
+}
 
 type httpServer struct {
 	Config                IssConfig
@@ -51,6 +80,8 @@ type httpServer struct {
 	deliverer             deliverer
 	isShuttingDown        bool
 	auth                  *BasicAuth
+	limiter               rateLimiter
+	dedup                 dedupStore // nil if deduplication is disabled
 	posts                 metrics.Timer   // tracks metrics about posts
 	healthChecks          metrics.Timer   // tracks metrics about health checks
 	pErrors               metrics.Counter // tracks the count of post errors
@@ -65,13 +96,17 @@ type httpServer struct {
 	pAppnameTruncations   metrics.Counter // tracks the number of appname fields in logs that have been truncated
 	pProcidTruncations    metrics.Counter // tracks the number of procid fields in logs that have been truncated
 	pMsgidTruncations     metrics.Counter // trakcs the number of msgid fields in logs that have been truncated
+	pMalformed            metrics.Counter // tracks the number of malformed frames skipped by lenient parsing
+	pDuplicates           metrics.Counter // tracks the number of logs not forwarded as they'd already been delivered
 	pAuthUsers            map[string]metrics.Counter
 	sync.WaitGroup
 }
 
-func newHTTPServer(config IssConfig, auth *BasicAuth, fixerFunc FixerFunc, deliverer deliverer) *httpServer {
+func newHTTPServer(config IssConfig, auth *BasicAuth, limiter rateLimiter, dedup dedupStore, fixerFunc FixerFunc, deliverer deliverer) *httpServer {
 	return &httpServer{
 		auth:                  auth,
+		limiter:               limiter,
+		dedup:                 dedup,
 		Config:                config,
 		FixerFunc:             fixerFunc,
 		deliverer:             deliverer,
@@ -90,6 +125,8 @@ func newHTTPServer(config IssConfig, auth *BasicAuth, fixerFunc FixerFunc, deliv
 		pAppnameTruncations:   metrics.GetOrRegisterCounter("log-iss.logs.appname_truncations", config.MetricsRegistry),
 		pProcidTruncations:    metrics.GetOrRegisterCounter("log-iss.logs.procid_truncations", config.MetricsRegistry),
 		pMsgidTruncations:     metrics.GetOrRegisterCounter("log-iss.logs.msgid_truncations", config.MetricsRegistry),
+		pMalformed:            metrics.GetOrRegisterCounter("log-iss.logs.malformed", config.MetricsRegistry),
+		pDuplicates:           metrics.GetOrRegisterCounter("log-iss.logs.duplicates", config.MetricsRegistry),
 		pAuthUsers:            make(map[string]metrics.Counter),
 		isShuttingDown:        false,
 	}
@@ -120,7 +157,6 @@ func extractRemoteAddr(r *http.Request) string {
 func (s *httpServer) Run() error {
 	go s.awaitShutdown()
 
-	//FXME: check outlet depth?
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		defer s.healthChecks.UpdateSince(time.Now())
 		if s.isShuttingDown {
@@ -128,8 +164,17 @@ func (s *httpServer) Run() error {
 			return
 		}
 
+		if sc, ok := s.deliverer.(saturationChecker); ok {
+			if err := sc.saturated(); err != nil {
+				http.Error(w, err.Error(), 503)
+				return
+			}
+		}
+
 	})
 
+	http.HandleFunc("/health/credentials", s.handleCredentialHealth)
+
 	http.HandleFunc("/logs", func(w http.ResponseWriter, r *http.Request) {
 		defer s.posts.UpdateSince(time.Now())
 
@@ -148,34 +193,38 @@ func (s *httpServer) Run() error {
 			return
 		}
 
-		if r.Header.Get("Content-Type") != "application/logplex-1" {
-			s.handleHTTPError(w, "Only Content-Type application/logplex-1 is accepted", 400)
+		switch contentType(r) {
+		case logplexContentType, jsonContentType, ndjsonContentType:
+		default:
+			s.handleHTTPError(w, "Only Content-Type application/logplex-1, application/json or application/x-ndjson is accepted", 400)
 			return
 		}
 
-		cred := s.auth.Authenticate(r)
-		if cred == nil {
+		cred, err := s.auth.Authenticate(r)
+		if err != nil {
 			s.pAuthErrors.Inc(1)
-			s.handleHTTPError(w, "Unable to authenticate request", 401)
+			s.handleHTTPError(w, err.Error(), 401)
 			return
 		} else {
 			s.pAuthSuccesses.Inc(1)
 		}
+		if cred.Deprecated {
+			setDeprecationHeaders(w.Header(), cred)
+		}
 
 		remoteAddr := extractRemoteAddr(r)
 		requestID := r.Header.Get("X-Request-Id")
 		logplexDrainToken := r.Header.Get("Logplex-Drain-Token")
 
 		body := r.Body
-		var err error
-
 		if r.Header.Get("Content-Encoding") == "gzip" {
-			body, err = gzip.NewReader(r.Body)
+			gz, err := getGzipReader(r.Body)
 			if err != nil {
 				s.handleHTTPError(w, "Could not decode gzip request", 500)
 				return
 			}
-			defer body.Close()
+			defer putGzipReader(gz)
+			body = gz
 		}
 
 		// This should only be reached if authentication information is valid.
@@ -196,7 +245,14 @@ func (s *httpServer) Run() error {
 			um.Inc(1)
 		}
 
-		if err, status := s.process(r, body, remoteAddr, requestID, logplexDrainToken, s.Config.MetadataId, cred); err != nil {
+		res, err, status := s.process(r, body, remoteAddr, requestID, logplexDrainToken, s.Config.MetadataId, cred)
+		if err != nil {
+			switch e := err.(type) {
+			case *throttledError:
+				w.Header().Set("Retry-After", retryAfterHeader(e.RetryAfter))
+			case *overloadedError:
+				w.Header().Set("Retry-After", retryAfterHeader(e.RetryAfter))
+			}
 			s.handleHTTPError(
 				w, err.Error(), status,
 				log.Fields{"remote_addr": remoteAddr, "requestId": requestID, "logdrain_token": logplexDrainToken},
@@ -205,44 +261,137 @@ func (s *httpServer) Run() error {
 		}
 
 		s.pSuccesses.Inc(1)
+		if res.duplicates > 0 {
+			log.WithFields(log.Fields{
+				"remote_addr": remoteAddr, "requestId": requestID, "logdrain_token": logplexDrainToken,
+				"frame_id": r.Header.Get(logplexFrameIDHeader), "duplicates": res.duplicates,
+			}).Info("Skipped logs already delivered")
+		}
+		if logplexDrainToken != "" {
+			s.accountLogplexLoss(r, res, logplexDrainToken, requestID)
+		}
+		if res.malformed > 0 {
+			s.pMalformed.Inc(res.malformed)
+			log.WithFields(log.Fields{
+				"remote_addr": remoteAddr, "requestId": requestID, "logdrain_token": logplexDrainToken,
+				"malformed": res.malformed, "frames": res.malformedFrames,
+			}).Warn("Skipped malformed frames")
+			writeMalformedReport(w, res)
+		}
 	})
 
 	return http.ListenAndServe(":"+s.Config.HttpPort, nil)
 }
 
+// Report the state of the credentials requests are authenticated with, with
+// status 503 unless they're up to date.
+func (s *httpServer) handleCredentialHealth(w http.ResponseWriter, r *http.Request) {
+	defer s.healthChecks.UpdateSince(time.Now())
+	h := s.auth.Health()
+	w.Header().Set("Content-Type", jsonContentType)
+	if h.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(h)
+}
+
 func (s *httpServer) awaitShutdown() {
 	<-s.shutdownCh
 	s.isShuttingDown = true
 	log.WithFields(log.Fields{"ns": "http", "at": "shutdown"}).Info()
 }
 
-func (s *httpServer) process(req *http.Request, reader io.Reader, remoteAddr string, requestID string, logplexDrainToken string, metadataId string, cred *credential) (error, int) {
+func (s *httpServer) process(req *http.Request, reader io.Reader, remoteAddr string, requestID string, logplexDrainToken string, metadataId string, cred *credential) (fixResult, error, int) {
 	s.Add(1)
 	defer s.Done()
 
-	r, err := s.FixerFunc(req, reader, remoteAddr, logplexDrainToken, metadataId, cred, &s.Config)
-	if err != nil {
-		return errors.New("Problem fixing body: " + err.Error()), http.StatusBadRequest
+	// Frames are delivered in chunks as the body is read, so a large body is
+	// never held in memory all at once. Chunks delivered before an error are
+	// not retracted, and are remembered so they're skipped if the request is
+	// retried.
+	var dedup *requestDedup
+	if s.dedup != nil {
+		dedup = newRequestDedup(req, logplexDrainToken, s.Config.DedupBodyHash)
+	}
+	var duplicates int64
+	var admitted bool
+	deliver := func(c fixResult) error {
+		var key string
+		if dedup != nil {
+			key = dedup.Key(c.bytes)
+			if !s.dedup.Claim(key) {
+				duplicates += c.numForwarded
+				s.pDuplicates.Inc(c.numForwarded)
+				return nil
+			}
+		}
+		if err, status := s.deliver(req, c, key, remoteAddr, requestID, logplexDrainToken, cred, admitted); err != nil {
+			if key != "" {
+				s.dedup.Release(key)
+			}
+			return &deliveryError{err: err, status: status}
+		}
+		admitted = true
+		return nil
 	}
 
+	r, err := s.FixerFunc(req, reader, remoteAddr, logplexDrainToken, metadataId, cred, &s.Config, deliver)
+	r.duplicates = duplicates
 	s.pLogsReceived.Inc(r.numLogs)
 	if r.hasMetadata {
 		s.pMetadataLogsReceived.Inc(r.numLogs)
 	}
+	s.pHostnameTruncations.Inc(r.hostnameTruncs)
+	s.pAppnameTruncations.Inc(r.appnameTruncs)
+	s.pProcidTruncations.Inc(r.procidTruncs)
+	s.pMsgidTruncations.Inc(r.msgidTruncs)
+
+	if err != nil {
+		if de, ok := err.(*deliveryError); ok {
+			return r, de.err, de.status
+		}
+		return r, errors.New("Problem fixing body: " + err.Error()), http.StatusBadRequest
+	}
+	return r, nil, 200
+}
+
+// Deliver a chunk of frames from a request, subject to the credential's rate
+// limits and load shedding. Whether a request is within its limits or shed is
+// decided before its first chunk is delivered, and later chunks are only
+// counted, so a request is never throttled or shed part way through.
+func (s *httpServer) deliver(req *http.Request, c fixResult, dedupKey string, remoteAddr string, requestID string, logplexDrainToken string, cred *credential, admitted bool) (error, int) {
+	if user, _, ok := req.BasicAuth(); ok {
+		key, limits := rateLimitKey(user, cred, logplexDrainToken)
+		if admitted {
+			s.limiter.Charge(key, limits, c.numForwarded, int64(len(c.bytes)))
+		} else if ok, wait := s.limiter.Take(key, limits, c.numForwarded, int64(len(c.bytes))); !ok {
+			me := "log-iss.ratelimit." + user + ".throttled"
+			metrics.GetOrRegisterCounter(me+".requests", s.Config.MetricsRegistry).Inc(1)
+			metrics.GetOrRegisterCounter(me+".lines", s.Config.MetricsRegistry).Inc(c.numForwarded)
+			metrics.GetOrRegisterCounter(me+".bytes", s.Config.MetricsRegistry).Inc(int64(len(c.bytes)))
+			return &throttledError{RetryAfter: wait}, http.StatusTooManyRequests
+		}
+	}
 
-	payload := NewPayload(remoteAddr, requestID, r.bytes)
+	payload := NewPayload(remoteAddr, requestID, c.bytes)
+	payload.Frames = c.numForwarded
+	payload.DedupKey = dedupKey
+	payload.Admitted = admitted
+	payload.Source = payloadSource{Credential: cred, DrainToken: logplexDrainToken, Query: req.URL.Query()}
+	payload.Context = req.Context()
 	if err := s.deliverer.Deliver(payload); err != nil {
+		if oe, ok := err.(*overloadedError); ok {
+			return oe, s.Config.LoadShedStatus
+		}
+		if err == errSpoolFull {
+			return errors.New("Problem delivering body: " + err.Error()), http.StatusServiceUnavailable
+		}
 		return errors.New("Problem delivering body: " + err.Error()), http.StatusGatewayTimeout
 	}
 
-	s.pLogsSent.Inc(r.numLogs)
-	if r.hasMetadata {
-		s.pMetadataLogsSent.Inc(r.numLogs)
+	s.pLogsSent.Inc(c.numForwarded)
+	if c.hasMetadata {
+		s.pMetadataLogsSent.Inc(c.numForwarded)
 	}
-	s.pHostnameTruncations.Inc(r.hostnameTruncs)
-	s.pAppnameTruncations.Inc(r.appnameTruncs)
-	s.pProcidTruncations.Inc(r.procidTruncs)
-	s.pMsgidTruncations.Inc(r.msgidTruncs)
-
 	return nil, 200
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failingDeliverer struct {
+	err error
+}
+
+func (d failingDeliverer) Deliver(p payload) error {
+	return d.err
+}
+
+type discardDeliverer struct{}
+
+func (discardDeliverer) Deliver(p payload) error {
+	return nil
+}
+
+// A body of n frames, each about 100 bytes.
+func logplexBody(n int) []byte {
+	var b bytes.Buffer
+	for i := 0; i < n; i++ {
+		writeSyslogFrame(&b, []byte(fmt.Sprintf("<13>1 2013-06-07T13:17:49.468822+00:00 host app web.1 - - at=info method=GET path=/%d status=200", i)))
+	}
+	return b.Bytes()
+}
+
+func newTestHTTPServer(t testing.TB, config IssConfig, d deliverer) *httpServer {
+	p, err := newPipeline(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newHTTPServer(config, nil, nil, nil, p.Fix, d)
+}
+
+func TestProcessDeliversChunks(t *testing.T) {
+	assert := assert.New(t)
+	config := *getConfig()
+	config.ChunkBytes = 1000
+	d := &recordingDeliverer{}
+	s := newTestHTTPServer(t, config, d)
+
+	body := logplexBody(25)
+	r, err, status := s.process(simpleHttpRequest(), bytes.NewReader(body), "", "", "", "", nil)
+	assert.NoError(err)
+	assert.Equal(200, status)
+	assert.Equal(int64(25), r.numForwarded)
+	assert.Nil(r.bytes)
+
+	if !assert.True(len(d.payloads) > 1) {
+		return
+	}
+	for _, p := range d.payloads[:len(d.payloads)-1] {
+		assert.True(len(p.Body) >= 1000 && len(p.Body) < 1200, "chunks end with the frame reaching ChunkBytes")
+		assert.NoError(eachFrame(p.Body, func(*routedFrame) {}), "chunks contain whole frames")
+	}
+	assert.Equal(string(body), d.bodies())
+	assert.Equal(int64(25), s.pLogsSent.Count())
+}
+
+func TestProcessErrors(t *testing.T) {
+	tests := map[string]struct {
+		deliverer deliverer
+		body      string
+		status    int
+		err       string
+	}{
+		"spool full":    {deliverer: failingDeliverer{errSpoolFull}, body: string(logplexBody(1)), status: 503, err: "Problem delivering body: " + errSpoolFull.Error()},
+		"timeout":       {deliverer: failingDeliverer{fmt.Errorf("Timed out")}, body: string(logplexBody(1)), status: 504, err: "Problem delivering body: Timed out"},
+		"bad frame":     {deliverer: &recordingDeliverer{}, body: string(logplexBody(1)) + "junk ", status: 400, err: `Problem fixing body: Invalid frame length "junk"`},
+		"short frame":   {deliverer: &recordingDeliverer{}, body: "100 <13>1 - - - - - hi", status: 400, err: "Problem fixing body: unexpected EOF"},
+		"nothing kept":  {deliverer: failingDeliverer{errSpoolFull}, body: "", status: 200},
+		"trailing junk": {deliverer: &recordingDeliverer{}, body: string(logplexBody(1)) + "\n", status: 200},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := newTestHTTPServer(t, *getConfig(), test.deliverer)
+			_, err, status := s.process(simpleHttpRequest(), strings.NewReader(test.body), "", "", "", "", nil)
+			assert.Equal(t, test.status, status)
+			if test.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, test.err)
+			}
+		})
+	}
+}
+
+func BenchmarkProcessLogplex(b *testing.B) {
+	benchmarkProcess(b, logplexBody(1000), false)
+}
+
+func BenchmarkProcessLogplexGzip(b *testing.B) {
+	benchmarkProcess(b, logplexBody(100000), true)
+}
+
+// Benchmark a request from being read to being delivered, with a body of
+// frames which may be gzipped as log-shuttle does.
+func benchmarkProcess(b *testing.B, body []byte, gzipped bool) {
+	s := newTestHTTPServer(b, *getConfig(), discardDeliverer{})
+	req, _ := http.NewRequest("POST", "/logs", nil)
+	if gzipped {
+		var gz bytes.Buffer
+		w := gzip.NewWriter(&gz)
+		w.Write(body)
+		w.Close()
+		body = gz.Bytes()
+	}
+	r := bytes.NewReader(body)
+
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(body)
+		if !gzipped {
+			if _, err, _ := s.process(req, r, "1.2.3.4", "", "", "", nil); err != nil {
+				b.Fatal(err)
+			}
+			continue
+		}
+
+		gz, err := getGzipReader(r)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err, _ := s.process(req, gz, "1.2.3.4", "", "", "", nil); err != nil {
+			b.Fatal(err)
+		}
+		putGzipReader(gz)
+	}
+}
+
+func TestHandleCredentialHealth(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Unix(10000, 0)
+	s := newHTTPServer(*getConfig(), refreshedCreds(now, ""), nil, nil, nil, discardDeliverer{})
+
+	rec := httptest.NewRecorder()
+	s.handleCredentialHealth(rec, httptest.NewRequest("GET", "/health/credentials", nil))
+	assert.Equal(200, rec.Code)
+	assert.Equal(jsonContentType, rec.Header().Get("Content-Type"))
+	assert.JSONEq(`{"status":"ok","source":"redis"}`, rec.Body.String())
+
+	s.auth.recordRefresh(errors.New("connection refused"))
+	s.auth.now = func() time.Time { return now.Add(2 * time.Hour) }
+	rec = httptest.NewRecorder()
+	s.handleCredentialHealth(rec, httptest.NewRequest("GET", "/health/credentials", nil))
+	assert.Equal(503, rec.Code)
+	assert.JSONEq(`{"status":"stale","source":"token_map","age_seconds":7200,"error":"connection refused"}`, rec.Body.String())
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bmizerany/lpx"
+)
+
+const (
+	// Default PRI for JSON frames that don't specify one: user.notice, the
+	// same as logplex uses for application logs.
+	defaultJSONPriority = 13
+	maxPriority         = 191
+)
+
+// jsonFrame is a single log line submitted as part of an application/json or
+// application/x-ndjson batch.
+type jsonFrame struct {
+	Priority       *int                         `json:"priority,omitempty"`
+	Timestamp      string                       `json:"timestamp,omitempty"`
+	Hostname       string                       `json:"hostname,omitempty"`
+	App            string                       `json:"app,omitempty"`
+	Procid         string                       `json:"procid,omitempty"`
+	Msgid          string                       `json:"msgid,omitempty"`
+	StructuredData map[string]map[string]string `json:"structured_data,omitempty"`
+	Message        string                       `json:"message,omitempty"`
+}
+
+// fixJSON writes the frames of an application/json batch, a single array of
+// objects, into fw.
+func fixJSON(fw *frameWriter, r io.Reader) error {
+	dec := json.NewDecoder(r)
+
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := t.(json.Delim); !ok || d != '[' {
+		return fmt.Errorf("Expected a JSON array of log lines")
+	}
+
+	for dec.More() {
+		var f jsonFrame
+		if err := dec.Decode(&f); err != nil {
+			return err
+		}
+		if err := writeJSONFrame(fw, &f); err != nil {
+			return err
+		}
+	}
+
+	_, err = dec.Token()
+	return err
+}
+
+// fixNDJSON writes the frames of an application/x-ndjson batch, one object per
+// line, into fw.
+func fixNDJSON(fw *frameWriter, r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		var f jsonFrame
+		if err := dec.Decode(&f); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := writeJSONFrame(fw, &f); err != nil {
+			return err
+		}
+	}
+}
+
+// Convert a jsonFrame into the header and message expected by fw.write.
+func writeJSONFrame(fw *frameWriter, f *jsonFrame) error {
+	pri := defaultJSONPriority
+	if f.Priority != nil {
+		pri = *f.Priority
+	}
+	if pri < 0 || pri > maxPriority {
+		return fmt.Errorf("Invalid priority %d", pri)
+	}
+
+	ts := "-"
+	if f.Timestamp != "" {
+		if _, err := time.Parse(time.RFC3339Nano, f.Timestamp); err != nil {
+			return fmt.Errorf("Invalid timestamp %q", f.Timestamp)
+		}
+		ts = f.Timestamp
+	}
+
+	header := lpx.Header{
+		PrivalVersion: []byte("<" + strconv.Itoa(pri) + ">1"),
+		Time:          []byte(ts),
+	}
+	fields := []struct {
+		name  string
+		value string
+		dst   *[]byte
+	}{
+		{"hostname", f.Hostname, &header.Hostname},
+		{"app", f.App, &header.Name},
+		{"procid", f.Procid, &header.Procid},
+		{"msgid", f.Msgid, &header.Msgid},
+	}
+	for _, field := range fields {
+		if strings.ContainsAny(field.value, " \t\r\n") {
+			return fmt.Errorf("Invalid %s %q", field.name, field.value)
+		}
+		*field.dst = []byte(nilValue(field.value))
+	}
+
+	var b bytes.Buffer
+	if len(f.StructuredData) > 0 {
+		if err := writeJSONStructuredData(&b, f.StructuredData); err != nil {
+			return err
+		}
+		if f.Message != "" {
+			b.WriteString(" ")
+		}
+	} else if f.Message != "" {
+		b.Write(nilVal)
+	}
+	b.WriteString(f.Message)
+
+	return fw.write(&header, b.Bytes())
+}
+
+// Returns "-" in place of an empty header field.
+func nilValue(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// Write STRUCTURED-DATA elements, sorted by SD-ID and PARAM-NAME so output is
+// stable.
+func writeJSONStructuredData(b *bytes.Buffer, sd map[string]map[string]string) error {
+	ids := make([]string, 0, len(sd))
+	for id := range sd {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		params := sd[id]
+		names := make([]string, 0, len(params))
+		for name := range params {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		e := sdElement{ID: id}
+		for _, name := range names {
+			e.Add(name, params[name])
+		}
+		if err := e.Validate(); err != nil {
+			return err
+		}
+		e.Write(b, false)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFixJSON(t *testing.T) {
+	tests := map[string]struct {
+		contentType string
+		body        string
+		expected    string
+		numLogs     int64
+		err         bool
+	}{
+		"json batch": {
+			contentType: "application/json",
+			body:        `[{"timestamp":"2013-06-07T13:17:49.468822+00:00","hostname":"host","app":"heroku","procid":"web.7","message":"hi"},{"timestamp":"2013-06-07T13:17:49.468822+00:00","hostname":"host","app":"heroku","procid":"web.7","message":"hello"}]`,
+			expected:    "83 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"] hi86 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"] hello",
+			numLogs:     2,
+		},
+		"ndjson batch with content type parameters": {
+			contentType: "application/x-ndjson; charset=utf-8",
+			body:        "{\"timestamp\":\"2013-06-07T13:17:49.468822+00:00\",\"hostname\":\"host\",\"app\":\"heroku\",\"procid\":\"web.7\",\"message\":\"hi\"}\n{\"priority\":11,\"timestamp\":\"2013-06-07T13:17:49.468822+00:00\",\"hostname\":\"host\",\"app\":\"heroku\",\"procid\":\"web.7\",\"msgid\":\"m\",\"message\":\"hello\"}\n",
+			expected:    "83 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"] hi86 <11>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 m [origin ip=\"1.2.3.4\"] hello",
+			numLogs:     2,
+		},
+		"structured data": {
+			contentType: "application/json",
+			body:        `[{"timestamp":"2013-06-07T13:17:49.468822+00:00","hostname":"host","app":"heroku","procid":"web.7","structured_data":{"meta":{"sequenceId":"hello"},"foo":{"bar":"b\"a]z"}},"message":"hello"}]`,
+			expected:    "130 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"][foo bar=\"b\\\"a\\]z\"][meta sequenceId=\"hello\"] hello",
+			numLogs:     1,
+		},
+		"empty fields": {
+			contentType: "application/json",
+			body:        `[{}]`,
+			expected:    "37 <13>1 - - - - - [origin ip=\"1.2.3.4\"]",
+			numLogs:     1,
+		},
+		"invalid timestamp": {
+			contentType: "application/json",
+			body:        `[{"timestamp":"yesterday","message":"hi"}]`,
+			err:         true,
+		},
+		"invalid hostname": {
+			contentType: "application/json",
+			body:        `[{"hostname":"my host","message":"hi"}]`,
+			err:         true,
+		},
+		"invalid priority": {
+			contentType: "application/x-ndjson",
+			body:        `{"priority":192,"message":"hi"}`,
+			err:         true,
+		},
+		"invalid SD-ID": {
+			contentType: "application/json",
+			body:        `[{"structured_data":{"my id":{"a":"b"}},"message":"hi"}]`,
+			err:         true,
+		},
+		"invalid PARAM-NAME": {
+			contentType: "application/json",
+			body:        `[{"structured_data":{"meta":{"a=b":"c"}},"message":"hi"}]`,
+			err:         true,
+		},
+		"not an array": {
+			contentType: "application/json",
+			body:        `{"message":"hi"}`,
+			err:         true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := simpleHttpRequest()
+			req.Header.Set("Content-Type", test.contentType)
+			r, err := fix(req, strings.NewReader(test.body), "1.2.3.4", "", "", nil, getConfig())
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, string(r.bytes))
+			assert.Equal(t, test.numLogs, r.numLogs)
+			assert.False(t, r.hasMetadata)
+		})
+	}
+}
+
+func TestFixJSONMatchesLogplex(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv("LOG_ISS_QUERY_PARAMS", "index;source;sourcetype")
+	testToken := "d.34bc219c-983b-463e-a17d-3d34ee7db812"
+	cred := credential{Stage: "previous", Name: "cred", Deprecated: true}
+
+	logplex := []byte("63 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi")
+	lr, err := fix(httpRequestWithParams(), bytes.NewReader(logplex), "1.2.3.4", testToken, "metadata@123", &cred, getConfig())
+	assert.NoError(err)
+
+	req := httpRequestWithParams()
+	req.Header.Set("Content-Type", "application/json")
+	body := `[{"timestamp":"2013-06-07T13:17:49.468822+00:00","hostname":"host","app":"heroku","procid":"web.7","message":"hi"}]`
+	jr, err := fix(req, strings.NewReader(body), "1.2.3.4", testToken, "metadata@123", &cred, getConfig())
+	assert.NoError(err)
+
+	assert.Equal(string(lr.bytes), string(jr.bytes))
+	assert.Equal(lr, jr)
+}
+
+func TestFixJSONTruncation(t *testing.T) {
+	assert := assert.New(t)
+
+	req := simpleHttpRequest()
+	req.Header.Set("Content-Type", "application/json")
+	body := fmt.Sprintf(`[{"timestamp":"2013-06-07T13:17:49.468822+00:00","hostname":"host","app":"%s","procid":"web.7"}]`, strings.Repeat("a", 49))
+	r, err := fix(req, strings.NewReader(body), "", "", "", nil, getConfig())
+	assert.NoError(err)
+	assert.Equal(fmt.Sprintf("102 <13>1 2013-06-07T13:17:49.468822+00:00 host %s web.7 - -", strings.Repeat("a", 48)), string(r.bytes))
+	assert.Equal(int64(1), r.appnameTruncs)
+}
+
+func TestContentType(t *testing.T) {
+	tests := map[string]string{
+		"":                                    "",
+		"application/logplex-1":               "application/logplex-1",
+		"application/json; charset=utf-8":     "application/json",
+		"Application/X-NDJSON":                "application/x-ndjson",
+		"application/logplex-1; charset=utf8": "application/logplex-1",
+	}
+
+	for in, expected := range tests {
+		req, _ := http.NewRequest("POST", "/logs", nil)
+		req.Header.Set("Content-Type", in)
+		assert.Equal(t, expected, contentType(req), in)
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	l2metSinkRegistry = "registry"
+	l2metSinkStatsd   = "statsd"
+
+	l2metCount   = "count"
+	l2metSample  = "sample"
+	l2metMeasure = "measure"
+
+	// Most measurements kept per series and flush interval, so one noisy
+	// series can't use unbounded memory.
+	maxL2metMeasurements = 1024
+
+	// Largest UDP packet sent to StatsD.
+	maxStatsdPacket = 1400
+)
+
+// Statistics exported for each measure# series.
+var l2metMeasureStats = []string{"min", "max", "mean", "median", "perc95", "perc99"}
+
+// l2metSeries aggregates the values seen for one metric from one source during
+// a flush interval.
+type l2metSeries struct {
+	kind   string
+	count  float64   // sum of count# values
+	last   float64   // latest sample# value
+	values []float64 // measure# values
+}
+
+// l2metSink receives the series aggregated during a flush interval.
+type l2metSink interface {
+	Flush(series map[string]*l2metSeries)
+}
+
+// l2met is a processor which turns l2met style count#, sample# and measure#
+// lines, and Heroku router lines, into metrics. Frames are never modified.
+type l2met struct {
+	mu        sync.Mutex
+	series    map[string]*l2metSeries
+	maxSeries int
+	sink      l2metSink
+	dropped   metrics.Counter // tracks the number of values dropped because there were too many series
+	ticker    *time.Ticker
+	done      chan struct{}
+}
+
+func newL2met(config IssConfig) (*l2met, error) {
+	l := &l2met{
+		series:    make(map[string]*l2metSeries),
+		maxSeries: config.L2metMaxSeries,
+		dropped:   metrics.GetOrRegisterCounter("log-iss.l2met.series_dropped", config.MetricsRegistry),
+	}
+
+	switch config.L2metSink {
+	case l2metSinkRegistry:
+		if config.L2metSeriesIdle <= 0 {
+			return nil, fmt.Errorf("L2MET_SERIES_IDLE must be positive")
+		}
+		l.sink = newL2metRegistrySink(config.MetricsRegistry, config.L2metMaxSeries, config.L2metSeriesIdle, l.dropped)
+	case l2metSinkStatsd:
+		if config.L2metStatsdAddr == "" {
+			return nil, fmt.Errorf("L2MET_STATSD_ADDR is required when L2MET_SINK is %s", l2metSinkStatsd)
+		}
+		conn, err := net.Dial("udp", config.L2metStatsdAddr)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to connect to StatsD: %s", err)
+		}
+		l.sink = &l2metStatsdSink{conn: conn}
+	default:
+		return nil, fmt.Errorf("L2MET_SINK must be one of %s or %s", l2metSinkRegistry, l2metSinkStatsd)
+	}
+
+	if config.L2metFlushInterval <= 0 {
+		return nil, fmt.Errorf("L2MET_FLUSH_INTERVAL must be positive")
+	}
+	l.ticker = time.NewTicker(config.L2metFlushInterval)
+	l.done = make(chan struct{})
+	go l.run()
+
+	return l, nil
+}
+
+// Flush the series every interval until closed.
+func (l *l2met) run() {
+	for {
+		select {
+		case <-l.ticker.C:
+			l.flush()
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// Close stops flushing, flushes the series of the current interval and closes
+// the sink if it has anything to close.
+func (l *l2met) Close() error {
+	l.ticker.Stop()
+	close(l.done)
+	l.flush()
+	if c, ok := l.sink.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (l *l2met) Process(b *batch, f *frame) bool {
+	_, _, msg := splitStructuredData(f.Data)
+	if len(msg) == 0 {
+		return true
+	}
+
+	source := string(f.Header.Procid)
+	router := string(f.Header.Name) == "heroku" && source == "router"
+	var found bool
+	fields := bytes.Fields(msg)
+	for _, field := range fields {
+		if bytes.HasPrefix(field, []byte("source=")) {
+			source = string(field[len("source="):])
+		}
+		if bytes.IndexByte(field, '#') > 0 {
+			found = true
+		}
+	}
+	if !found && !router {
+		return true
+	}
+
+	prefix := "log-iss.l2met." + metricSegment(string(f.Header.Hostname)) + "." + metricSegment(source) + "."
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, field := range fields {
+		key, value := field, []byte(nil)
+		if i := bytes.IndexByte(field, '='); i >= 0 {
+			key, value = field[:i], field[i+1:]
+		}
+
+		if router {
+			l.addRouter(prefix, string(key), value)
+			continue
+		}
+
+		i := bytes.IndexByte(key, '#')
+		if i < 0 {
+			continue
+		}
+		kind, name := string(key[:i]), string(key[i+1:])
+		if !validL2metName(name) {
+			continue
+		}
+		switch kind {
+		case l2metCount:
+			v := 1.0
+			if value != nil {
+				var ok bool
+				if v, ok = parseL2metValue(value); !ok {
+					continue
+				}
+			}
+			l.add(prefix+name, kind, v)
+		case l2metSample, l2metMeasure:
+			if v, ok := parseL2metValue(value); ok {
+				l.add(prefix+name, kind, v)
+			}
+		}
+	}
+
+	return true
+}
+
+// Heroku router lines have connect and service times, a status and, on
+// errors, a code such as H12.
+func (l *l2met) addRouter(prefix, key string, value []byte) {
+	switch key {
+	case "connect", "service":
+		if v, ok := parseL2metValue(value); ok {
+			l.add(prefix+"router."+key, l2metMeasure, v)
+		}
+	case "status":
+		if _, err := strconv.Atoi(string(value)); err == nil {
+			l.add(prefix+"router.status."+string(value), l2metCount, 1)
+		}
+	case "code":
+		if validL2metName(string(value)) {
+			l.add(prefix+"router.error."+string(value), l2metCount, 1)
+		}
+	}
+}
+
+// Add v to a series, which must be called with l.mu held.
+func (l *l2met) add(name, kind string, v float64) {
+	s, ok := l.series[name]
+	if !ok {
+		if l.maxSeries > 0 && len(l.series) >= l.maxSeries {
+			l.dropped.Inc(1)
+			return
+		}
+		s = &l2metSeries{kind: kind}
+		l.series[name] = s
+	}
+	if s.kind != kind {
+		// The same name was used with a different kind during this interval.
+		l.dropped.Inc(1)
+		return
+	}
+
+	switch kind {
+	case l2metCount:
+		s.count += v
+	case l2metSample:
+		s.last = v
+	case l2metMeasure:
+		if len(s.values) < maxL2metMeasurements {
+			s.values = append(s.values, v)
+		}
+	}
+}
+
+// Hand the series aggregated so far to the sink and start a new interval.
+func (l *l2met) flush() {
+	l.mu.Lock()
+	series := l.series
+	l.series = make(map[string]*l2metSeries, len(series))
+	l.mu.Unlock()
+
+	if len(series) > 0 {
+		l.sink.Flush(series)
+	}
+}
+
+// l2metRegistrySink exports series to the metrics registry, and so to Librato
+// and Prometheus. Counts are counters, samples are gauges and each statistic of
+// a measure is a gauge suffixed by its name, e.g. .perc95.
+//
+// Series names come from tenants' logs, so at most maxSeries are registered at
+// once, and series which haven't been flushed for idle are unregistered.
+type l2metRegistrySink struct {
+	registry   metrics.Registry
+	maxSeries  int
+	idle       time.Duration
+	dropped    metrics.Counter
+	registered map[string]*l2metRegistered
+	now        func() time.Time
+}
+
+// l2metRegistered is a series registered by an l2metRegistrySink.
+type l2metRegistered struct {
+	kind string
+	last time.Time // when the series was last flushed
+}
+
+func newL2metRegistrySink(registry metrics.Registry, maxSeries int, idle time.Duration, dropped metrics.Counter) *l2metRegistrySink {
+	return &l2metRegistrySink{
+		registry:   registry,
+		maxSeries:  maxSeries,
+		idle:       idle,
+		dropped:    dropped,
+		registered: make(map[string]*l2metRegistered),
+		now:        time.Now,
+	}
+}
+
+func (r *l2metRegistrySink) Flush(series map[string]*l2metSeries) {
+	now := r.now()
+	r.expire(now)
+
+	for name, s := range series {
+		reg, ok := r.registered[name]
+		if !ok {
+			if r.maxSeries > 0 && len(r.registered) >= r.maxSeries {
+				r.dropped.Inc(1)
+				continue
+			}
+			reg = &l2metRegistered{kind: s.kind}
+			r.registered[name] = reg
+		}
+		if reg.kind != s.kind {
+			r.dropped.Inc(1)
+			continue
+		}
+		reg.last = now
+
+		switch s.kind {
+		case l2metCount:
+			if c, ok := r.registry.GetOrRegister(name, metrics.NewCounter).(metrics.Counter); ok {
+				c.Inc(int64(math.Round(s.count)))
+			}
+		case l2metSample:
+			r.gauge(name, s.last)
+		case l2metMeasure:
+			stats := measureStats(s.values)
+			for i, stat := range l2metMeasureStats {
+				r.gauge(name+"."+stat, stats[i])
+			}
+		}
+	}
+}
+
+// Unregister series which haven't been flushed for r.idle.
+func (r *l2metRegistrySink) expire(now time.Time) {
+	for name, reg := range r.registered {
+		if now.Sub(reg.last) < r.idle {
+			continue
+		}
+		if reg.kind == l2metMeasure {
+			for _, stat := range l2metMeasureStats {
+				r.registry.Unregister(name + "." + stat)
+			}
+		} else {
+			r.registry.Unregister(name)
+		}
+		delete(r.registered, name)
+	}
+}
+
+func (r *l2metRegistrySink) gauge(name string, v float64) {
+	if g, ok := r.registry.GetOrRegister(name, metrics.NewGaugeFloat64).(metrics.GaugeFloat64); ok {
+		g.Update(v)
+	}
+}
+
+// l2metStatsdSink sends series to StatsD over UDP, with each measurement sent
+// as a timing so StatsD can compute its own statistics.
+type l2metStatsdSink struct {
+	conn net.Conn
+}
+
+func (st *l2metStatsdSink) Close() error {
+	return st.conn.Close()
+}
+
+func (st *l2metStatsdSink) Flush(series map[string]*l2metSeries) {
+	var packet bytes.Buffer
+	send := func(line string) {
+		if packet.Len() > 0 && packet.Len()+len(line)+1 > maxStatsdPacket {
+			st.write(packet.Bytes())
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteString("\n")
+		}
+		packet.WriteString(line)
+	}
+
+	for name, s := range series {
+		name = strings.TrimPrefix(name, "log-iss.")
+		switch s.kind {
+		case l2metCount:
+			send(name + ":" + formatL2metValue(s.count) + "|c")
+		case l2metSample:
+			send(name + ":" + formatL2metValue(s.last) + "|g")
+		case l2metMeasure:
+			for _, v := range s.values {
+				send(name + ":" + formatL2metValue(v) + "|ms")
+			}
+		}
+	}
+	if packet.Len() > 0 {
+		st.write(packet.Bytes())
+	}
+}
+
+func (st *l2metStatsdSink) write(b []byte) {
+	if _, err := st.conn.Write(b); err != nil {
+		log.WithFields(log.Fields{"ns": "l2met", "at": "statsd", "message": err}).Error()
+	}
+}
+
+// Return the min, max, mean, median, 95th and 99th percentiles of values.
+func measureStats(values []float64) []float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+	perc := func(p float64) float64 {
+		return sorted[int(math.Ceil(p*float64(len(sorted))))-1]
+	}
+	return []float64{sorted[0], sorted[len(sorted)-1], sum / float64(len(sorted)), perc(0.5), perc(0.95), perc(0.99)}
+}
+
+// Parse the number at the start of b, ignoring any units that follow, e.g.
+// 12.5ms or 21.00MB.
+func parseL2metValue(b []byte) (float64, bool) {
+	end := 0
+	for end < len(b) && (b[end] >= '0' && b[end] <= '9' || b[end] == '.' || b[end] == '-' || b[end] == '+' || b[end] == 'e') {
+		end++
+	}
+	if end == 0 {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(string(b[:end]), 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, false
+	}
+	return v, true
+}
+
+func formatL2metValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// Metric names may only contain letters, digits, '.', '_' and '-'.
+func validL2metName(s string) bool {
+	if s == "" || s[0] == '.' || s[len(s)-1] == '.' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/lpx"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingL2metSink struct {
+	series map[string]*l2metSeries
+}
+
+func (r *recordingL2metSink) Flush(series map[string]*l2metSeries) {
+	r.series = series
+}
+
+func l2metFrame(app, procid, msg string) *frame {
+	return &frame{
+		Header: lpx.Header{
+			PrivalVersion: []byte("<13>1"),
+			Hostname:      []byte("d.1234"),
+			Name:          []byte(app),
+			Procid:        []byte(procid),
+		},
+		Data: []byte("- " + msg),
+	}
+}
+
+func TestL2metProcess(t *testing.T) {
+	assert := assert.New(t)
+	config := *getConfig()
+	config.L2metMaxSeries = 8
+	l, err := newL2met(config)
+	if !assert.NoError(err) {
+		return
+	}
+	defer l.Close()
+	sink := &recordingL2metSink{}
+	l.sink = sink
+
+	frames := []*frame{
+		l2metFrame("app", "web.1", "count#jobs=2 measure#db.query=12.5ms"),
+		l2metFrame("app", "web.1", "count#jobs measure#db.query=7.5ms"),
+		l2metFrame("app", "web.1", "just some text"),
+		l2metFrame("heroku", "web.2", "source=web.2 dyno=heroku.1 sample#memory_total=21.00MB sample#memory_total=22.50MB"),
+		l2metFrame("heroku", "router", `at=info method=GET path="/" dyno=web.1 connect=1ms service=25ms status=200 bytes=12`),
+		l2metFrame("heroku", "router", `at=error code=H12 desc="Request timeout" path="/" connect=1ms service=30000ms status=503`),
+		l2metFrame("app", "web.1", "count#bad!name=1 sample#nan=NaN measure#empty="),
+	}
+	for _, f := range frames {
+		data := string(f.Data)
+		assert.True(l.Process(&batch{}, f))
+		assert.Equal(data, string(f.Data), "frames aren't modified")
+	}
+
+	l.flush()
+	names := make([]string, 0, len(sink.series))
+	for name := range sink.series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	assert.Equal([]string{
+		"log-iss.l2met.d_1234.router.router.connect",
+		"log-iss.l2met.d_1234.router.router.error.H12",
+		"log-iss.l2met.d_1234.router.router.service",
+		"log-iss.l2met.d_1234.router.router.status.200",
+		"log-iss.l2met.d_1234.router.router.status.503",
+		"log-iss.l2met.d_1234.web_1.db.query",
+		"log-iss.l2met.d_1234.web_1.jobs",
+		"log-iss.l2met.d_1234.web_2.memory_total",
+	}, names)
+
+	assert.Equal(3.0, sink.series["log-iss.l2met.d_1234.web_1.jobs"].count)
+	assert.Equal([]float64{12.5, 7.5}, sink.series["log-iss.l2met.d_1234.web_1.db.query"].values)
+	assert.Equal(22.5, sink.series["log-iss.l2met.d_1234.web_2.memory_total"].last)
+	assert.Equal([]float64{25, 30000}, sink.series["log-iss.l2met.d_1234.router.router.service"].values)
+
+	assert.True(l.Process(&batch{}, l2metFrame("app", "web.1", "count#jobs=1 count#more=1")))
+	assert.Equal(2, len(l.series), "series are reset by flush")
+	assert.Equal(int64(0), l.dropped.Count())
+
+	l.flush()
+	sink.series = nil
+	l.flush()
+	assert.Nil(sink.series, "empty intervals aren't flushed")
+}
+
+func TestL2metMaxSeries(t *testing.T) {
+	config := *getConfig()
+	config.L2metMaxSeries = 1
+	l, err := newL2met(config)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	l.Process(&batch{}, l2metFrame("app", "web.1", "count#a=1 count#b=1 sample#a=1"))
+	assert.Equal(t, 1, len(l.series))
+	assert.Equal(t, int64(2), l.dropped.Count(), "a new series and a kind mismatch")
+}
+
+func TestL2metRegistrySink(t *testing.T) {
+	assert := assert.New(t)
+	registry := metrics.NewRegistry()
+	sink := newL2metRegistrySink(registry, 0, time.Hour, metrics.NewCounter())
+
+	sink.Flush(map[string]*l2metSeries{
+		"log-iss.l2met.h.s.jobs":   {kind: l2metCount, count: 3},
+		"log-iss.l2met.h.s.memory": {kind: l2metSample, last: 21.5},
+		"log-iss.l2met.h.s.query":  {kind: l2metMeasure, values: []float64{4, 1, 3, 2}},
+	})
+	sink.Flush(map[string]*l2metSeries{"log-iss.l2met.h.s.jobs": {kind: l2metCount, count: 2}})
+
+	assert.Equal(int64(5), registry.Get("log-iss.l2met.h.s.jobs").(metrics.Counter).Count())
+	assert.Equal(21.5, registry.Get("log-iss.l2met.h.s.memory").(metrics.GaugeFloat64).Value())
+	assert.Equal(1.0, registry.Get("log-iss.l2met.h.s.query.min").(metrics.GaugeFloat64).Value())
+	assert.Equal(4.0, registry.Get("log-iss.l2met.h.s.query.max").(metrics.GaugeFloat64).Value())
+	assert.Equal(2.5, registry.Get("log-iss.l2met.h.s.query.mean").(metrics.GaugeFloat64).Value())
+
+	name, labels := prometheusName("log-iss.l2met.h.s.query.perc95")
+	assert.Equal("log_iss_l2met_query_perc95", name)
+	assert.Equal(map[string]string{"host": "h", "source": "s"}, labels)
+}
+
+func TestL2metRegistrySinkBoundsSeries(t *testing.T) {
+	assert := assert.New(t)
+	registry := metrics.NewRegistry()
+	dropped := metrics.NewCounter()
+	now := time.Unix(1000, 0)
+	sink := newL2metRegistrySink(registry, 2, time.Minute, dropped)
+	sink.now = func() time.Time { return now }
+
+	sink.Flush(map[string]*l2metSeries{
+		"log-iss.l2met.h.s.jobs":  {kind: l2metCount, count: 3},
+		"log-iss.l2met.h.s.query": {kind: l2metMeasure, values: []float64{1}},
+	})
+	sink.Flush(map[string]*l2metSeries{
+		"log-iss.l2met.h.s.memory": {kind: l2metSample, last: 21.5},
+		"log-iss.l2met.h.s.jobs":   {kind: l2metSample, last: 1},
+	})
+	assert.Nil(registry.Get("log-iss.l2met.h.s.memory"), "no more than maxSeries are registered")
+	assert.Equal(int64(2), dropped.Count(), "a new series and a kind mismatch")
+
+	now = now.Add(30 * time.Second)
+	sink.Flush(map[string]*l2metSeries{"log-iss.l2met.h.s.jobs": {kind: l2metCount, count: 2}})
+	now = now.Add(45 * time.Second)
+	sink.Flush(map[string]*l2metSeries{"log-iss.l2met.h.s.memory": {kind: l2metSample, last: 21.5}})
+
+	assert.Nil(registry.Get("log-iss.l2met.h.s.query.min"), "idle series are unregistered")
+	assert.Equal(int64(5), registry.Get("log-iss.l2met.h.s.jobs").(metrics.Counter).Count())
+	assert.Equal(21.5, registry.Get("log-iss.l2met.h.s.memory").(metrics.GaugeFloat64).Value())
+	assert.Equal(2, len(sink.registered))
+}
+
+func TestL2metStatsdSink(t *testing.T) {
+	assert := assert.New(t)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(err) {
+		return
+	}
+	defer pc.Close()
+
+	config := *getConfig()
+	config.L2metSink = l2metSinkStatsd
+	config.L2metStatsdAddr = pc.LocalAddr().String()
+	l, err := newL2met(config)
+	if !assert.NoError(err) {
+		return
+	}
+	defer l.Close()
+	l.Process(&batch{}, l2metFrame("app", "web.1", "count#jobs=2 measure#query=3ms measure#query=4ms"))
+	l.flush()
+
+	buf := make([]byte, maxStatsdPacket)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	assert.NoError(err)
+	lines := strings.Split(string(buf[:n]), "\n")
+	sort.Strings(lines)
+	assert.Equal([]string{
+		"l2met.d_1234.web_1.jobs:2|c",
+		"l2met.d_1234.web_1.query:3|ms",
+		"l2met.d_1234.web_1.query:4|ms",
+	}, lines)
+}
+
+func TestL2metClose(t *testing.T) {
+	assert := assert.New(t)
+	config := *getConfig()
+	config.Pipeline = []string{"l2met"}
+	p, err := newPipeline(config)
+	if !assert.NoError(err) {
+		return
+	}
+	l := p.stages[0].processor.(*l2met)
+	sink := &recordingL2metSink{}
+	l.sink = sink
+
+	l.Process(&batch{}, l2metFrame("app", "web.1", "count#jobs=1"))
+	assert.NoError(p.Close())
+	assert.Len(sink.series, 1, "the last interval is flushed")
+
+	select {
+	case <-l.done:
+	default:
+		assert.Fail("flushing wasn't stopped")
+	}
+}
+
+func TestNewL2metErrors(t *testing.T) {
+	config := *getConfig()
+	config.L2metSink = "carbon"
+	_, err := newL2met(config)
+	assert.EqualError(t, err, "L2MET_SINK must be one of registry or statsd")
+
+	config.L2metSink = l2metSinkStatsd
+	_, err = newL2met(config)
+	assert.EqualError(t, err, "L2MET_STATSD_ADDR is required when L2MET_SINK is statsd")
+}
+
+func TestParseL2metValue(t *testing.T) {
+	tests := map[string]struct {
+		value float64
+		ok    bool
+	}{
+		"12":      {12, true},
+		"12.5ms":  {12.5, true},
+		"21.00MB": {21, true},
+		"-3":      {-3, true},
+		"ms":      {0, false},
+		"":        {0, false},
+	}
+	for in, test := range tests {
+		v, ok := parseL2metValue([]byte(in))
+		assert.Equal(t, test.ok, ok, in)
+		assert.Equal(t, test.value, v, in)
+	}
+}
+
+func TestMeasureStats(t *testing.T) {
+	values := make([]float64, 100)
+	for i := range values {
+		values[i] = float64(100 - i)
+	}
+	assert.Equal(t, []float64{1, 100, 50.5, 50, 95, 99}, measureStats(values))
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/bmizerany/lpx"
+)
+
+const (
+	// Most malformed frames described in a fixResult. All of them are counted.
+	maxMalformedFrames = 100
+
+	// Size of the window fixLenient parses bodies through, large enough for
+	// the longest frame accepted and its length.
+	lenientWindowSize = maxFrameLength + readerBufferSize
+
+	// Bytes at the end of the window searched again once it has moved on,
+	// longer than any frameStart match for a frame of acceptable length.
+	lenientWindowOverlap = 64
+
+	// Response header giving the number of malformed frames in a request.
+	malformedFramesHeader = "Log-Iss-Malformed-Frames"
+)
+
+// Where a frame could start: a length, PRI and VERSION following something
+// other than a digit, so the tail of a longer length doesn't match.
+var frameStart = regexp.MustCompile(`[^0-9]([1-9][0-9]* <[0-9]{1,3}>[0-9]{1,2} )`)
+
+// malformedFrame describes a frame skipped by fixLenient.
+type malformedFrame struct {
+	Offset int64  `json:"offset"` // in the decoded request body
+	Length int64  `json:"length"` // bytes skipped
+	Error  string `json:"error"`
+}
+
+// malformedReport is the response body describing a partially accepted request.
+type malformedReport struct {
+	Accepted  int64            `json:"accepted"`
+	Malformed int64            `json:"malformed"`
+	Frames    []malformedFrame `json:"frames"`
+}
+
+// fixLenient writes the frames of an application/logplex-1 body into fw,
+// skipping any malformed frames. After a malformed frame, parsing resumes at
+// the next place a frame appears to start. The body is parsed through a window
+// of lenientWindowSize bytes, so it's never held in memory all at once.
+func fixLenient(fw *frameWriter, r io.Reader) error {
+	br := getLenientReader(r)
+	defer putLenientReader(br)
+
+	var off int64            // offset in the body of br's next byte
+	var junk *malformedFrame // being skipped until the next frame start
+	var refill bool          // whether the window must be filled first
+	for {
+		// Filling the window moves what's buffered to the start of it, so
+		// only do so when it's running low or a frame doesn't fit.
+		var window []byte
+		var err error
+		if refill || br.Buffered() < readerBufferSize {
+			window, err = br.Peek(lenientWindowSize)
+		} else {
+			window, err = br.Peek(br.Buffered())
+		}
+		refill = false
+		if err != nil && err != io.EOF {
+			return err
+		}
+		last := err == io.EOF // the window holds the rest of the body
+
+		if junk == nil {
+			n := 0
+			for n < len(window) && isSpace(window[n]) {
+				n++
+			}
+			if n == len(window) && last {
+				return nil
+			}
+			if n > 0 {
+				br.Discard(n)
+				off += int64(n)
+				continue
+			}
+
+			l, header, rest, err := parseLenientFrame(window)
+			if (err != nil || l == len(window)) && !last && len(window) < lenientWindowSize {
+				// Look further before deciding where the frame ends.
+				refill = true
+				continue
+			}
+			if err == nil {
+				if err := fw.write(header, rest); err != nil {
+					return err
+				}
+				br.Discard(l)
+				off += int64(l)
+				continue
+			}
+			junk = &malformedFrame{Offset: off, Error: err.Error()}
+		}
+
+		// Keep the end of the window unless the body ends there, in case a
+		// frame starts in it but continues past it.
+		skip := len(window)
+		loc := frameStart.FindSubmatchIndex(window)
+		if loc != nil {
+			skip = loc[2]
+		} else if !last {
+			skip -= lenientWindowOverlap
+		}
+		br.Discard(skip)
+		off += int64(skip)
+		junk.Length += int64(skip)
+		if loc != nil || last {
+			fw.malformed(*junk)
+			junk = nil
+		}
+	}
+}
+
+// Parse the octet-counted frame at the start of b, returning its length. The
+// frame must be followed by the end of b, whitespace or something that looks
+// like another frame's length, so a wrong length isn't silently accepted. A
+// consequence is that a frame followed directly by junk is malformed too.
+func parseLenientFrame(b []byte) (int, *lpx.Header, []byte, error) {
+	sp := bytes.IndexByte(b, ' ')
+	if sp <= 0 {
+		return 0, nil, nil, fmt.Errorf("Missing frame length")
+	}
+	l, err := strconv.Atoi(string(b[:sp]))
+	if err != nil || l <= 0 {
+		return 0, nil, nil, fmt.Errorf("Invalid frame length %.32q", b[:sp])
+	}
+	if l > maxFrameLength {
+		return 0, nil, nil, fmt.Errorf("Frame length %d exceeds the maximum of %d", l, maxFrameLength)
+	}
+	end := sp + 1 + l
+	if end > len(b) {
+		return 0, nil, nil, fmt.Errorf("Frame length %d exceeds the %d bytes remaining", l, len(b)-sp-1)
+	}
+	if end < len(b) && !isSpace(b[end]) && (b[end] < '1' || b[end] > '9') {
+		return 0, nil, nil, fmt.Errorf("Frame length %d doesn't end at a frame boundary", l)
+	}
+
+	msg := b[sp+1 : end]
+	h, rest, ok := splitSyslogHeader(msg)
+	if !ok || parsePriority(h) < 0 {
+		return 0, nil, nil, errSyslogFrame
+	}
+	fields := bytes.Fields(h)
+	header := &lpx.Header{
+		PrivalVersion: fields[0],
+		Time:          fields[1],
+		Hostname:      fields[2],
+		Name:          fields[3],
+		Procid:        fields[4],
+		Msgid:         fields[5],
+	}
+	return end, header, rest, nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// Tell the client which frames of a partially accepted request were skipped.
+func writeMalformedReport(w http.ResponseWriter, r fixResult) {
+	w.Header().Set(malformedFramesHeader, strconv.FormatInt(r.malformed, 10))
+	w.Header().Set("Content-Type", jsonContentType)
+	json.NewEncoder(w).Encode(malformedReport{
+		Accepted:  r.numLogs,
+		Malformed: r.malformed,
+		Frames:    r.malformedFrames,
+	})
+}
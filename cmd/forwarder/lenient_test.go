@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFixLenient(t *testing.T) {
+	assert := assert.New(t)
+	config := *getConfig()
+	config.LenientParsing = true
+	config.Pipeline = nil
+	p, err := newPipeline(config)
+	if !assert.NoError(err) {
+		return
+	}
+
+	var good bytes.Buffer
+	writeSyslogFrame(&good, []byte("<13>1 2013-06-07T13:17:49.468822+00:00 host app web.1 - - hello"))
+	garbage := "this isn't a frame\n"
+	wrongLength := "60 <13>1 2013-06-07T13:17:49.468822+00:00 host app web.1 - - too long"
+	badHeader := "7 <13>1 -"
+
+	body := good.String() + "\n" + garbage + good.String() + wrongLength + "\n" + good.String() + badHeader + "\n"
+	r, err := p.Fix(simpleHttpRequest(), bytes.NewBufferString(body), "", "", "", nil, &config, nil)
+	assert.NoError(err)
+	assert.Equal(int64(3), r.numLogs)
+	assert.Equal(int64(3), r.numForwarded)
+	assert.Equal(good.String()+good.String()+good.String(), string(r.bytes))
+
+	off := int64(good.Len() + 1)
+	assert.Equal(int64(3), r.malformed)
+	assert.Equal([]malformedFrame{
+		{Offset: off, Length: int64(len(garbage)), Error: `Invalid frame length "this"`},
+		{Offset: 2*off - 1 + int64(len(garbage)), Length: int64(len(wrongLength) + 1), Error: "Frame length 60 doesn't end at a frame boundary"},
+		{Offset: 3*off - 1 + int64(len(garbage)+len(wrongLength)), Length: int64(len(badHeader) + 1), Error: "Malformed syslog frame"},
+	}, r.malformedFrames)
+}
+
+func TestFixLenientLargeBody(t *testing.T) {
+	assert := assert.New(t)
+	config := *getConfig()
+	config.LenientParsing = true
+	config.Pipeline = nil
+	p, err := newPipeline(config)
+	if !assert.NoError(err) {
+		return
+	}
+
+	var good bytes.Buffer
+	for good.Len() < lenientWindowSize {
+		writeSyslogFrame(&good, []byte("<13>1 2013-06-07T13:17:49.468822+00:00 host app web.1 - - hello"))
+	}
+	garbage := strings.Repeat("x", 2*lenientWindowSize+lenientWindowOverlap/2)
+
+	body := good.String() + "\n" + garbage + good.String()
+	r, err := p.Fix(simpleHttpRequest(), bytes.NewBufferString(body), "", "", "", nil, &config, nil)
+	assert.NoError(err)
+	assert.Equal(good.String()+good.String(), string(r.bytes), "frames across the window's edges are accepted")
+	assert.Equal([]malformedFrame{
+		{Offset: int64(good.Len() + 1), Length: int64(len(garbage)), Error: "Missing frame length"},
+	}, r.malformedFrames, "garbage longer than the window is one malformed frame")
+}
+
+func TestFixStrictRejectsMalformedFrames(t *testing.T) {
+	config := getConfig()
+	_, err := fix(simpleHttpRequest(), bytes.NewBufferString("this isn't a frame\n"), "", "", "", nil, config)
+	assert.Error(t, err)
+}
+
+func TestParseLenientFrame(t *testing.T) {
+	tests := map[string]struct {
+		in  string
+		n   int
+		err string
+	}{
+		"valid":          {in: "17 <13>1 - - - - - x 17 ", n: 20},
+		"valid at end":   {in: "17 <13>1 - - - - - x", n: 20},
+		"missing length": {in: "<13>1 - - - - - x", err: `Invalid frame length "<13>1"`},
+		"zero length":    {in: "0 <13>1", err: `Invalid frame length "0"`},
+		"too long":       {in: "30 <13>1 - - - - - x", err: "Frame length 30 exceeds the 17 bytes remaining"},
+		"too short":      {in: "12 <13>1 - - - - - x", err: "Frame length 12 doesn't end at a frame boundary"},
+		"over maximum":   {in: "1048577 <13>1 - - - - - x", err: "Frame length 1048577 exceeds the maximum of 1048576"},
+		"bad priority":   {in: "20 <99999>1 - - - - - x", err: "Malformed syslog frame"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			n, _, _, err := parseLenientFrame([]byte(test.in))
+			if test.err != "" {
+				assert.EqualError(t, err, test.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.n, n)
+		})
+	}
+}
+
+func TestWriteMalformedReport(t *testing.T) {
+	assert := assert.New(t)
+	rec := httptest.NewRecorder()
+	writeMalformedReport(rec, fixResult{
+		numLogs:         2,
+		malformed:       1,
+		malformedFrames: []malformedFrame{{Offset: 10, Length: 5, Error: "Missing frame length"}},
+	})
+
+	assert.Equal("1", rec.Header().Get(malformedFramesHeader))
+	assert.Equal(jsonContentType, rec.Header().Get("Content-Type"))
+	var report malformedReport
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.Equal(malformedReport{
+		Accepted:  2,
+		Malformed: 1,
+		Frames:    []malformedFrame{{Offset: 10, Length: 5, Error: "Missing frame length"}},
+	}, report)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Delivery latency samples older than this no longer count as recent, so an
+// instance shedding all of its traffic eventually admits some again to find
+// out whether its destinations have recovered.
+const latencyStaleAfter = 10 * time.Second
+
+// overloadedError is returned when a payload is shed rather than queued
+// behind a backlog it would likely time out waiting on.
+type overloadedError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *overloadedError) Error() string {
+	return "Overloaded: " + e.Reason
+}
+
+// saturationChecker is implemented by deliverers that can tell when they're
+// too backed up to accept more payloads.
+type saturationChecker interface {
+	saturated() error
+}
+
+// Value for a Retry-After header, in whole seconds.
+func retryAfterHeader(d time.Duration) string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(d.Seconds()))))
+}
+
+// latencyTracker keeps an exponentially weighted moving average of delivery
+// latency.
+type latencyTracker struct {
+	mu      sync.Mutex
+	average time.Duration
+	updated time.Time
+}
+
+func (l *latencyTracker) Update(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.updated.IsZero() {
+		l.average = d
+	} else {
+		l.average += (d - l.average) / 8
+	}
+	l.updated = time.Now()
+}
+
+// Recent returns the average latency, or zero if there haven't been any
+// deliveries lately.
+func (l *latencyTracker) Recent() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.updated) > latencyStaleAfter {
+		return 0
+	}
+	return l.average
+}
+
+// Check the inbox fill level and recent latency against the configured
+// thresholds.
+func checkSaturation(config IssConfig, queued, capacity int, latency time.Duration) error {
+	if config.LoadShedInboxFill > 0 && capacity > 0 {
+		if fill := float64(queued) / float64(capacity); fill >= config.LoadShedInboxFill {
+			return &overloadedError{Reason: fmt.Sprintf("forwarder queue %.0f%% full", fill*100), RetryAfter: config.LoadShedRetryAfter}
+		}
+	}
+	if config.LoadShedLatency > 0 && latency >= config.LoadShedLatency {
+		return &overloadedError{Reason: fmt.Sprintf("delivery latency %s", latency), RetryAfter: config.LoadShedRetryAfter}
+	}
+	return nil
+}
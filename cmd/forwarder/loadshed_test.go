@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSaturation(t *testing.T) {
+	config := *getConfig()
+	config.LoadShedInboxFill = 0.8
+	config.LoadShedLatency = 2 * time.Second
+
+	tests := map[string]struct {
+		queued     int
+		latency    time.Duration
+		overloaded bool
+	}{
+		"idle":           {queued: 0, latency: 0},
+		"busy":           {queued: 799, latency: 1999 * time.Millisecond},
+		"inbox too full": {queued: 800, latency: 0, overloaded: true},
+		"too slow":       {queued: 0, latency: 2 * time.Second, overloaded: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := checkSaturation(config, test.queued, 1000, test.latency)
+			if !test.overloaded {
+				assert.NoError(t, err)
+				return
+			}
+			if assert.IsType(t, &overloadedError{}, err) {
+				assert.Equal(t, config.LoadShedRetryAfter, err.(*overloadedError).RetryAfter)
+			}
+		})
+	}
+
+	config.LoadShedInboxFill = 0
+	config.LoadShedLatency = 0
+	assert.NoError(t, checkSaturation(config, 1000, 1000, time.Hour), "zero thresholds disable shedding")
+}
+
+func TestForwarderSetShedsWhenSaturated(t *testing.T) {
+	assert := assert.New(t)
+	config := *getConfig()
+	config.LoadShedInboxFill = 0.5
+	fs, err := newForwarderSet("", config, config.ForwardDest, config.ForwardDestPolicy, nil)
+	assert.NoError(err)
+
+	for i := 0; i < cap(fs.Inbox)/2; i++ {
+		fs.Inbox <- NewPayload("", "", nil)
+	}
+
+	start := time.Now()
+	err = fs.Deliver(NewPayload("", "", []byte("hello\n")))
+	assert.IsType(&overloadedError{}, err)
+	assert.True(time.Since(start) < time.Second, "shedding should be immediate")
+	assert.Equal(int64(1), fs.shed.Count())
+	assert.Equal(cap(fs.Inbox)/2, len(fs.Inbox))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	p := NewPayload("", "", []byte("hello\n"))
+	p.Context = ctx
+	p.Admitted = true
+	err = fs.Deliver(p)
+	_, shed := err.(*overloadedError)
+	assert.False(shed, "payloads of admitted requests aren't shed")
+	assert.Equal(int64(1), fs.shed.Count())
+	assert.Equal(cap(fs.Inbox)/2+1, len(fs.Inbox))
+}
+
+func TestLatencyTracker(t *testing.T) {
+	assert := assert.New(t)
+	var l latencyTracker
+	assert.Equal(time.Duration(0), l.Recent())
+
+	l.Update(8 * time.Second)
+	assert.Equal(8*time.Second, l.Recent())
+	l.Update(0)
+	assert.Equal(7*time.Second, l.Recent())
+
+	l.updated = time.Now().Add(-2 * latencyStaleAfter)
+	assert.Equal(time.Duration(0), l.Recent(), "old samples aren't recent")
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	assert.Equal(t, "1", retryAfterHeader(100*time.Millisecond))
+	assert.Equal(t, "3", retryAfterHeader(2100*time.Millisecond))
+}
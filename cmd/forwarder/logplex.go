@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/bmizerany/lpx"
+	metrics "github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Longest frame fixLenient can parse, as each frame must fit in its window.
+	maxFrameLength = 1 << 20
+
+	// Headers logplex sends with each request to a drain.
+	logplexMsgCountHeader = "Logplex-Msg-Count"
+	logplexFrameIDHeader  = "Logplex-Frame-Id"
+)
+
+// Logplex reports logs it had to drop with L-series errors in the stream, such
+// as "Error L10 (output buffer overflow): 42 messages dropped since
+// 2013-06-07T13:15:00+00:00."
+var (
+	logplexErrorPattern   = regexp.MustCompile(`^Error (L[0-9]+) \(([^)]*)\)`)
+	logplexDroppedPattern = regexp.MustCompile(`([0-9]+) messages? dropped|dropped ([0-9]+) messages?`)
+)
+
+// logplexError counts the L-series errors with one code in a request.
+type logplexError struct {
+	Code        string
+	Description string
+	Count       int64 // errors with the code
+	Dropped     int64 // messages they report dropping
+}
+
+// logplexReader reads the octet-counted frames of an application/logplex-1
+// body. Unlike lpx.Reader it doesn't allocate for each frame: the header and
+// message it returns refer to its buffers, and are only valid until the next
+// call to Next.
+type logplexReader struct {
+	r        *bufio.Reader
+	buf      []byte // holds frames too large for r's buffer
+	maxFrame int    // longest frame accepted, if positive
+	header   lpx.Header
+	data     []byte
+	err      error
+}
+
+// newLogplexReader returns a reader for the frames in r which rejects any
+// longer than maxFrame bytes. A maxFrame of 0 accepts frames of any length.
+func newLogplexReader(r io.Reader, maxFrame int) *logplexReader {
+	return &logplexReader{r: getReader(r), maxFrame: maxFrame}
+}
+
+// Next advances to the next frame, returning false at the end of the body or
+// if there's an error.
+func (lr *logplexReader) Next() bool {
+	if lr.err != nil {
+		return false
+	}
+
+	l, err := lr.r.ReadSlice(' ')
+	if err != nil {
+		// As with lpx.Reader, anything after the last frame that doesn't look
+		// like the start of another is ignored.
+		if err == bufio.ErrBufferFull {
+			err = fmt.Errorf("Invalid frame length %.32q", l)
+		}
+		lr.err = err
+		return false
+	}
+	l = l[:len(l)-1]
+	n, ok := parseFrameLength(l)
+	if !ok {
+		lr.err = fmt.Errorf("Invalid frame length %q", l)
+		return false
+	}
+	if lr.maxFrame > 0 && n > lr.maxFrame {
+		lr.err = fmt.Errorf("Frame length %d exceeds the maximum of %d", n, lr.maxFrame)
+		return false
+	}
+
+	msg, err := lr.read(n)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		lr.err = err
+		return false
+	}
+	if lr.data, ok = parseHeader(msg, &lr.header); !ok {
+		if lr.err = lr.readLongHeader(msg); lr.err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Like lpx.Reader, read a header which continues past the end of the frame.
+// Some clients don't count the space following the MSGID of a frame with
+// neither STRUCTURED-DATA nor MSG.
+func (lr *logplexReader) readLongHeader(msg []byte) error {
+	lr.buf = append(lr.buf[:0], msg...)
+	for bytes.Count(lr.buf, []byte(" ")) < 6 {
+		field, err := lr.r.ReadSlice(' ')
+		if err != nil {
+			if err == io.EOF || err == bufio.ErrBufferFull {
+				err = errSyslogFrame
+			}
+			return err
+		}
+		lr.buf = append(lr.buf, field...)
+	}
+	lr.data, _ = parseHeader(lr.buf, &lr.header)
+	return nil
+}
+
+// Read the next n bytes, without copying them if they fit in r's buffer.
+func (lr *logplexReader) read(n int) ([]byte, error) {
+	if n <= lr.r.Size() {
+		b, err := lr.r.Peek(n)
+		if err != nil {
+			return nil, err
+		}
+		// Discarding bytes which have already been peeked doesn't refill the
+		// buffer, so b remains valid until the next call to Next.
+		lr.r.Discard(n)
+		return b, nil
+	}
+
+	// The body may end long before n bytes, so the buffer is grown as they
+	// arrive rather than allocated up front.
+	buf := bytes.NewBuffer(lr.buf[:0])
+	m, err := buf.ReadFrom(io.LimitReader(lr.r, int64(n)))
+	lr.buf = buf.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if m < int64(n) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return lr.buf, nil
+}
+
+// Header returns the current frame's header.
+func (lr *logplexReader) Header() *lpx.Header {
+	return &lr.header
+}
+
+// Bytes returns the rest of the current frame, its STRUCTURED-DATA and MSG.
+func (lr *logplexReader) Bytes() []byte {
+	return lr.data
+}
+
+// Err returns the first error encountered, other than the end of the body.
+func (lr *logplexReader) Err() error {
+	if lr.err == io.EOF {
+		return nil
+	}
+	return lr.err
+}
+
+// Close releases lr's buffer. Nothing lr returned may be used afterwards.
+func (lr *logplexReader) Close() {
+	putReader(lr.r)
+	lr.r = nil
+}
+
+// Parse a frame length, a positive decimal integer, without allocating.
+func parseFrameLength(b []byte) (int, bool) {
+	if len(b) == 0 || len(b) > 9 || b[0] == '0' {
+		return 0, false
+	}
+	n := 0
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, true
+}
+
+// Split the header fields, PRI and VERSION through MSGID, each followed by a
+// space, from the start of msg into h. Returns the rest of msg.
+func parseHeader(msg []byte, h *lpx.Header) ([]byte, bool) {
+	for _, field := range [...]*[]byte{&h.PrivalVersion, &h.Time, &h.Hostname, &h.Name, &h.Procid, &h.Msgid} {
+		i := bytes.IndexByte(msg, ' ')
+		if i < 0 {
+			return nil, false
+		}
+		*field = msg[:i]
+		msg = msg[i+1:]
+	}
+	return msg, true
+}
+
+// Parse the L-series error in a frame, if it's one. Logplex's own messages come
+// from the heroku app's logplex process.
+func parseLogplexError(header *lpx.Header, data []byte) (logplexError, bool) {
+	if string(header.Name) != "heroku" || string(header.Procid) != "logplex" {
+		return logplexError{}, false
+	}
+	_, _, msg := splitStructuredData(data)
+	m := logplexErrorPattern.FindSubmatch(msg)
+	if m == nil {
+		return logplexError{}, false
+	}
+
+	e := logplexError{Code: string(m[1]), Description: string(m[2]), Count: 1}
+	if d := logplexDroppedPattern.FindSubmatch(msg[len(m[0]):]); d != nil {
+		e.Dropped, _ = strconv.ParseInt(string(d[1])+string(d[2]), 10, 64)
+	}
+	return e, true
+}
+
+// Add e to the errors in r, combining it with any others with its code.
+func (r *fixResult) addLogplexError(e logplexError) {
+	for i := range r.logplexErrors {
+		if r.logplexErrors[i].Code == e.Code {
+			r.logplexErrors[i].Count += e.Count
+			r.logplexErrors[i].Dropped += e.Dropped
+			return
+		}
+	}
+	r.logplexErrors = append(r.logplexErrors, e)
+}
+
+// Account for the logs a drain lost before reaching us: frames missing from
+// the request compared with its Logplex-Msg-Count header, and messages logplex
+// reported dropping with L-series errors.
+func (s *httpServer) accountLogplexLoss(req *http.Request, r fixResult, token, requestID string) {
+	me := "log-iss.logplex." + metricSegment(token)
+	fields := log.Fields{
+		"ns":             "logplex",
+		"logdrain_token": token,
+		"requestId":      requestID,
+		"frame_id":       req.Header.Get(logplexFrameIDHeader),
+	}
+
+	if v := req.Header.Get(logplexMsgCountHeader); v != "" {
+		expected, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || expected < 0 {
+			log.WithFields(fields).WithField("at", "msg_count").Warnf("Invalid %s %q", logplexMsgCountHeader, v)
+		} else {
+			received := r.numLogs + r.malformed
+			metrics.GetOrRegisterCounter(me+".frames.expected", s.Config.MetricsRegistry).Inc(expected)
+			if expected > received {
+				metrics.GetOrRegisterCounter(me+".frames.missing", s.Config.MetricsRegistry).Inc(expected - received)
+			}
+			if expected != received {
+				log.WithFields(fields).WithFields(log.Fields{"at": "msg_count", "expected": expected, "received": received}).
+					Warnf("Frame count doesn't match %s", logplexMsgCountHeader)
+			}
+		}
+	}
+
+	for _, e := range r.logplexErrors {
+		metrics.GetOrRegisterCounter(me+".errors."+e.Code, s.Config.MetricsRegistry).Inc(e.Count)
+		metrics.GetOrRegisterCounter(me+".dropped", s.Config.MetricsRegistry).Inc(e.Dropped)
+		log.WithFields(fields).WithFields(log.Fields{"at": "error", "code": e.Code, "description": e.Description, "count": e.Count, "dropped": e.Dropped}).
+			Warn("Logplex reported dropping logs")
+	}
+}
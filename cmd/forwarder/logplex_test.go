@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/lpx"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogplexReader(t *testing.T) {
+	assert := assert.New(t)
+	large := "<13>1 - host app web.1 - - " + strings.Repeat("x", readerBufferSize)
+	var in bytes.Buffer
+	writeSyslogFrame(&in, []byte("<13>1 2013-06-07T13:17:49.468822+00:00 host app web.1 - - hi"))
+	writeSyslogFrame(&in, []byte(large))
+	writeSyslogFrame(&in, []byte("<13>1 - host app web.2 - [a b=\"c\"]"))
+
+	lr := newLogplexReader(&in, 0)
+	defer lr.Close()
+
+	assert.True(lr.Next())
+	assert.Equal("2013-06-07T13:17:49.468822+00:00", string(lr.Header().Time))
+	assert.Equal("- hi", string(lr.Bytes()))
+
+	assert.True(lr.Next(), "frames larger than the reader's buffer")
+	assert.Equal(strings.Repeat("x", readerBufferSize), string(bytes.TrimPrefix(lr.Bytes(), []byte("- "))))
+
+	assert.True(lr.Next())
+	assert.Equal("web.2", string(lr.Header().Procid))
+	assert.Equal(`[a b="c"]`, string(lr.Bytes()))
+
+	assert.False(lr.Next())
+	assert.NoError(lr.Err())
+}
+
+func TestLogplexReaderLongHeader(t *testing.T) {
+	assert := assert.New(t)
+	lr := newLogplexReader(strings.NewReader("58 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - 17 <13>1 - - - - - x"), 0)
+	defer lr.Close()
+
+	assert.True(lr.Next())
+	assert.Equal("-", string(lr.Header().Msgid))
+	assert.Empty(lr.Bytes())
+	assert.True(lr.Next())
+	assert.Equal("x", string(lr.Bytes()))
+	assert.False(lr.Next())
+	assert.NoError(lr.Err())
+}
+
+func TestLogplexReaderErrors(t *testing.T) {
+	tests := map[string]string{
+		"-1 <13>1 - - - - - x":    `Invalid frame length "-1"`,
+		"012 <13>1 - - - - - x":   `Invalid frame length "012"`,
+		"2000000 <13>1 - - - - -": "Frame length 2000000 exceeds the maximum of 1048576",
+		"20 <13>1 - - - - - x":    "unexpected EOF",
+		"5 <13>1 - -":             "Malformed syslog frame",
+	}
+
+	for in, expected := range tests {
+		t.Run(in, func(t *testing.T) {
+			lr := newLogplexReader(strings.NewReader(in), 1<<20)
+			defer lr.Close()
+			assert.False(t, lr.Next())
+			assert.EqualError(t, lr.Err(), expected)
+		})
+	}
+}
+
+func TestLogplexReaderUnlimited(t *testing.T) {
+	assert := assert.New(t)
+	msg := "<13>1 - - - - - " + strings.Repeat("x", 2<<20)
+	lr := newLogplexReader(strings.NewReader(strconv.Itoa(len(msg))+" "+msg), 0)
+	defer lr.Close()
+	assert.True(lr.Next())
+	assert.Equal(2<<20, len(lr.Bytes()))
+	assert.False(lr.Next())
+	assert.NoError(lr.Err())
+
+	lr = newLogplexReader(strings.NewReader("999999999 <13>1 - - - - - x"), 0)
+	defer lr.Close()
+	assert.False(lr.Next())
+	assert.EqualError(lr.Err(), "unexpected EOF")
+	assert.True(cap(lr.buf) < 1<<20, "the claimed length isn't allocated up front")
+}
+
+func TestLogplexReaderAllocs(t *testing.T) {
+	body := bytes.Repeat([]byte("67 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hello\n"), 100)
+	r := bytes.NewReader(body)
+	allocs := testing.AllocsPerRun(10, func() {
+		r.Reset(body)
+		lr := newLogplexReader(r, 0)
+		for lr.Next() {
+		}
+		lr.Close()
+	})
+	assert.True(t, allocs <= 1, "%v allocations for 100 frames", allocs)
+}
+
+func TestParseLogplexError(t *testing.T) {
+	tests := map[string]struct {
+		app, procid, data string
+		ok                bool
+		e                 logplexError
+	}{
+		"L10": {
+			app: "heroku", procid: "logplex", ok: true,
+			data: "- Error L10 (output buffer overflow): 42 messages dropped since 2013-06-07T13:15:00+00:00.",
+			e:    logplexError{Code: "L10", Description: "output buffer overflow", Count: 1, Dropped: 42},
+		},
+		"L11": {
+			app: "heroku", procid: "logplex", ok: true,
+			data: "- Error L11 (Tail buffer overflow) -- This tail session dropped 7 messages since 2013-06-07T13:15:00+00:00.",
+			e:    logplexError{Code: "L11", Description: "Tail buffer overflow", Count: 1, Dropped: 7},
+		},
+		"with structured data": {
+			app: "heroku", procid: "logplex", ok: true,
+			data: `[meta a="b"] Error L12 (Local buffer overflow): 1 message dropped`,
+			e:    logplexError{Code: "L12", Description: "Local buffer overflow", Count: 1, Dropped: 1},
+		},
+		"without a count": {
+			app: "heroku", procid: "logplex", ok: true,
+			data: "- Error L13 (Local delivery error)",
+			e:    logplexError{Code: "L13", Description: "Local delivery error", Count: 1},
+		},
+		"other logplex message": {app: "heroku", procid: "logplex", data: "- Drain connected"},
+		"from an app":           {app: "app", procid: "web.1", data: "- Error L10 (output buffer overflow): 42 messages dropped"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			e, ok := parseLogplexError(&lpx.Header{Name: []byte(test.app), Procid: []byte(test.procid)}, []byte(test.data))
+			assert.Equal(t, test.ok, ok)
+			assert.Equal(t, test.e, e)
+		})
+	}
+}
+
+func TestAccountLogplexLoss(t *testing.T) {
+	assert := assert.New(t)
+	config := *getConfig()
+	config.MetricsRegistry = metrics.NewRegistry()
+	s := newTestHTTPServer(t, config, &recordingDeliverer{})
+
+	var body bytes.Buffer
+	writeSyslogFrame(&body, []byte("<172>1 2013-06-07T13:17:49+00:00 host heroku logplex - Error L10 (output buffer overflow): 20 messages dropped since 2013-06-07T13:15:00+00:00."))
+	writeSyslogFrame(&body, []byte("<13>1 2013-06-07T13:17:49+00:00 host app web.1 - - hi"))
+	writeSyslogFrame(&body, []byte("<172>1 2013-06-07T13:17:50+00:00 host heroku logplex - Error L10 (output buffer overflow): 10 messages dropped since 2013-06-07T13:17:49+00:00."))
+
+	req := simpleHttpRequest()
+	req.Header.Set(logplexMsgCountHeader, "5")
+	req.Header.Set(logplexFrameIDHeader, "frame-1")
+	r, err, _ := s.process(req, &body, "", "", "d.1234", "", nil)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal([]logplexError{{Code: "L10", Description: "output buffer overflow", Count: 2, Dropped: 30}}, r.logplexErrors)
+
+	s.accountLogplexLoss(req, r, "d.1234", "")
+	counter := func(name string) int64 {
+		if c, ok := config.MetricsRegistry.Get(name).(metrics.Counter); ok {
+			return c.Count()
+		}
+		return -1
+	}
+	assert.Equal(int64(5), counter("log-iss.logplex.d_1234.frames.expected"))
+	assert.Equal(int64(2), counter("log-iss.logplex.d_1234.frames.missing"))
+	assert.Equal(int64(2), counter("log-iss.logplex.d_1234.errors.L10"))
+	assert.Equal(int64(30), counter("log-iss.logplex.d_1234.dropped"))
+
+	name, labels := prometheusName("log-iss.logplex.d_1234.errors.L10")
+	assert.Equal("log_iss_logplex_errors", name)
+	assert.Equal(map[string]string{"token": "d_1234", "code": "L10"}, labels)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -15,7 +16,7 @@ import (
 type shutdownCh chan struct{}
 
 func awaitShutdownSignals(chs ...shutdownCh) {
-	sigCh := make(chan os.Signal)
+	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
 	for sig := range sigCh {
 		log.WithFields(log.Fields{"at": "shutdown-signal", "signal": sig}).Info()
@@ -45,14 +46,51 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	forwarderSet := newForwarderSet(config)
+	enc, err := newEncoder(config.ForwardFormat, config.ForwardFraming)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	forwarderSet, err := newForwarderSet("", config, config.ForwardDest, config.ForwardDestPolicy, enc)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	dedup, err := newDedupStore(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	router, err := newRouter(config, forwarderSet, dedup)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	pipeline, err := newPipeline(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	limiter, err := newRateLimiter(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
 
 	shutdownCh := make(shutdownCh)
-	httpServer := newHTTPServer(config, auth, fix, forwarderSet)
+	httpServer := newHTTPServer(config, auth, limiter, dedup, pipeline.Fix, router)
+
+	syslogServer, err := newSyslogServer(config, pipeline.Fix, router)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	go awaitShutdownSignals(httpServer.shutdownCh, syslogServer.shutdownCh, shutdownCh)
 
-	go awaitShutdownSignals(httpServer.shutdownCh, shutdownCh)
+	go router.Run()
 
-	go forwarderSet.Run()
+	if err := syslogServer.Run(); err != nil {
+		log.Fatalln("Unable to start syslog listeners:", err)
+	}
 
 	go func() {
 		if err := httpServer.Run(); err != nil {
@@ -73,9 +111,24 @@ func main() {
 		)
 	}
 
+	if config.AdminPort != "" {
+		log.WithField("port", config.AdminPort).Info("starting prometheus metrics endpoint")
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", newPrometheusHandler(config.MetricsRegistry))
+			if err := http.ListenAndServe(":"+config.AdminPort, mux); err != nil {
+				log.Fatalln("Unable to start admin server:", err)
+			}
+		}()
+	}
+
 	log.WithField("at", "start").Info()
 	<-shutdownCh
 	log.WithField("at", "drain").Info()
 	httpServer.Wait()
+	syslogServer.Wait()
+	if err := pipeline.Close(); err != nil {
+		log.WithFields(log.Fields{"at": "pipeline-close", "err": err}).Error()
+	}
 	log.WithField("at", "exit").Info()
 }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/bmizerany/lpx"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// processor is a step of the pipeline frames go through after being parsed
+// from a request and before being encoded for delivery.
+type processor interface {
+	// Process modifies f in place. It returns false if f should be dropped.
+	Process(b *batch, f *frame) bool
+}
+
+// processorFunc adapts a function to the processor interface.
+type processorFunc func(b *batch, f *frame) bool
+
+func (fn processorFunc) Process(b *batch, f *frame) bool {
+	return fn(b, f)
+}
+
+// processorFactories are the processors that can be named in
+// LOG_ISS_PIPELINE. Factories are called once, when the pipeline is built, and
+// should register any metrics of their own with config.MetricsRegistry.
+// Processors which hold resources, such as goroutines, should implement
+// io.Closer so they're released when the pipeline is closed.
+var processorFactories = map[string]func(config IssConfig) (processor, error){
+	"hostname": func(IssConfig) (processor, error) { return processorFunc(processHostname), nil },
+	"truncate": func(IssConfig) (processor, error) { return processorFunc(processTruncate), nil },
+	"origin":   func(IssConfig) (processor, error) { return processorFunc(processOrigin), nil },
+	"metadata": func(IssConfig) (processor, error) { return processorFunc(processMetadata), nil },
+	"filter":   func(config IssConfig) (processor, error) { return newFilter(config) },
+	"l2met":    func(config IssConfig) (processor, error) { return newL2met(config) },
+	"redact":   func(config IssConfig) (processor, error) { return newRedactor(config) },
+}
+
+// frame is a single syslog message going through the pipeline. Its header and
+// Data may refer to the request's buffers, and the elements of SD may be shared
+// with other frames, so processors should replace rather than modify them.
+type frame struct {
+	Header lpx.Header
+	Data   []byte      // STRUCTURED-DATA and MSG, as they follow the header
+	SD     []sdElement // SD-ELEMENTs to add to the frame's STRUCTURED-DATA
+}
+
+// batch describes the request the frames being processed came from.
+type batch struct {
+	Request    *http.Request
+	RemoteAddr string
+	DrainToken string
+	MetadataId string
+	Credential *credential
+	Config     *IssConfig
+
+	result      *fixResult
+	origin      sdElement
+	metadata    sdElement
+	hasMetadata bool
+	metadataSet bool
+}
+
+// Metadata returns the metadata element for the request, if it has any.
+func (b *batch) Metadata() (sdElement, bool) {
+	if !b.metadataSet {
+		b.metadata, b.hasMetadata = getMetadata(b.Request, b.Credential, b.MetadataId, b.Config)
+		b.metadataSet = true
+	}
+	return b.metadata, b.hasMetadata
+}
+
+// Origin returns the origin element for the request.
+func (b *batch) Origin() sdElement {
+	if b.origin.ID == "" {
+		b.origin = sdElement{ID: "origin", Params: []sdParam{{Name: "ip", Value: b.RemoteAddr}}}
+	}
+	return b.origin
+}
+
+// pipeline is the ordered chain of processors named in LOG_ISS_PIPELINE.
+type pipeline struct {
+	stages []pipelineStage
+}
+
+type pipelineStage struct {
+	name      string
+	processor processor
+	dropped   metrics.Counter // tracks the number of frames dropped by the processor
+}
+
+func newPipeline(config IssConfig) (*pipeline, error) {
+	p := &pipeline{}
+	for _, name := range config.Pipeline {
+		name = strings.TrimSpace(name)
+		factory, ok := processorFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown LOG_ISS_PIPELINE processor %q", name)
+		}
+		proc, err := factory(config)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create %s processor: %s", name, err)
+		}
+		p.stages = append(p.stages, pipelineStage{
+			name:      name,
+			processor: proc,
+			dropped:   metrics.GetOrRegisterCounter("log-iss.pipeline."+name+".dropped", config.MetricsRegistry),
+		})
+	}
+	return p, nil
+}
+
+// Close closes the processors implementing io.Closer, returning the first error.
+func (p *pipeline) Close() error {
+	var first error
+	for _, s := range p.stages {
+		if c, ok := s.processor.(io.Closer); ok {
+			if err := c.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// Run f through each processor in turn, stopping if one drops it.
+func (p *pipeline) process(b *batch, f *frame) bool {
+	for _, s := range p.stages {
+		if !s.processor.Process(b, f) {
+			s.dropped.Inc(1)
+			return false
+		}
+	}
+	return true
+}
+
+// Fix is a FixerFunc which parses the request body according to its content
+// type, runs each frame through the pipeline and encodes the frames that
+// remain as length prefixed syslog.
+func (p *pipeline) Fix(req *http.Request, r io.Reader, remoteAddr string, logplexDrainToken string, metadataId string, cred *credential, config *IssConfig, chunk chunkFunc) (fixResult, error) {
+	fw := newFrameWriter(p, batch{
+		Request:    req,
+		RemoteAddr: remoteAddr,
+		DrainToken: logplexDrainToken,
+		MetadataId: metadataId,
+		Credential: cred,
+		Config:     config,
+	}, chunk)
+	defer fw.Release()
+
+	var err error
+	switch contentType(req) {
+	case jsonContentType:
+		err = fixJSON(fw, r)
+	case ndjsonContentType:
+		err = fixNDJSON(fw, r)
+	default:
+		if config.LenientParsing {
+			err = fixLenient(fw, r)
+			break
+		}
+		lr := newLogplexReader(r, config.MaxFrameBytes)
+		for err == nil && lr.Next() {
+			err = fw.write(lr.Header(), lr.Bytes())
+		}
+		if err == nil {
+			err = lr.Err()
+		}
+		lr.Close()
+	}
+
+	if err == nil {
+		err = fw.Finish()
+	}
+	return fw.Result(), err
+}
+
+// Replace logplex's default hostname with the drain token, if there is one.
+func processHostname(b *batch, f *frame) bool {
+	if string(f.Header.Hostname) == logplexDefaultHost && b.DrainToken != "" {
+		f.Header.Hostname = []byte(b.DrainToken)
+	}
+	return true
+}
+
+// Truncate header fields to the lengths allowed by RFC5424.
+func processTruncate(b *batch, f *frame) bool {
+	if truncateField(&f.Header.Hostname, maxHostnameLength) {
+		b.result.hostnameTruncs++
+	}
+	if truncateField(&f.Header.Name, maxAppnameLength) {
+		b.result.appnameTruncs++
+	}
+	if truncateField(&f.Header.Procid, maxProcidLength) {
+		b.result.procidTruncs++
+	}
+	if truncateField(&f.Header.Msgid, maxMsgidLength) {
+		b.result.msgidTruncs++
+	}
+	return true
+}
+
+// Add the address the request came from as [origin ip="..."].
+func processOrigin(b *batch, f *frame) bool {
+	if b.RemoteAddr != "" {
+		f.SD = append(f.SD, b.Origin())
+	}
+	return true
+}
+
+// Add the request's metadata, from its query parameters and credential.
+func processMetadata(b *batch, f *frame) bool {
+	if md, ok := b.Metadata(); ok {
+		f.SD = append(f.SD, md)
+		b.result.hasMetadata = true
+	}
+	return true
+}
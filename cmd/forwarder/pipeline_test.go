@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPipelineUnknownProcessor(t *testing.T) {
+	config := *getConfig()
+	config.Pipeline = []string{"hostname", "nope"}
+	_, err := newPipeline(config)
+	assert.EqualError(t, err, `Unknown LOG_ISS_PIPELINE processor "nope"`)
+}
+
+func TestPipelineOrder(t *testing.T) {
+	config := *getConfig()
+	config.QueryParams = []string{"index"}
+	config.Pipeline = []string{"metadata", "origin"}
+	p, err := newPipeline(config)
+	assert.NoError(t, err)
+
+	in := []byte("65 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - hello\n")
+	r, err := p.Fix(httpRequestWithParams(), bytes.NewReader(in), "1.2.3.4", "", "metadata@123", nil, &config, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, `111 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [metadata@123 index="i"][origin ip="1.2.3.4"] hello`+"\n", string(r.bytes))
+	assert.True(t, r.hasMetadata)
+}
+
+func TestPipelineDrop(t *testing.T) {
+	assert := assert.New(t)
+	config := *getConfig()
+	processorFactories["test-drop-web"] = func(IssConfig) (processor, error) {
+		return processorFunc(func(b *batch, f *frame) bool {
+			return !bytes.HasPrefix(f.Header.Procid, []byte("web"))
+		}), nil
+	}
+	defer delete(processorFactories, "test-drop-web")
+	config.Pipeline = append(config.Pipeline, "test-drop-web")
+	p, err := newPipeline(config)
+	assert.NoError(err)
+
+	in := []byte("65 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - hello\n" +
+		"65 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku worker.1 - hi\n")
+	r, err := p.Fix(simpleHttpRequest(), bytes.NewReader(in), "", "", "", nil, &config, nil)
+	assert.NoError(err)
+	assert.Equal("67 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku worker.1 - - hi\n", string(r.bytes))
+	assert.Equal(int64(2), r.numLogs)
+	assert.Equal(int64(1), p.stages[len(p.stages)-1].dropped.Count())
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+const (
+	// Size of the buffered readers requests are parsed with. Frames up to this
+	// size are parsed without being copied.
+	readerBufferSize = 64 << 10
+
+	// Larger buffers aren't returned to bufferPool, so one unusually large
+	// request doesn't pin its memory for the life of the process.
+	maxPooledBufferSize = 4 << 20
+)
+
+var (
+	bufferPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+	readerPool = sync.Pool{New: func() interface{} { return bufio.NewReaderSize(nil, readerBufferSize) }}
+
+	lenientReaderPool = sync.Pool{New: func() interface{} { return bufio.NewReaderSize(nil, lenientWindowSize) }}
+	gzipPool          sync.Pool
+)
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer returns b to the pool. b must not be used afterwards, including
+// any slice returned by b.Bytes().
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() > maxPooledBufferSize {
+		return
+	}
+	b.Reset()
+	bufferPool.Put(b)
+}
+
+func getReader(r io.Reader) *bufio.Reader {
+	br := readerPool.Get().(*bufio.Reader)
+	br.Reset(r)
+	return br
+}
+
+func putReader(br *bufio.Reader) {
+	br.Reset(nil)
+	readerPool.Put(br)
+}
+
+func getLenientReader(r io.Reader) *bufio.Reader {
+	br := lenientReaderPool.Get().(*bufio.Reader)
+	br.Reset(r)
+	return br
+}
+
+func putLenientReader(br *bufio.Reader) {
+	br.Reset(nil)
+	lenientReaderPool.Put(br)
+}
+
+func getGzipReader(r io.Reader) (*gzip.Reader, error) {
+	if gz, ok := gzipPool.Get().(*gzip.Reader); ok {
+		if err := gz.Reset(r); err != nil {
+			return nil, err
+		}
+		return gz, nil
+	}
+	return gzip.NewReader(r)
+}
+
+func putGzipReader(gz *gzip.Reader) {
+	gz.Close()
+	gzipPool.Put(gz)
+}
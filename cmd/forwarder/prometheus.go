@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+var prometheusQuantiles = []float64{0.5, 0.95, 0.99}
+
+// prometheusRule turns the dotted names of a group of metrics into a metric
+// name and labels. Named groups in re become labels, except for metric, which
+// is substituted into name.
+type prometheusRule struct {
+	re   *regexp.Regexp
+	name string
+}
+
+var prometheusRules = []prometheusRule{
+	{regexp.MustCompile(`^log-iss\.auth\.user\.(?P<user>[^.]+)$`), "log_iss_auth_user_posts"},
+	{regexp.MustCompile(`^log-iss\.auth\.(?P<user>[^.]+)\.(?P<stage>[^.]+)\.(?P<metric>successes|deprecated|expired|not_yet_valid)$`), "log_iss_auth_credential_${metric}"},
+	{regexp.MustCompile(`^log-iss\.auth\.(?P<user>[^.]+)\.failures$`), "log_iss_auth_credential_failures"},
+	{regexp.MustCompile(`^log-iss\.auth_refresh\.credentials\.(?P<user>[^.]+)$`), "log_iss_auth_refresh_credentials"},
+	{regexp.MustCompile(`^log-iss\.forwarder\.(?:(?P<set>[^.]+)\.)?(?P<forwarder>\d+)\.(?P<metric>.+)$`), "log_iss_forwarder_${metric}"},
+	{regexp.MustCompile(`^log-iss\.forwardset\.(?:(?P<set>[^.]+)\.)?(?P<metric>deliver\..+)$`), "log_iss_forwardset_${metric}"},
+	{regexp.MustCompile(`^log-iss\.spool\.(?:(?P<set>[^.]+)\.)?(?P<metric>[^.]+)$`), "log_iss_spool_${metric}"},
+	{regexp.MustCompile(`^log-iss\.router\.(?P<set>[^.]+)\.(?P<metric>frames)$`), "log_iss_router_${metric}"},
+	{regexp.MustCompile(`^log-iss\.ratelimit\.(?P<user>[^.]+)\.throttled\.(?P<metric>[^.]+)$`), "log_iss_ratelimit_throttled_${metric}"},
+	{regexp.MustCompile(`^log-iss\.pipeline\.(?P<processor>[^.]+)\.(?P<metric>[^.]+)$`), "log_iss_pipeline_${metric}"},
+	{regexp.MustCompile(`^log-iss\.filter\.(?P<rule>[^.]+)\.(?P<metric>[^.]+)$`), "log_iss_filter_${metric}"},
+	{regexp.MustCompile(`^log-iss\.redact\.(?P<rule>[^.]+)\.(?P<metric>[^.]+)$`), "log_iss_redact_${metric}"},
+	{regexp.MustCompile(`^log-iss\.l2met\.(?P<host>[^.]+)\.(?P<source>[^.]+)\.(?P<metric>.+)$`), "log_iss_l2met_${metric}"},
+	{regexp.MustCompile(`^log-iss\.logplex\.(?P<token>[^.]+)\.errors\.(?P<code>[^.]+)$`), "log_iss_logplex_errors"},
+	{regexp.MustCompile(`^log-iss\.logplex\.(?P<token>[^.]+)\.(?P<metric>.+)$`), "log_iss_logplex_${metric}"},
+	{regexp.MustCompile(`^log-iss\.destination\.(?P<destination>[^.]+)\.(?P<metric>.+)$`), "log_iss_destination_${metric}"},
+}
+
+var prometheusInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// Return the Prometheus metric name and labels for the go-metrics name.
+func prometheusName(name string) (string, map[string]string) {
+	for _, rule := range prometheusRules {
+		m := rule.re.FindStringSubmatchIndex(name)
+		if m == nil {
+			continue
+		}
+
+		labels := make(map[string]string)
+		for i, group := range rule.re.SubexpNames() {
+			if group == "" || group == "metric" || m[2*i] < 0 {
+				continue
+			}
+			labels[group] = name[m[2*i]:m[2*i+1]]
+		}
+		n := rule.re.ExpandString(nil, rule.name, name, m)
+		return prometheusInvalidChars.ReplaceAllString(string(n), "_"), labels
+	}
+	return prometheusInvalidChars.ReplaceAllString(name, "_"), nil
+}
+
+// prometheusFamily is every sample of one metric name, which Prometheus
+// requires to be listed together under a single TYPE line.
+type prometheusFamily struct {
+	kind    string
+	samples []string
+}
+
+func (f *prometheusFamily) add(name string, labels map[string]string, value float64) {
+	f.samples = append(f.samples, name+formatPrometheusLabels(labels)+" "+strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func formatPrometheusLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, k, escaper.Replace(labels[k])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLabel returns a copy of labels with k set to v.
+func withLabel(labels map[string]string, k, v string) map[string]string {
+	l := map[string]string{k: v}
+	for lk, lv := range labels {
+		l[lk] = lv
+	}
+	return l
+}
+
+// writePrometheus writes every metric in registry to b in the Prometheus text
+// exposition format. Counters and meters are counters, gauges are gauges,
+// histograms are summaries and timers are summaries in seconds.
+func writePrometheus(b *bytes.Buffer, registry metrics.Registry) {
+	families := make(map[string]*prometheusFamily)
+	family := func(name, kind string) *prometheusFamily {
+		f, ok := families[name]
+		if !ok {
+			f = &prometheusFamily{kind: kind}
+			families[name] = f
+		}
+		return f
+	}
+	summary := func(name string, labels map[string]string, count int64, sum float64, quantiles []float64) {
+		f := family(name, "summary")
+		for i, q := range prometheusQuantiles {
+			f.add(name, withLabel(labels, "quantile", strconv.FormatFloat(q, 'g', -1, 64)), quantiles[i])
+		}
+		f.add(name+"_sum", labels, sum)
+		f.add(name+"_count", labels, float64(count))
+	}
+
+	// Visit metrics in order so each family's samples are listed consistently.
+	all := make(map[string]interface{})
+	registry.Each(func(n string, i interface{}) { all[n] = i })
+	sorted := make([]string, 0, len(all))
+	for n := range all {
+		sorted = append(sorted, n)
+	}
+	sort.Strings(sorted)
+
+	for _, n := range sorted {
+		name, labels := prometheusName(n)
+
+		switch m := all[n].(type) {
+		case metrics.Counter:
+			family(name+"_total", "counter").add(name+"_total", labels, float64(m.Count()))
+		case metrics.Meter:
+			family(name+"_total", "counter").add(name+"_total", labels, float64(m.Count()))
+		case metrics.Gauge:
+			family(name, "gauge").add(name, labels, float64(m.Value()))
+		case metrics.GaugeFloat64:
+			family(name, "gauge").add(name, labels, m.Value())
+		case metrics.Histogram:
+			s := m.Snapshot()
+			summary(name, labels, s.Count(), float64(s.Sum()), s.Percentiles(prometheusQuantiles))
+		case metrics.Timer:
+			s := m.Snapshot()
+			ps := s.Percentiles(prometheusQuantiles)
+			for i := range ps {
+				ps[i] /= 1e9
+			}
+			summary(name+"_seconds", labels, s.Count(), float64(s.Sum())/1e9, ps)
+		}
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := families[name]
+		fmt.Fprintf(b, "# TYPE %s %s\n", name, f.kind)
+		for _, s := range f.samples {
+			b.WriteString(s)
+			b.WriteString("\n")
+		}
+	}
+}
+
+// newPrometheusHandler serves registry for Prometheus to scrape.
+func newPrometheusHandler(registry metrics.Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b bytes.Buffer
+		writePrometheus(&b, registry)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(b.Bytes())
+	})
+}
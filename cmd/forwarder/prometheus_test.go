@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusName(t *testing.T) {
+	tests := map[string]struct {
+		name   string
+		labels map[string]string
+	}{
+		"log-iss.logs.sent":                        {name: "log_iss_logs_sent"},
+		"log-iss.auth.user.shuttle":                {name: "log_iss_auth_user_posts", labels: map[string]string{"user": "shuttle"}},
+		"log-iss.auth.shuttle.current.successes":   {name: "log_iss_auth_credential_successes", labels: map[string]string{"user": "shuttle", "stage": "current"}},
+		"log-iss.auth.shuttle.failures":            {name: "log_iss_auth_credential_failures", labels: map[string]string{"user": "shuttle"}},
+		"log-iss.forwarder.3.write.errors":         {name: "log_iss_forwarder_write_errors", labels: map[string]string{"forwarder": "3"}},
+		"log-iss.forwarder.audit.3.write.errors":   {name: "log_iss_forwarder_write_errors", labels: map[string]string{"forwarder": "3", "set": "audit"}},
+		"log-iss.forwardset.deliver.timeout":       {name: "log_iss_forwardset_deliver_timeout", labels: map[string]string{}},
+		"log-iss.forwardset.audit.deliver.timeout": {name: "log_iss_forwardset_deliver_timeout", labels: map[string]string{"set": "audit"}},
+		"log-iss.spool.bytes":                      {name: "log_iss_spool_bytes", labels: map[string]string{}},
+		"log-iss.router.audit.frames":              {name: "log_iss_router_frames", labels: map[string]string{"set": "audit"}},
+		"log-iss.destination.10_0_0_1_601.healthy": {name: "log_iss_destination_healthy", labels: map[string]string{"destination": "10_0_0_1_601"}},
+		"log-iss.destination.a_601.connect.errors": {name: "log_iss_destination_connect_errors", labels: map[string]string{"destination": "a_601"}},
+	}
+
+	for in, test := range tests {
+		t.Run(in, func(t *testing.T) {
+			name, labels := prometheusName(in)
+			assert.Equal(t, test.name, name)
+			assert.Equal(t, test.labels, labels)
+		})
+	}
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	assert := assert.New(t)
+	registry := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("log-iss.forwarder.0.write.errors", registry).Inc(2)
+	metrics.GetOrRegisterCounter("log-iss.forwarder.1.write.errors", registry).Inc(3)
+	metrics.GetOrRegisterGauge("log-iss.spool.bytes", registry).Update(42)
+	metrics.GetOrRegisterTimer("log-iss.http.logs", registry).Update(2 * time.Second)
+
+	rec := httptest.NewRecorder()
+	newPrometheusHandler(registry).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	expected := strings.Join([]string{
+		`# TYPE log_iss_forwarder_write_errors_total counter`,
+		`log_iss_forwarder_write_errors_total{forwarder="0"} 2`,
+		`log_iss_forwarder_write_errors_total{forwarder="1"} 3`,
+		`# TYPE log_iss_http_logs_seconds summary`,
+		`log_iss_http_logs_seconds{quantile="0.5"} 2`,
+		`log_iss_http_logs_seconds{quantile="0.95"} 2`,
+		`log_iss_http_logs_seconds{quantile="0.99"} 2`,
+		`log_iss_http_logs_seconds_sum 2`,
+		`log_iss_http_logs_seconds_count 1`,
+		`# TYPE log_iss_spool_bytes gauge`,
+		`log_iss_spool_bytes 42`,
+	}, "\n") + "\n"
+	assert.Equal(expected, rec.Body.String())
+	assert.Equal("text/plain; version=0.0.4", rec.Header().Get("Content-Type"))
+}
+
+func TestFormatPrometheusLabelsEscapes(t *testing.T) {
+	assert.Equal(t, `{user="a\"b\\c\nd"}`, formatPrometheusLabels(map[string]string{"user": "a\"b\\c\nd"}))
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	metrics "github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	rateLimitRedisPrefix = "log-iss:ratelimit"
+
+	// How long an idle, full bucket is kept before it's forgotten.
+	rateBucketIdle = time.Minute
+)
+
+// rateLimits are the lines and bytes per second a credential may send. A zero
+// limit is unlimited.
+type rateLimits struct {
+	Lines float64
+	Bytes float64
+}
+
+func (l rateLimits) unlimited() bool {
+	return l.Lines <= 0 && l.Bytes <= 0
+}
+
+// rateLimitKey returns the key cred's usage is counted under, and its limits.
+func rateLimitKey(user string, cred *credential, drainToken string) (string, rateLimits) {
+	limits := rateLimits{Lines: cred.LinesPerSecond, Bytes: cred.BytesPerSecond}
+	if cred.LimitPerDrainToken && drainToken != "" {
+		return user + "/" + drainToken, limits
+	}
+	return user, limits
+}
+
+// rateLimiter decides whether a request may be delivered.
+type rateLimiter interface {
+	// Take counts lines and bytes against key. If key was already over its
+	// limits, nothing is counted and Take returns how long to wait before
+	// trying again.
+	Take(key string, limits rateLimits, lines, bytes int64) (bool, time.Duration)
+	// Charge counts lines and bytes against key whether or not it's over its
+	// limits, for the rest of a request admitted by Take.
+	Charge(key string, limits rateLimits, lines, bytes int64)
+}
+
+// throttledError is returned when a request is rejected by the rate limiter.
+type throttledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *throttledError) Error() string {
+	return fmt.Sprintf("Rate limit exceeded, retry after %s", e.RetryAfter)
+}
+
+// newRateLimiter returns a limiter shared between all instances through Redis
+// if RATE_LIMIT_REDIS_URL is set, or one local to this process otherwise.
+func newRateLimiter(config IssConfig) (rateLimiter, error) {
+	if config.RateLimitRedisUrl == "" {
+		return newLocalRateLimiter(), nil
+	}
+
+	client, _, err := newRedisClient(config.RateLimitRedisUrl)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse RATE_LIMIT_REDIS_URL: %s", err)
+	}
+	return newRedisRateLimiter(client, config.MetricsRegistry), nil
+}
+
+// localRateLimiter keeps a token bucket per key, holding a second's worth of
+// each limit. A request is admitted as long as its bucket isn't empty, and may
+// take the bucket below zero, so batches larger than the limit still get
+// through at the limited rate on average.
+type localRateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type rateBucket struct {
+	lines float64
+	bytes float64
+	last  time.Time
+}
+
+func newLocalRateLimiter() *localRateLimiter {
+	return &localRateLimiter{
+		buckets: make(map[string]*rateBucket),
+		now:     time.Now,
+	}
+}
+
+func (l *localRateLimiter) Take(key string, limits rateLimits, lines, bytes int64) (bool, time.Duration) {
+	if limits.unlimited() {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.bucket(key, limits)
+	var wait float64
+	if limits.Lines > 0 && b.lines < 0 {
+		wait = -b.lines / limits.Lines
+	}
+	if limits.Bytes > 0 && b.bytes < 0 {
+		wait = math.Max(wait, -b.bytes/limits.Bytes)
+	}
+	if wait > 0 {
+		return false, time.Duration(wait * float64(time.Second))
+	}
+
+	b.lines -= float64(lines)
+	b.bytes -= float64(bytes)
+	return true, 0
+}
+
+func (l *localRateLimiter) Charge(key string, limits rateLimits, lines, bytes int64) {
+	if limits.unlimited() {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.bucket(key, limits)
+	b.lines -= float64(lines)
+	b.bytes -= float64(bytes)
+}
+
+// Return key's bucket, refilled for the time since it was last used. Callers
+// must hold l.mu.
+func (l *localRateLimiter) bucket(key string, limits rateLimits) *rateBucket {
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &rateBucket{lines: limits.Lines, bytes: limits.Bytes, last: now}
+		l.buckets[key] = b
+	}
+
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	b.lines = math.Min(b.lines+elapsed*limits.Lines, limits.Lines)
+	b.bytes = math.Min(b.bytes+elapsed*limits.Bytes, limits.Bytes)
+	return b
+}
+
+// Forget buckets that have been idle long enough to be full again, at most
+// once per rateBucketIdle.
+func (l *localRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateBucketIdle {
+		return
+	}
+	l.lastSweep = now
+	for k, b := range l.buckets {
+		if now.Sub(b.last) >= rateBucketIdle {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// redisRateLimiter counts usage in one second windows in Redis so limits apply
+// across all instances. A request is admitted as long as the window wasn't
+// already over the limit. If Redis is unavailable, requests are admitted.
+type redisRateLimiter struct {
+	client redis.Cmdable
+	errors metrics.Counter // counts failures talking to Redis
+	now    func() time.Time
+}
+
+// rateLimitScript takes whether to check the limits, then a limit and count
+// for each of KEYS. Unless checking and one of the keys is already at its
+// limit, every count is added and 1 returned; otherwise nothing is counted and
+// 0 returned.
+var rateLimitScript = redis.NewScript(`
+if ARGV[1] == "1" then
+	for i, k in ipairs(KEYS) do
+		if tonumber(redis.call("GET", k) or "0") >= tonumber(ARGV[2*i]) then
+			return 0
+		end
+	end
+end
+for i, k in ipairs(KEYS) do
+	redis.call("INCRBY", k, ARGV[2*i+1])
+	redis.call("EXPIRE", k, 2)
+end
+return 1
+`)
+
+func newRedisRateLimiter(client redis.Cmdable, registry metrics.Registry) *redisRateLimiter {
+	return &redisRateLimiter{
+		client: client,
+		errors: metrics.GetOrRegisterCounter("log-iss.ratelimit.redis.errors", registry),
+		now:    time.Now,
+	}
+}
+
+func (l *redisRateLimiter) Take(key string, limits rateLimits, lines, bytes int64) (bool, time.Duration) {
+	return l.count(key, limits, lines, bytes, true)
+}
+
+func (l *redisRateLimiter) Charge(key string, limits rateLimits, lines, bytes int64) {
+	l.count(key, limits, lines, bytes, false)
+}
+
+func (l *redisRateLimiter) count(key string, limits rateLimits, lines, bytes int64, check bool) (bool, time.Duration) {
+	if limits.unlimited() {
+		return true, 0
+	}
+
+	now := l.now()
+	window := now.Unix()
+	wait := time.Unix(window+1, 0).Sub(now)
+
+	keys := make([]string, 0, 2)
+	args := []interface{}{0}
+	if check {
+		args[0] = 1
+	}
+	for _, c := range []struct {
+		name  string
+		limit float64
+		n     int64
+	}{{"lines", limits.Lines, lines}, {"bytes", limits.Bytes, bytes}} {
+		if c.limit <= 0 {
+			continue
+		}
+		// The hash tag keeps a window's keys in the same Redis Cluster slot,
+		// as scripts require.
+		keys = append(keys, fmt.Sprintf("%s:{%s:%d}:%s", rateLimitRedisPrefix, key, window, c.name))
+		args = append(args, strconv.FormatFloat(c.limit, 'f', -1, 64), c.n)
+	}
+
+	admitted, err := rateLimitScript.Run(l.client, keys, args...).Int64()
+	if err != nil {
+		l.errors.Inc(1)
+		log.WithFields(log.Fields{"ns": "ratelimit", "at": "error", "message": err}).Error()
+		return true, 0
+	}
+	if admitted == 0 {
+		return false, wait
+	}
+	return true, 0
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/elliotchance/redismock"
+	"github.com/go-redis/redis"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Unix(1000, 0)
+	l := newLocalRateLimiter()
+	l.now = func() time.Time { return now }
+	limits := rateLimits{Lines: 10}
+
+	ok, _ := l.Take("user", limits, 25, 1000)
+	assert.True(ok, "a batch larger than the limit is admitted while the bucket isn't empty")
+
+	ok, wait := l.Take("user", limits, 1, 10)
+	assert.False(ok)
+	assert.Equal(1500*time.Millisecond, wait)
+
+	ok, _ = l.Take("other", limits, 1, 10)
+	assert.True(ok, "keys are limited independently")
+
+	now = now.Add(wait)
+	ok, _ = l.Take("user", limits, 1, 10)
+	assert.True(ok)
+
+	ok, _ = l.Take("user", rateLimits{}, 1000, 1000)
+	assert.True(ok, "no limits means unlimited")
+}
+
+func TestLocalRateLimiterCharge(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Unix(1000, 0)
+	l := newLocalRateLimiter()
+	l.now = func() time.Time { return now }
+	limits := rateLimits{Lines: 10}
+
+	l.Charge("user", limits, 15, 100)
+	ok, wait := l.Take("user", limits, 1, 10)
+	assert.False(ok, "charges are counted even when over the limit")
+	assert.Equal(500*time.Millisecond, wait)
+}
+
+func TestProcessRateLimitsWholeRequests(t *testing.T) {
+	assert := assert.New(t)
+	config := *getConfig()
+	config.ChunkBytes = 1000
+	config.MetricsRegistry = metrics.NewRegistry()
+	p, err := newPipeline(config)
+	if !assert.NoError(err) {
+		return
+	}
+	d := &recordingDeliverer{}
+	s := newHTTPServer(config, nil, newLocalRateLimiter(), nil, p.Fix, d)
+	cred := &credential{LinesPerSecond: 10}
+
+	body := logplexBody(25)
+	req := simpleHttpRequest()
+	req.SetBasicAuth("user", "pass")
+	_, err, status := s.process(req, bytes.NewReader(body), "", "", "", "", cred)
+	assert.NoError(err)
+	assert.Equal(200, status)
+	assert.True(len(d.payloads) > 1)
+	assert.Equal(string(body), d.bodies(), "an admitted request is delivered in full")
+
+	_, err, status = s.process(req, bytes.NewReader(body), "", "", "", "", cred)
+	assert.Error(err)
+	assert.Equal(429, status)
+	assert.Equal(string(body), d.bodies(), "a throttled request isn't delivered at all")
+}
+
+func TestLocalRateLimiterBytes(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Unix(1000, 0)
+	l := newLocalRateLimiter()
+	l.now = func() time.Time { return now }
+	limits := rateLimits{Lines: 100, Bytes: 1000}
+
+	ok, _ := l.Take("user", limits, 1, 3000)
+	assert.True(ok)
+	ok, wait := l.Take("user", limits, 1, 10)
+	assert.False(ok)
+	assert.Equal(2*time.Second, wait)
+}
+
+func TestLocalRateLimiterForgetsIdleBuckets(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newLocalRateLimiter()
+	l.now = func() time.Time { return now }
+
+	l.Take("a", rateLimits{Lines: 10}, 1, 1)
+	now = now.Add(2 * rateBucketIdle)
+	l.Take("b", rateLimits{Lines: 10}, 1, 1)
+	assert.Equal(t, 1, len(l.buckets))
+}
+
+func TestRedisRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+	r := redismock.NewMock()
+	r.On("EvalSha").Return(redis.NewCmdResult(int64(1), nil)).Once()
+	r.On("EvalSha").Return(redis.NewCmdResult(int64(0), nil)).Once()
+
+	l := newRedisRateLimiter(r, metrics.NewRegistry())
+	l.now = func() time.Time { return time.Unix(1000, int64(250*time.Millisecond)) }
+
+	ok, _ := l.Take("user", rateLimits{Lines: 10}, 5, 100)
+	assert.True(ok)
+
+	ok, wait := l.Take("user", rateLimits{Lines: 10}, 5, 100)
+	assert.False(ok)
+	assert.Equal(750*time.Millisecond, wait)
+	r.AssertExpectations(t)
+}
+
+func TestRedisRateLimiterFailsOpen(t *testing.T) {
+	r := redismock.NewMock()
+	r.On("EvalSha").Return(redis.NewCmdResult(nil, errors.New("connection refused")))
+
+	l := newRedisRateLimiter(r, metrics.NewRegistry())
+	ok, _ := l.Take("user", rateLimits{Lines: 10}, 5, 100)
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), l.errors.Count())
+}
+
+func TestRateLimitKey(t *testing.T) {
+	tests := map[string]struct {
+		cred     credential
+		expected string
+	}{
+		"per credential":  {cred: credential{LinesPerSecond: 1}, expected: "user"},
+		"per drain token": {cred: credential{LinesPerSecond: 1, LimitPerDrainToken: true}, expected: "user/d.123"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			key, limits := rateLimitKey("user", &test.cred, "d.123")
+			assert.Equal(t, test.expected, key)
+			assert.Equal(t, rateLimits{Lines: 1}, limits)
+		})
+	}
+}
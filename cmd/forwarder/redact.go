@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+const (
+	redactMask = "mask"
+	redactHash = "hash"
+	redactDrop = "drop"
+
+	defaultRedactReplacement = "<redacted>"
+)
+
+// Built in detectors which rules can name instead of giving a pattern.
+var redactDetectors = map[string]struct {
+	pattern *regexp.Regexp
+	valid   func([]byte) bool // further checks a match, if set
+}{
+	"email":   {pattern: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)},
+	"pan":     {pattern: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`), valid: luhnValid},
+	"jwt":     {pattern: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)},
+	"aws_key": {pattern: regexp.MustCompile(`\b(?:AKIA|ASIA|AGPA|AIDA|AROA|ANPA|ANVA|AIPA)[A-Z0-9]{16}\b`)},
+}
+
+// redactConfig is the list of redaction rules, read as JSON from
+// LOG_ISS_REDACT_RULES. For example:
+//
+//	{
+//	  "rules": [
+//	    {"name": "cards", "detector": "pan", "strategy": "drop"},
+//	    {"name": "emails", "detector": "email", "strategy": "hash", "credential": ["app-*"]},
+//	    {"name": "sessions", "pattern": "session=[0-9a-f]+", "replacement": "session=<redacted>"}
+//	  ]
+//	}
+//
+// Rules are applied in order to each PARAM-VALUE and the MSG of every frame
+// they're in scope for. Each is matched separately, so a pattern can't match
+// across the delimiters of the STRUCTURED-DATA.
+type redactConfig struct {
+	Rules []redactRuleConfig `json:"rules"`
+}
+
+type redactRuleConfig struct {
+	Name        string   `json:"name"`
+	Detector    string   `json:"detector"`
+	Pattern     string   `json:"pattern"`
+	Strategy    string   `json:"strategy"`    // mask (the default), hash or drop
+	Replacement string   `json:"replacement"` // for mask, defaults to <redacted>
+	Credential  []string `json:"credential"`  // shell patterns the credential name must match
+	DrainToken  []string `json:"drain_token"` // shell patterns the drain token must match
+}
+
+type redactRule struct {
+	redactRuleConfig
+	pattern     *regexp.Regexp
+	valid       func([]byte) bool
+	replacement []byte
+	hits        metrics.Counter // tracks the number of frames the rule matched
+}
+
+// redactor is a processor which masks, hashes or drops sensitive data.
+type redactor struct {
+	rules   []*redactRule
+	hashKey []byte
+}
+
+func newRedactor(config IssConfig) (*redactor, error) {
+	r := &redactor{hashKey: []byte(config.RedactHashKey)}
+	if config.RedactRules == "" {
+		return r, nil
+	}
+
+	var rc redactConfig
+	if err := json.Unmarshal([]byte(config.RedactRules), &rc); err != nil {
+		return nil, fmt.Errorf("Unable to parse LOG_ISS_REDACT_RULES: %s", err)
+	}
+
+	names := make(map[string]bool)
+	for _, c := range rc.Rules {
+		if c.Name == "" || strings.ContainsAny(c.Name, ". ") {
+			return nil, fmt.Errorf("Redaction rule name %q must be non-empty and contain no dots or spaces", c.Name)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("Duplicate redaction rule %q", c.Name)
+		}
+		names[c.Name] = true
+
+		rule := &redactRule{
+			redactRuleConfig: c,
+			hits:             metrics.GetOrRegisterCounter("log-iss.redact."+c.Name+".hits", config.MetricsRegistry),
+		}
+
+		switch {
+		case c.Detector != "" && c.Pattern != "":
+			return nil, fmt.Errorf("Redaction rule %q has both a detector and a pattern", c.Name)
+		case c.Detector != "":
+			d, ok := redactDetectors[c.Detector]
+			if !ok {
+				return nil, fmt.Errorf("Redaction rule %q uses unknown detector %q", c.Name, c.Detector)
+			}
+			rule.pattern, rule.valid = d.pattern, d.valid
+		case c.Pattern != "":
+			re, err := regexp.Compile(c.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("Redaction rule %q has an invalid pattern: %s", c.Name, err)
+			}
+			rule.pattern = re
+		default:
+			return nil, fmt.Errorf("Redaction rule %q needs a detector or a pattern", c.Name)
+		}
+
+		switch c.Strategy {
+		case "", redactMask:
+			rule.Strategy = redactMask
+			rule.replacement = []byte(defaultRedactReplacement)
+			if c.Replacement != "" {
+				rule.replacement = []byte(c.Replacement)
+			}
+		case redactHash:
+			if len(r.hashKey) == 0 {
+				return nil, fmt.Errorf("Redaction rule %q hashes but LOG_ISS_REDACT_HASH_KEY isn't set", c.Name)
+			}
+		case redactDrop:
+		default:
+			return nil, fmt.Errorf("Redaction rule %q has unknown strategy %q", c.Name, c.Strategy)
+		}
+
+		r.rules = append(r.rules, rule)
+	}
+
+	return r, nil
+}
+
+func (r *redactor) Process(b *batch, f *frame) bool {
+	for _, rule := range r.rules {
+		if !rule.inScope(b) {
+			continue
+		}
+
+		var hit bool
+		data := replaceSDValuesAndMsg(f.Data, func(b []byte) []byte {
+			return rule.pattern.ReplaceAllFunc(b, func(m []byte) []byte {
+				if rule.valid != nil && !rule.valid(m) {
+					return m
+				}
+				hit = true
+				switch rule.Strategy {
+				case redactHash:
+					return r.hash(m)
+				case redactMask:
+					return rule.replacement
+				}
+				return m
+			})
+		})
+		if !hit {
+			continue
+		}
+
+		rule.hits.Inc(1)
+		if rule.Strategy == redactDrop {
+			return false
+		}
+		f.Data = data
+	}
+	return true
+}
+
+// Return data, everything after the MSGID, with each unescaped PARAM-VALUE and
+// the MSG replaced by what fn returns for them.
+func replaceSDValuesAndMsg(data []byte, fn func([]byte) []byte) []byte {
+	elements, _, msg := splitStructuredData(data)
+	var out bytes.Buffer
+	n := 0
+	for _, raw := range elements {
+		n += len(raw)
+		e := parseSDElement(raw)
+		var changed bool
+		for i, p := range e.Params {
+			if v := fn([]byte(p.Value)); string(v) != p.Value {
+				e.Params[i].Value = string(v)
+				changed = true
+			}
+		}
+		if changed {
+			e.Write(&out, false)
+		} else {
+			out.Write(raw)
+		}
+	}
+	out.Write(data[n : len(data)-len(msg)])
+	out.Write(fn(msg))
+	return out.Bytes()
+}
+
+// Replace m with a keyed hash so equal values can still be correlated without
+// being revealed.
+func (r *redactor) hash(m []byte) []byte {
+	mac := hmac.New(sha256.New, r.hashKey)
+	mac.Write(m)
+	sum := mac.Sum(nil)
+	return []byte("hmac:" + hex.EncodeToString(sum[:8]))
+}
+
+// Whether the rule applies to frames from the request described by b.
+func (rule *redactRule) inScope(b *batch) bool {
+	if len(rule.Credential) > 0 {
+		if b.Credential == nil || !matchAny(rule.Credential, b.Credential.Name) {
+			return false
+		}
+	}
+	if len(rule.DrainToken) > 0 && !matchAny(rule.DrainToken, b.DrainToken) {
+		return false
+	}
+	return true
+}
+
+// Whether the digits in b, ignoring spaces and dashes, pass the Luhn check
+// used by payment card numbers.
+func luhnValid(b []byte) bool {
+	var sum, n int
+	for i := len(b) - 1; i >= 0; i-- {
+		c := b[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// newRedisClient connects to the Redis described by rawurl, one of
+//
+//	redis://[:password@]host[:port][/db], or rediss:// for TLS
+//	redis-sentinel://[:password@]host:port[,host:port...][/db]?master=name
+//	redis-cluster://[:password@]host:port[,host:port...]
+//
+// A Sentinel URL lists the sentinels to ask for the address of master, so
+// clients follow it when it fails over. A cluster URL lists any of the cluster's
+// nodes. Also returns the database selected.
+func newRedisClient(rawurl string) (redis.UniversalClient, int, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch u.Scheme {
+	case "redis-sentinel":
+		addrs, db, err := parseRedisHosts(u, "26379")
+		if err != nil {
+			return nil, 0, err
+		}
+		master := u.Query().Get("master")
+		if master == "" {
+			return nil, 0, fmt.Errorf("Redis Sentinel URL must set master")
+		}
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    master,
+			SentinelAddrs: addrs,
+			Password:      redisPassword(u),
+			DB:            db,
+		}), db, nil
+
+	case "redis-cluster":
+		addrs, db, err := parseRedisHosts(u, "6379")
+		if err != nil {
+			return nil, 0, err
+		}
+		if db != 0 {
+			return nil, 0, fmt.Errorf("Redis Cluster doesn't support selecting database %d", db)
+		}
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    addrs,
+			Password: redisPassword(u),
+		}), 0, nil
+	}
+
+	opt, err := redis.ParseURL(rawurl)
+	if err != nil {
+		return nil, 0, err
+	}
+	return redis.NewClient(opt), opt.DB, nil
+}
+
+// Parse the comma separated host:port addresses and database of u.
+func parseRedisHosts(u *url.URL, defaultPort string) ([]string, int, error) {
+	var addrs []string
+	for _, h := range strings.Split(u.Host, ",") {
+		if h == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(h); err != nil {
+			h = net.JoinHostPort(h, defaultPort)
+		}
+		addrs = append(addrs, h)
+	}
+	if len(addrs) == 0 {
+		return nil, 0, fmt.Errorf("Redis URL must list at least one host")
+	}
+
+	var db int
+	if p := strings.Trim(u.Path, "/"); p != "" {
+		var err error
+		if db, err = strconv.Atoi(p); err != nil {
+			return nil, 0, fmt.Errorf("Invalid Redis database %q", p)
+		}
+	}
+	return addrs, db, nil
+}
+
+func redisPassword(u *url.URL) string {
+	if u.User == nil {
+		return ""
+	}
+	p, _ := u.User.Password()
+	return p
+}
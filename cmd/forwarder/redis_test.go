@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRedisClient(t *testing.T) {
+	tests := map[string]struct {
+		url    string
+		client interface{}
+		db     int
+		err    string
+	}{
+		"redis":            {url: "redis://:secret@localhost:6380/2", client: &redis.Client{}, db: 2},
+		"sentinel":         {url: "redis-sentinel://:secret@s1:26379,s2,s3:26380/1?master=creds", client: &redis.Client{}, db: 1},
+		"sentinel master":  {url: "redis-sentinel://s1:26379", err: "Redis Sentinel URL must set master"},
+		"cluster":          {url: "redis-cluster://n1:7000,n2:7001", client: &redis.ClusterClient{}},
+		"cluster database": {url: "redis-cluster://n1:7000/3", err: "Redis Cluster doesn't support selecting database 3"},
+		"no hosts":         {url: "redis-cluster:///", err: "Redis URL must list at least one host"},
+		"bad database":     {url: "redis-sentinel://s1/x?master=creds", err: `Invalid Redis database "x"`},
+		"bad scheme":       {url: "http://localhost", err: "invalid redis URL scheme: http"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			client, db, err := newRedisClient(test.url)
+			if test.err != "" {
+				assert.EqualError(t, err, test.err)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer client.Close()
+			assert.IsType(t, test.client, client)
+			assert.Equal(t, test.db, db)
+		})
+	}
+}
+
+func TestParseRedisHosts(t *testing.T) {
+	u, err := url.Parse("redis-sentinel://s1:26379,s2,s3:26380/4")
+	if !assert.NoError(t, err) {
+		return
+	}
+	addrs, db, err := parseRedisHosts(u, "26379")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"s1:26379", "s2:26379", "s3:26380"}, addrs)
+	assert.Equal(t, 4, db)
+}
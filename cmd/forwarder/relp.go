@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	forwardProtocolTCP  = "tcp"
+	forwardProtocolRELP = "relp"
+
+	// Largest RELP frame we're willing to read from a server.
+	maxRELPFrameLength = 128 * 1024
+
+	relpOffers = "relp_version=0\nrelp_software=log-iss\ncommands=syslog"
+)
+
+// outputConn is a connection to a destination.
+type outputConn interface {
+	// Write sends the octet-counted frames in b, returning the number of bytes
+	// of b known to have been delivered even if an error is also returned.
+	Write(b []byte) (int, error)
+	Close() error
+	RemoteAddr() net.Addr
+}
+
+// streamConn writes frames as they are onto the connection. A write the kernel
+// accepted is considered delivered, and nothing is on error.
+type streamConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.SetWriteDeadline(time.Now().Add(c.timeout))
+	n, err := c.Conn.Write(b)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// relpConn speaks the Reliable Event Logging Protocol: each frame is sent as a
+// syslog command and is only delivered once the server acknowledges it. Up to
+// window commands are outstanding at once.
+type relpConn struct {
+	net.Conn
+	br      *bufio.Reader
+	txnr    uint64
+	window  int
+	timeout time.Duration
+}
+
+// newRELPConn opens a RELP session on c.
+func newRELPConn(c net.Conn, window int, timeout time.Duration) (*relpConn, error) {
+	r := &relpConn{
+		Conn:    c,
+		br:      bufio.NewReader(c),
+		window:  window,
+		timeout: timeout,
+	}
+
+	r.SetDeadline(time.Now().Add(timeout))
+	txnr, err := r.send("open", []byte(relpOffers))
+	if err != nil {
+		return nil, err
+	}
+	if err := r.awaitOK(txnr); err != nil {
+		return nil, fmt.Errorf("RELP open failed: %s", err)
+	}
+	return r, nil
+}
+
+func (r *relpConn) Write(b []byte) (int, error) {
+	type pending struct {
+		txnr uint64
+		end  int // offset in b just past the frame
+	}
+
+	var inflight []pending
+	acked := 0
+	off := 0
+	for off < len(b) || len(inflight) > 0 {
+		r.SetDeadline(time.Now().Add(r.timeout))
+
+		for off < len(b) && len(inflight) < r.window {
+			msg, n, err := nextFrame(b[off:])
+			if err != nil {
+				return acked, err
+			}
+			txnr, err := r.send("syslog", msg)
+			if err != nil {
+				return acked, err
+			}
+			off += n
+			inflight = append(inflight, pending{txnr: txnr, end: off})
+		}
+
+		txnr, status, err := r.readResponse()
+		if err != nil {
+			return acked, err
+		}
+		if txnr != inflight[0].txnr {
+			return acked, fmt.Errorf("RELP response for unexpected transaction %d, expected %d", txnr, inflight[0].txnr)
+		}
+		if status != "200" {
+			return acked, fmt.Errorf("RELP server rejected transaction %d with status %s", txnr, status)
+		}
+		acked = inflight[0].end
+		inflight = inflight[1:]
+	}
+	return acked, nil
+}
+
+// Close ends the session, then closes the connection.
+func (r *relpConn) Close() error {
+	r.SetDeadline(time.Now().Add(r.timeout))
+	if txnr, err := r.send("close", nil); err == nil {
+		r.awaitOK(txnr)
+	}
+	return r.Conn.Close()
+}
+
+func (r *relpConn) send(command string, data []byte) (uint64, error) {
+	r.txnr++
+	if _, err := r.Conn.Write(encodeRELPFrame(r.txnr, command, data)); err != nil {
+		return 0, err
+	}
+	return r.txnr, nil
+}
+
+func (r *relpConn) awaitOK(txnr uint64) error {
+	got, status, err := r.readResponse()
+	if err != nil {
+		return err
+	}
+	if got != txnr || status != "200" {
+		return fmt.Errorf("unexpected response %s to transaction %d", status, got)
+	}
+	return nil
+}
+
+// Read the next rsp frame, returning its transaction number and status code.
+func (r *relpConn) readResponse() (uint64, string, error) {
+	txnr, command, data, err := readRELPFrame(r.br)
+	if err != nil {
+		return 0, "", err
+	}
+	if command == "serverclose" {
+		return 0, "", errors.New("RELP server closed the session")
+	}
+	if command != "rsp" {
+		return 0, "", fmt.Errorf("Unexpected RELP command %q", command)
+	}
+	status := data
+	if i := bytes.IndexAny(data, " \n"); i >= 0 {
+		status = data[:i]
+	}
+	return txnr, string(status), nil
+}
+
+// Encode a RELP frame: TXNR SP COMMAND SP DATALEN [SP DATA] LF
+func encodeRELPFrame(txnr uint64, command string, data []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(strconv.FormatUint(txnr, 10))
+	b.WriteString(" ")
+	b.WriteString(command)
+	b.WriteString(" ")
+	b.WriteString(strconv.Itoa(len(data)))
+	if len(data) > 0 {
+		b.WriteString(" ")
+		b.Write(data)
+	}
+	b.WriteString("\n")
+	return b.Bytes()
+}
+
+// Read a RELP frame, as sent by either side.
+func readRELPFrame(br *bufio.Reader) (uint64, string, []byte, error) {
+	t, err := br.ReadString(' ')
+	if err != nil {
+		return 0, "", nil, err
+	}
+	txnr, err := strconv.ParseUint(t[:len(t)-1], 10, 64)
+	if err != nil {
+		return 0, "", nil, fmt.Errorf("Invalid RELP transaction number %q", t)
+	}
+
+	command, err := br.ReadString(' ')
+	if err != nil {
+		return 0, "", nil, unexpectedEOF(err)
+	}
+	command = command[:len(command)-1]
+
+	var l []byte
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return 0, "", nil, unexpectedEOF(err)
+		}
+		if c == ' ' || c == '\n' {
+			if c == '\n' {
+				br.UnreadByte()
+			}
+			break
+		}
+		l = append(l, c)
+	}
+	n, err := strconv.Atoi(string(l))
+	if err != nil || n < 0 || n > maxRELPFrameLength {
+		return 0, "", nil, fmt.Errorf("Invalid RELP data length %q", l)
+	}
+
+	data := make([]byte, n+1)
+	if _, err := io.ReadFull(br, data); err != nil {
+		return 0, "", nil, unexpectedEOF(err)
+	}
+	if data[n] != '\n' {
+		return 0, "", nil, errors.New("Missing RELP frame trailer")
+	}
+	return txnr, command, data[:n], nil
+}
+
+// Return the message of the first octet-counted frame in b and the length of
+// the whole frame.
+func nextFrame(b []byte) ([]byte, int, error) {
+	sp := bytes.IndexByte(b, ' ')
+	if sp <= 0 {
+		return nil, 0, errors.New("Malformed frame length")
+	}
+	n, err := strconv.Atoi(string(b[:sp]))
+	if err != nil || n < 0 || sp+1+n > len(b) {
+		return nil, 0, fmt.Errorf("Malformed frame length %q", b[:sp])
+	}
+	return b[sp+1 : sp+1+n], sp + 1 + n, nil
+}
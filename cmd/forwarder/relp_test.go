@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRELPServer acknowledges syslog commands, optionally dropping the first
+// connection without acknowledging anything after ackLimit messages.
+type fakeRELPServer struct {
+	ln       net.Listener
+	ackLimit int
+	mu       sync.Mutex
+	conns    int
+	messages []string
+}
+
+func newFakeRELPServer(t *testing.T, ackLimit int) *fakeRELPServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRELPServer{ln: ln, ackLimit: ackLimit}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			first := s.conns == 1
+			s.mu.Unlock()
+			go s.serve(c, first)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRELPServer) serve(c net.Conn, first bool) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	acked := 0
+	for {
+		txnr, command, data, err := readRELPFrame(br)
+		if err != nil {
+			return
+		}
+		switch command {
+		case "open":
+			c.Write(encodeRELPFrame(txnr, "rsp", []byte("200 OK\nrelp_version=0\ncommands=syslog")))
+		case "syslog":
+			if first && s.ackLimit > 0 && acked == s.ackLimit {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, string(data))
+			s.mu.Unlock()
+			acked++
+			c.Write(encodeRELPFrame(txnr, "rsp", []byte("200 OK")))
+		case "close":
+			c.Write(encodeRELPFrame(txnr, "rsp", nil))
+			return
+		}
+	}
+}
+
+func (s *fakeRELPServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.messages...)
+}
+
+func testRELPForwarder(t *testing.T, addr string, window int) *forwarder {
+	config := *getConfig()
+	config.ForwardProtocol = forwardProtocolRELP
+	config.ForwardRELPWindow = window
+	config.ForwardRELPTimeout = time.Second
+	pool, err := newDestinationPool([]string{addr}, destinationPolicyFailover, config.MetricsRegistry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newForwarder(config, nil, pool, "", 0)
+}
+
+func TestForwarderRELP(t *testing.T) {
+	assert := assert.New(t)
+	s := newFakeRELPServer(t, 0)
+	defer s.ln.Close()
+
+	f := testRELPForwarder(t, s.ln.Addr().String(), 2)
+	f.write(NewPayload("", "", []byte("3 one3 two5 three")))
+
+	assert.Equal([]string{"one", "two", "three"}, s.received())
+	assert.Equal(int64(17), f.wBytes.Count())
+}
+
+func TestForwarderRELPRetransmitsUnacked(t *testing.T) {
+	assert := assert.New(t)
+	s := newFakeRELPServer(t, 2)
+	defer s.ln.Close()
+
+	f := testRELPForwarder(t, s.ln.Addr().String(), 1)
+	f.write(NewPayload("", "", []byte("3 one3 two5 three4 four")))
+
+	assert.Equal([]string{"one", "two", "three", "four"}, s.received(), "acknowledged frames shouldn't be sent again")
+	assert.Equal(int64(1), f.wErrors.Count())
+	s.mu.Lock()
+	assert.Equal(2, s.conns)
+	s.mu.Unlock()
+}
+
+func TestRELPFrameRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	tests := map[string]struct {
+		command string
+		data    string
+		encoded string
+	}{
+		"with data":    {command: "syslog", data: "<13>1 - - - - - hi", encoded: "7 syslog 18 <13>1 - - - - - hi\n"},
+		"without data": {command: "close", data: "", encoded: "7 close 0\n"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			b := encodeRELPFrame(7, test.command, []byte(test.data))
+			assert.Equal(test.encoded, string(b))
+
+			txnr, command, data, err := readRELPFrame(bufio.NewReader(bytes.NewReader(b)))
+			assert.NoError(err)
+			assert.Equal(uint64(7), txnr)
+			assert.Equal(test.command, command)
+			assert.Equal(test.data, string(data))
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sync"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+const defaultRoute = "default"
+
+// routeConfig is the routing table, read as JSON from LOG_ISS_ROUTES. For
+// example:
+//
+//  {
+//    "destinations": {"audit": {"dest": ["audit-1:601", "audit-2:601"], "policy": "failover"}},
+//    "rules": [{"name": "audit-apps", "match": {"app_name": ["audit*"]}, "destination": "audit"}]
+//  }
+//
+// Rules are evaluated in order and the first match wins. Frames matching no
+// rule go to the default destination, FORWARD_DEST. Destinations may set the
+// "format" and "framing" frames are forwarded in, as FORWARD_FORMAT and
+// FORWARD_FRAMING do for the default destination.
+type routeConfig struct {
+	Destinations map[string]routeDestination `json:"destinations"`
+	Rules        []routeRule                 `json:"rules"`
+}
+
+type routeDestination struct {
+	Dest    []string `json:"dest"`
+	Policy  string   `json:"policy"`
+	Format  string   `json:"format"`
+	Framing string   `json:"framing"`
+}
+
+type routeRule struct {
+	Name        string     `json:"name"`
+	Match       routeMatch `json:"match"`
+	Destination string     `json:"destination"`
+}
+
+// routeMatch holds the conditions of a rule, all of which must match. String
+// values are shell patterns as accepted by path.Match; any of the listed
+// values may match.
+type routeMatch struct {
+	Credential []string            `json:"credential"`
+	DrainToken []string            `json:"drain_token"`
+	AppName    []string            `json:"app_name"`
+	Hostname   []string            `json:"hostname"`
+	Severity   []int               `json:"severity"`
+	Query      map[string][]string `json:"query"`
+}
+
+// Whether the rule needs to look at individual frames rather than just the
+// request.
+func (m *routeMatch) perFrame() bool {
+	return len(m.AppName) > 0 || len(m.Hostname) > 0 || len(m.Severity) > 0
+}
+
+func (m *routeMatch) matchesSource(src *payloadSource) bool {
+	if len(m.Credential) > 0 {
+		if src.Credential == nil || !matchAny(m.Credential, src.Credential.Name) {
+			return false
+		}
+	}
+	if len(m.DrainToken) > 0 && !matchAny(m.DrainToken, src.DrainToken) {
+		return false
+	}
+	for k, patterns := range m.Query {
+		if !matchAny(patterns, src.Query.Get(k)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *routeMatch) matchesFrame(f *routedFrame) bool {
+	if len(m.AppName) > 0 && !matchAny(m.AppName, f.appName) {
+		return false
+	}
+	if len(m.Hostname) > 0 && !matchAny(m.Hostname, f.hostname) {
+		return false
+	}
+	if len(m.Severity) > 0 && !containsInt(m.Severity, f.severity) {
+		return false
+	}
+	return true
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// routedFrame is a single octet-counted frame from a payload body, along with
+// the header fields rules can match on.
+type routedFrame struct {
+	raw      []byte
+	hostname string
+	appName  string
+	severity int
+}
+
+// router is a deliverer choosing a forwarderSet for each frame of a payload
+// according to the routing table.
+type router struct {
+	rules    []routeRule
+	perFrame bool
+	sets     map[string]deliverer
+	runners  []*forwarderSet
+	dedup    dedupStore                 // remembers the parts of payloads delivered to each destination
+	frames   map[string]metrics.Counter // counts frames routed to each destination
+}
+
+func newRouter(config IssConfig, defaultSet *forwarderSet, dedup dedupStore) (*router, error) {
+	r := &router{
+		dedup:   dedup,
+		sets:    map[string]deliverer{defaultRoute: defaultSet},
+		runners: []*forwarderSet{defaultSet},
+		frames:  map[string]metrics.Counter{defaultRoute: metrics.GetOrRegisterCounter("log-iss.router.default.frames", config.MetricsRegistry)},
+	}
+
+	if config.Routes == "" {
+		return r, nil
+	}
+
+	var rc routeConfig
+	if err := json.Unmarshal([]byte(config.Routes), &rc); err != nil {
+		return nil, fmt.Errorf("Unable to parse LOG_ISS_ROUTES: %s", err)
+	}
+
+	for name, d := range rc.Destinations {
+		if name == defaultRoute {
+			return nil, fmt.Errorf("Destination name %q is reserved", defaultRoute)
+		}
+		policy := d.Policy
+		if policy == "" {
+			policy = destinationPolicyFailover
+		}
+		enc, err := newEncoder(d.Format, d.Framing)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create destination %q: %s", name, err)
+		}
+		fs, err := newForwarderSet(name, config, d.Dest, policy, enc)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create destination %q: %s", name, err)
+		}
+		r.sets[name] = fs
+		r.runners = append(r.runners, fs)
+		r.frames[name] = metrics.GetOrRegisterCounter("log-iss.router."+name+".frames", config.MetricsRegistry)
+	}
+
+	for _, rule := range rc.Rules {
+		if _, ok := r.sets[rule.Destination]; !ok {
+			return nil, fmt.Errorf("Rule %q routes to unknown destination %q", rule.Name, rule.Destination)
+		}
+		r.perFrame = r.perFrame || rule.Match.perFrame()
+	}
+	r.rules = rc.Rules
+
+	return r, nil
+}
+
+// Run starts the forwarders of every destination.
+func (r *router) Run() {
+	for _, fs := range r.runners {
+		fs.Run()
+	}
+}
+
+// Deliver splits p between destinations and waits for every part to be
+// delivered, returning the first error encountered. Parts delivered before the
+// error aren't retracted, but if p has a DedupKey, they're remembered so a
+// retry only delivers the parts that failed.
+func (r *router) Deliver(p payload) error {
+	if len(r.rules) == 0 {
+		return r.sets[defaultRoute].Deliver(p)
+	}
+
+	// Evaluate request level conditions once for the whole payload.
+	candidates := make([]*routeRule, 0, len(r.rules))
+	for i := range r.rules {
+		if r.rules[i].Match.matchesSource(&p.Source) {
+			candidates = append(candidates, &r.rules[i])
+		}
+	}
+
+	if !r.perFrame {
+		dest := defaultRoute
+		if len(candidates) > 0 {
+			dest = candidates[0].Destination
+		}
+		return r.deliverTo(dest, p)
+	}
+
+	bodies := make(map[string]*bytes.Buffer)
+	counts := make(map[string]int64)
+	order := []string{}
+	err := eachFrame(p.Body, func(f *routedFrame) {
+		dest := defaultRoute
+		for _, rule := range candidates {
+			if rule.Match.matchesFrame(f) {
+				dest = rule.Destination
+				break
+			}
+		}
+		b, ok := bodies[dest]
+		if !ok {
+			b = &bytes.Buffer{}
+			bodies[dest] = b
+			order = append(order, dest)
+		}
+		b.Write(f.raw)
+		counts[dest]++
+	})
+	if err != nil {
+		return err
+	}
+	for dest, n := range counts {
+		r.frames[dest].Inc(n)
+	}
+
+	if len(order) == 1 {
+		return r.sets[order[0]].Deliver(p)
+	}
+
+	// Don't deliver any part if one would be shed, so retrying the request
+	// doesn't duplicate the others.
+	for _, dest := range order {
+		if sc, ok := r.sets[dest].(saturationChecker); ok && !p.Admitted {
+			if err := sc.saturated(); err != nil {
+				return err
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(order))
+	for i, dest := range order {
+		var key string
+		if r.dedup != nil && p.DedupKey != "" {
+			key = p.DedupKey + "/" + dest
+			if !r.dedup.Claim(key) {
+				continue
+			}
+		}
+
+		wg.Add(1)
+		part := NewPayload(p.SourceAddr, p.RequestID, bodies[dest].Bytes())
+		part.Source = p.Source
+		part.Context = p.Context
+		part.Frames = counts[dest]
+		part.Admitted = p.Admitted
+		go func(i int, dest string, part payload) {
+			defer wg.Done()
+			if errs[i] = r.sets[dest].Deliver(part); errs[i] != nil && key != "" {
+				r.dedup.Release(key)
+			}
+		}(i, dest, part)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saturated reports whether any destination is saturated.
+func (r *router) saturated() error {
+	for _, d := range r.sets {
+		if sc, ok := d.(saturationChecker); ok {
+			if err := sc.saturated(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *router) deliverTo(dest string, p payload) error {
+	r.frames[dest].Inc(p.Frames)
+	return r.sets[dest].Deliver(p)
+}
+
+// Call fn with each octet-counted frame in body.
+func eachFrame(body []byte, fn func(*routedFrame)) error {
+	for len(body) > 0 {
+		msg, n, err := nextFrame(body)
+		if err != nil {
+			return err
+		}
+
+		f := routedFrame{raw: body[:n], severity: -1}
+		if header, _, ok := splitSyslogHeader(msg); ok {
+			fields := bytes.Fields(header)
+			f.hostname = string(fields[2])
+			f.appName = string(fields[3])
+			f.severity = prioritySeverity(fields[0])
+		}
+		fn(&f)
+
+		body = body[n:]
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	routeWebFrame   = "84 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"1.2.3.4\"] hi\n"
+	routeAuditFrame = "90 <10>1 2013-06-07T13:17:49.468822+00:00 host audit-log web.7 - [origin ip=\"1.2.3.4\"] login\n"
+)
+
+func testRouter(t *testing.T, routes string) (*router, map[string]*recordingDeliverer) {
+	config := *getConfig()
+	config.Routes = routes
+
+	fs, err := newForwarderSet("", config, config.ForwardDest, config.ForwardDestPolicy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newRouter(config, fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorders := make(map[string]*recordingDeliverer)
+	for name := range r.sets {
+		recorders[name] = &recordingDeliverer{}
+		r.sets[name] = recorders[name]
+	}
+	return r, recorders
+}
+
+func TestRouterPerFrame(t *testing.T) {
+	assert := assert.New(t)
+	r, rec := testRouter(t, `{
+		"destinations": {"audit": {"dest": ["127.0.0.1:6001"]}},
+		"rules": [{"name": "audit", "match": {"app_name": ["audit-*"], "severity": [0, 1, 2, 3]}, "destination": "audit"}]
+	}`)
+
+	p := NewPayload("1.2.3.4", "req", []byte(routeWebFrame+routeAuditFrame+routeWebFrame))
+	assert.NoError(r.Deliver(p))
+
+	assert.Equal(routeWebFrame+routeWebFrame, rec["default"].bodies())
+	assert.Equal(routeAuditFrame, rec["audit"].bodies())
+	assert.Equal(int64(2), r.frames["default"].Count())
+	assert.Equal(int64(1), r.frames["audit"].Count())
+}
+
+func TestRouterRetriesOnlyFailedParts(t *testing.T) {
+	assert := assert.New(t)
+	r, rec := testRouter(t, `{
+		"destinations": {"audit": {"dest": ["127.0.0.1:6001"]}},
+		"rules": [{"name": "audit", "match": {"app_name": ["audit-*"]}, "destination": "audit"}]
+	}`)
+	audit := &flakyDeliverer{fail: map[int]bool{1: true}}
+	r.sets["audit"] = audit
+	r.dedup = newLocalDedupStore(100, time.Minute)
+
+	p := NewPayload("1.2.3.4", "req", []byte(routeWebFrame+routeAuditFrame))
+	p.DedupKey = "user/token/frame-1/0"
+	assert.Error(r.Deliver(p))
+	assert.NoError(r.Deliver(p))
+
+	assert.Equal(routeWebFrame, rec["default"].bodies(), "parts already delivered aren't delivered again")
+	assert.Equal(routeAuditFrame, audit.bodies())
+}
+
+func TestRouterPerRequest(t *testing.T) {
+	r, rec := testRouter(t, `{
+		"destinations": {"splunk": {"dest": ["127.0.0.1:6001", "127.0.0.1:6002"], "policy": "round-robin"}},
+		"rules": [
+			{"name": "token", "match": {"drain_token": ["d.secure-*"]}, "destination": "splunk"},
+			{"name": "index", "match": {"credential": ["audit"], "query": {"index": ["security"]}}, "destination": "splunk"}
+		]
+	}`)
+
+	tests := map[string]struct {
+		source   payloadSource
+		expected string
+	}{
+		"no match": {
+			source:   payloadSource{DrainToken: "d.other"},
+			expected: "default",
+		},
+		"drain token": {
+			source:   payloadSource{DrainToken: "d.secure-123"},
+			expected: "splunk",
+		},
+		"credential and query": {
+			source:   payloadSource{Credential: &credential{Name: "audit"}, Query: url.Values{"index": {"security"}}},
+			expected: "splunk",
+		},
+		"credential without query": {
+			source:   payloadSource{Credential: &credential{Name: "audit"}, Query: url.Values{"index": {"main"}}},
+			expected: "default",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			for _, d := range rec {
+				d.payloads = nil
+			}
+			frames := r.frames[test.expected].Count()
+			p := NewPayload("1.2.3.4", "req", []byte(routeWebFrame))
+			p.Frames = 1
+			p.Source = test.source
+			assert.NoError(t, r.Deliver(p))
+			assert.Equal(t, routeWebFrame, rec[test.expected].bodies())
+			assert.Equal(t, frames+1, r.frames[test.expected].Count())
+		})
+	}
+}
+
+func TestNewRouterValidation(t *testing.T) {
+	tests := map[string]string{
+		"invalid json":          `{`,
+		"reserved name":         `{"destinations": {"default": {"dest": ["127.0.0.1:6001"]}}}`,
+		"unknown destination":   `{"rules": [{"name": "x", "destination": "nowhere"}]}`,
+		"destination with none": `{"destinations": {"empty": {"dest": []}}}`,
+		"unknown policy":        `{"destinations": {"x": {"dest": ["127.0.0.1:6001"], "policy": "random"}}}`,
+	}
+
+	for name, routes := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := *getConfig()
+			config.Routes = routes
+			fs, err := newForwarderSet("", config, config.ForwardDest, config.ForwardDestPolicy, nil)
+			assert.NoError(t, err)
+			_, err = newRouter(config, fs, nil)
+			assert.Error(t, err)
+		})
+	}
+}
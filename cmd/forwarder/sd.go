@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// RFC5424 limits SD-IDs and PARAM-NAMEs to 32 characters.
+const maxSDNameLength = 32
+
+// Escapes the characters RFC5424 requires to be escaped in PARAM-VALUE.
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// sdElement is an RFC5424 SD-ELEMENT.
+type sdElement struct {
+	ID     string
+	Params []sdParam
+}
+
+type sdParam struct {
+	Name  string
+	Value string
+}
+
+func (e *sdElement) Add(name, value string) {
+	e.Params = append(e.Params, sdParam{Name: name, Value: value})
+}
+
+// Validate checks the SD-ID and PARAM-NAMEs are valid SD-NAMEs.
+func (e *sdElement) Validate() error {
+	if !validSDName(e.ID) {
+		return fmt.Errorf("Invalid SD-ID %q", e.ID)
+	}
+	for _, p := range e.Params {
+		if !validSDName(p.Name) {
+			return fmt.Errorf("Invalid PARAM-NAME %q in SD-ID %q", p.Name, e.ID)
+		}
+	}
+	return nil
+}
+
+// Write the element to b, escaping PARAM-VALUEs unless legacy is set.
+func (e *sdElement) Write(b *bytes.Buffer, legacy bool) {
+	b.WriteString("[")
+	b.WriteString(e.ID)
+	for _, p := range e.Params {
+		b.WriteString(" ")
+		b.WriteString(p.Name)
+		b.WriteString(`="`)
+		if legacy {
+			b.WriteString(p.Value)
+		} else {
+			sdEscaper.WriteString(b, p.Value)
+		}
+		b.WriteString(`"`)
+	}
+	b.WriteString("]")
+}
+
+// An SD-NAME is 1 to 32 printable US-ASCII characters other than '=', SP,
+// ']' and '"'.
+func validSDName(s string) bool {
+	if len(s) == 0 || len(s) > maxSDNameLength {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 33 || c > 126 || c == '=' || c == ']' || c == '"' {
+			return false
+		}
+	}
+	return true
+}
+
+// Scan the SD-ELEMENT at the start of b, returning its SD-ID and length.
+func scanSDElement(b []byte) ([]byte, int, bool) {
+	if len(b) == 0 || b[0] != '[' {
+		return nil, 0, false
+	}
+
+	i := 1
+	for i < len(b) && b[i] != ' ' && b[i] != ']' {
+		i++
+	}
+	id := b[1:i]
+	if !validSDName(string(id)) {
+		return nil, 0, false
+	}
+
+	for i < len(b) && b[i] == ' ' {
+		start := i + 1
+		i = start
+		for i < len(b) && b[i] != '=' {
+			i++
+		}
+		if i+1 >= len(b) || !validSDName(string(b[start:i])) || b[i+1] != '"' {
+			return nil, 0, false
+		}
+
+		// PARAM-VALUE, in which '"', '\' and ']' may be escaped.
+		for i += 2; i < len(b) && b[i] != '"'; i++ {
+			if b[i] == '\\' {
+				i++
+			}
+		}
+		if i >= len(b) {
+			return nil, 0, false
+		}
+		i++
+	}
+
+	if i >= len(b) || b[i] != ']' {
+		return nil, 0, false
+	}
+	return id, i + 1, true
+}
+
+// Size returns the length of the element as written with legacy set, which is
+// the shortest it can be.
+func (e *sdElement) Size() int {
+	n := len(e.ID) + 2
+	for _, p := range e.Params {
+		n += len(p.Name) + len(p.Value) + 4
+	}
+	return n
+}
+
+// Parse an SD-ELEMENT found by scanSDElement, unescaping its PARAM-VALUEs.
+func parseSDElement(b []byte) sdElement {
+	b = b[1 : len(b)-1]
+	i := 0
+	for i < len(b) && b[i] != ' ' {
+		i++
+	}
+	e := sdElement{ID: string(b[:i])}
+
+	for i < len(b) {
+		start := i + 1
+		eq := start + bytes.IndexByte(b[start:], '=')
+		var value bytes.Buffer
+		for i = eq + 2; b[i] != '"'; i++ {
+			if b[i] == '\\' && (b[i+1] == '"' || b[i+1] == '\\' || b[i+1] == ']') {
+				i++
+			}
+			value.WriteByte(b[i])
+		}
+		e.Add(string(b[start:eq]), value.String())
+		i++
+	}
+	return e
+}
+
+// Split the STRUCTURED-DATA at the start of b, which holds everything after
+// the MSGID, into its SD-ELEMENTs and the MSG that follows. If b doesn't start
+// with valid STRUCTURED-DATA, all of it is considered MSG.
+func splitStructuredData(b []byte) ([][]byte, [][]byte, []byte) {
+	return appendStructuredData(nil, nil, b)
+}
+
+// appendStructuredData is like splitStructuredData, but appends the
+// SD-ELEMENTs and their SD-IDs to elements and ids so their storage can be
+// reused.
+func appendStructuredData(elements, ids [][]byte, b []byte) ([][]byte, [][]byte, []byte) {
+	elements, ids = elements[:0], ids[:0]
+	if len(b) > 0 && b[0] == '-' && (len(b) == 1 || b[1] == ' ') {
+		if len(b) == 1 {
+			return elements, ids, nil
+		}
+		return elements, ids, b[2:]
+	}
+
+	rest := b
+	for len(rest) > 0 && rest[0] == '[' {
+		id, n, ok := scanSDElement(rest)
+		if !ok {
+			return elements[:0], ids[:0], b
+		}
+		elements = append(elements, rest[:n])
+		ids = append(ids, id)
+		rest = rest[n:]
+	}
+
+	switch {
+	case len(elements) == 0:
+		return elements, ids, b
+	case len(rest) == 0:
+		return elements, ids, nil
+	case rest[0] != ' ':
+		return elements[:0], ids[:0], b
+	}
+	return elements, ids, rest[1:]
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidSDName(t *testing.T) {
+	tests := map[string]bool{
+		"origin":                true,
+		"metadata@123":          true,
+		strings.Repeat("a", 32): true,
+		"":                      false,
+		strings.Repeat("a", 33): false,
+		"with space":            false,
+		"a=b":                   false,
+		"a]":                    false,
+		`a"`:                    false,
+		"café":                  false,
+	}
+
+	for name, valid := range tests {
+		assert.Equal(t, valid, validSDName(name), name)
+	}
+}
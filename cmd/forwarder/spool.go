@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	metrics "github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	spoolPolicyReject     = "reject"
+	spoolPolicyDropOldest = "drop-oldest"
+
+	spoolSegmentSuffix  = ".seg"
+	spoolCheckpointFile = "checkpoint"
+
+	// Each record is prefixed by its length and CRC32, both big endian uint32.
+	spoolRecordHeaderLength = 8
+)
+
+var errSpoolFull = errors.New("Spool is full")
+
+// spoolEntry is a payload read back from the spool, along with the position
+// just past its record, which becomes the checkpoint once it's delivered.
+type spoolEntry struct {
+	payload payload
+	segment int64
+	offset  int64
+}
+
+// spool is a write-ahead log of accepted payloads, split into segment files.
+// Payloads are fsynced before Append returns, read back in order by Next, and
+// segments are removed once a Commit moves the checkpoint past them.
+type spool struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+	policy       string
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	segments []int64         // ids of segments on disk, oldest first
+	sizes    map[int64]int64 // size of each segment on disk
+	size     int64           // total size of all segments
+	w        spoolFile       // segment being appended to
+	wID      int64
+	rID      int64 // read position
+	rOff     int64
+	ckID     int64 // last committed position
+	ckOff    int64
+
+	bytes    metrics.Gauge   // tracks the number of bytes on disk
+	appends  metrics.Counter // counts payloads appended
+	rejected metrics.Counter // counts payloads rejected because the spool was full
+	dropped  metrics.Counter // counts undelivered bytes dropped to make room
+	corrupt  metrics.Counter // counts corrupt records skipped
+}
+
+// openSpool opens, or creates, the spool in dir. Anything appended but not
+// committed before the previous process exited will be returned by Next.
+func openSpool(dir string, maxBytes int64, segmentBytes int64, policy string, me string, registry metrics.Registry) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &spool{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		segmentBytes: segmentBytes,
+		policy:       policy,
+		sizes:        make(map[int64]int64),
+		bytes:        metrics.GetOrRegisterGauge(me+".bytes", registry),
+		appends:      metrics.GetOrRegisterCounter(me+".appends", registry),
+		rejected:     metrics.GetOrRegisterCounter(me+".rejected", registry),
+		dropped:      metrics.GetOrRegisterCounter(me+".dropped_bytes", registry),
+		corrupt:      metrics.GetOrRegisterCounter(me+".corrupt", registry),
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *spool) segmentPath(id int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, spoolSegmentSuffix))
+}
+
+// Load the segments and checkpoint from disk, truncating a partially written
+// record at the end of the newest segment.
+func (s *spool) load() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), spoolSegmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(f.Name(), spoolSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, id)
+		s.sizes[id] = f.Size()
+		s.size += f.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	if b, err := ioutil.ReadFile(filepath.Join(s.dir, spoolCheckpointFile)); err == nil {
+		if _, err := fmt.Sscanf(string(b), "%d %d", &s.ckID, &s.ckOff); err != nil {
+			return fmt.Errorf("Unable to parse spool checkpoint: %s", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// Segments older than the checkpoint were fully delivered.
+	for len(s.segments) > 0 && s.segments[0] < s.ckID {
+		s.removeOldest()
+	}
+
+	if len(s.segments) == 0 {
+		s.segments = []int64{s.ckID}
+		s.sizes[s.ckID] = 0
+	}
+	s.wID = s.segments[len(s.segments)-1]
+
+	valid, err := s.validLength(s.wID)
+	if err != nil {
+		return err
+	}
+	if valid != s.sizes[s.wID] {
+		log.WithFields(log.Fields{"ns": "spool", "at": "truncate", "segment": s.wID, "offset": valid}).Warn()
+	}
+	s.w, err = os.OpenFile(s.segmentPath(s.wID), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+	if err := s.w.Truncate(valid); err != nil {
+		return err
+	}
+	if _, err := s.w.Seek(valid, io.SeekStart); err != nil {
+		return err
+	}
+	s.size -= s.sizes[s.wID] - valid
+	s.sizes[s.wID] = valid
+
+	s.rID, s.rOff = s.segments[0], 0
+	if s.rID == s.ckID {
+		s.rOff = s.ckOff
+	}
+
+	s.bytes.Update(s.size)
+
+	log.WithFields(log.Fields{"ns": "spool", "at": "open", "segments": len(s.segments), "bytes": s.size, "segment": s.rID, "offset": s.rOff}).Info()
+	return nil
+}
+
+// Return the length of the longest prefix of the segment made of intact records.
+func (s *spool) validLength(id int64) (int64, error) {
+	f, err := os.Open(s.segmentPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	var off int64
+	for {
+		_, n, err := readSpoolRecord(f, off)
+		if err != nil {
+			return off, nil
+		}
+		off += n
+	}
+}
+
+// Append writes p to the spool and fsyncs it. If the spool is full, the oldest
+// undelivered payloads are dropped or errSpoolFull returned depending on the
+// policy.
+func (s *spool) Append(p payload) error {
+	record := encodeSpoolRecord(p)
+	n := int64(len(record))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.size+n > s.maxBytes {
+		if s.policy != spoolPolicyDropOldest || len(s.segments) < 2 {
+			s.rejected.Inc(1)
+			return errSpoolFull
+		}
+		s.dropOldest()
+	}
+
+	if s.sizes[s.wID] > 0 && s.sizes[s.wID]+n > s.segmentBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.w.Write(record); err != nil {
+		s.rollback()
+		return err
+	}
+	if err := s.w.Sync(); err != nil {
+		s.rollback()
+		return err
+	}
+
+	s.sizes[s.wID] += n
+	s.size += n
+	s.bytes.Update(s.size)
+	s.appends.Inc(1)
+	s.cond.Broadcast()
+	return nil
+}
+
+// Discard whatever part of a record a failed Append wrote, so the next record
+// follows the last intact one. Callers must hold s.mu.
+func (s *spool) rollback() {
+	size := s.sizes[s.wID]
+	if err := s.w.Truncate(size); err != nil {
+		log.WithFields(log.Fields{"ns": "spool", "at": "rollback", "segment": s.wID, "message": err}).Error()
+	}
+	if _, err := s.w.Seek(size, io.SeekStart); err != nil {
+		log.WithFields(log.Fields{"ns": "spool", "at": "rollback", "segment": s.wID, "message": err}).Error()
+	}
+}
+
+// Start a new segment for writing. Callers must hold s.mu.
+func (s *spool) rotate() error {
+	id := s.wID + 1
+	w, err := os.OpenFile(s.segmentPath(id), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	// Without syncing the directory, the new segment and the payloads about
+	// to be acknowledged from it could disappear after a crash.
+	if err := syncDir(s.dir); err != nil {
+		w.Close()
+		return err
+	}
+	s.w.Close()
+	s.w = w
+	s.wID = id
+	s.segments = append(s.segments, id)
+	s.sizes[id] = 0
+	return nil
+}
+
+// Drop the oldest segment whether or not it has been delivered. Callers must
+// hold s.mu.
+func (s *spool) dropOldest() {
+	id := s.segments[0]
+	undelivered := s.sizes[id]
+	if id == s.rID {
+		undelivered -= s.rOff
+	} else if id < s.rID {
+		undelivered = 0
+	}
+	s.dropped.Inc(undelivered)
+	log.WithFields(log.Fields{"ns": "spool", "at": "drop-oldest", "segment": id, "bytes": undelivered}).Warn()
+
+	s.removeOldest()
+	if s.rID <= id {
+		s.rID, s.rOff = s.segments[0], 0
+	}
+}
+
+// Remove the oldest segment from disk. Callers must hold s.mu.
+func (s *spool) removeOldest() {
+	id := s.segments[0]
+	if err := os.Remove(s.segmentPath(id)); err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{"ns": "spool", "at": "remove", "segment": id, "message": err}).Error()
+	}
+	s.size -= s.sizes[id]
+	delete(s.sizes, id)
+	s.segments = s.segments[1:]
+	s.bytes.Update(s.size)
+}
+
+// Next blocks until a payload is available and returns it. Payloads are
+// returned in the order they were appended.
+func (s *spool) Next() (spoolEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		for s.rID == s.wID && s.rOff >= s.sizes[s.wID] {
+			s.cond.Wait()
+		}
+
+		if s.rOff >= s.sizes[s.rID] {
+			s.rID, s.rOff = s.nextSegment(s.rID), 0
+			continue
+		}
+
+		f, err := os.Open(s.segmentPath(s.rID))
+		if err != nil {
+			return spoolEntry{}, err
+		}
+		p, n, err := readSpoolRecord(f, s.rOff)
+		f.Close()
+		if err != nil {
+			// Skip the rest of a corrupt segment rather than wedge delivery.
+			s.corrupt.Inc(1)
+			log.WithFields(log.Fields{"ns": "spool", "at": "corrupt", "segment": s.rID, "offset": s.rOff, "message": err}).Error()
+			if s.rID == s.wID {
+				s.rOff = s.sizes[s.rID]
+			} else {
+				s.rID, s.rOff = s.nextSegment(s.rID), 0
+			}
+			continue
+		}
+
+		s.rOff += n
+		return spoolEntry{payload: p, segment: s.rID, offset: s.rOff}, nil
+	}
+}
+
+// Return the id of the segment following id. Callers must hold s.mu.
+func (s *spool) nextSegment(id int64) int64 {
+	for _, next := range s.segments {
+		if next > id {
+			return next
+		}
+	}
+	return s.wID
+}
+
+// Commit records that e, and everything appended before it, has been
+// delivered. Fully delivered segments are removed.
+func (s *spool) Commit(e spoolEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ckID, s.ckOff = e.segment, e.offset
+	for len(s.segments) > 1 && s.segments[0] < s.ckID {
+		s.removeOldest()
+	}
+
+	tmp := filepath.Join(s.dir, spoolCheckpointFile+".tmp")
+	if err := writeFileSync(tmp, []byte(fmt.Sprintf("%d %d\n", s.ckID, s.ckOff))); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, spoolCheckpointFile)); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// Write b to a new file named name and fsync it.
+func writeFileSync(name string, b []byte) error {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Fsync dir, making files created in or renamed into it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// spoolFile is the segment being appended to, an *os.File.
+type spoolFile interface {
+	io.WriteCloser
+	io.Seeker
+	Sync() error
+	Truncate(size int64) error
+}
+
+// Encode a payload as a record: length, CRC32, then the request id, source
+// address and body, each prefixed by their uvarint length.
+func encodeSpoolRecord(p payload) []byte {
+	var data bytes.Buffer
+	for _, f := range [][]byte{[]byte(p.RequestID), []byte(p.SourceAddr), p.Body} {
+		var l [binary.MaxVarintLen64]byte
+		data.Write(l[:binary.PutUvarint(l[:], uint64(len(f)))])
+		data.Write(f)
+	}
+
+	record := make([]byte, spoolRecordHeaderLength, spoolRecordHeaderLength+data.Len())
+	binary.BigEndian.PutUint32(record[0:4], uint32(data.Len()))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data.Bytes()))
+	return append(record, data.Bytes()...)
+}
+
+// Read the record at off, returning the payload and the length of the record.
+func readSpoolRecord(r io.ReaderAt, off int64) (payload, int64, error) {
+	var header [spoolRecordHeaderLength]byte
+	if _, err := r.ReadAt(header[:], off); err != nil {
+		return payload{}, 0, err
+	}
+
+	data := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	if _, err := r.ReadAt(data, off+spoolRecordHeaderLength); err != nil {
+		return payload{}, 0, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return payload{}, 0, errors.New("Spool record checksum mismatch")
+	}
+
+	var fields [3][]byte
+	rest := data
+	for i := range fields {
+		l, n := binary.Uvarint(rest)
+		if n <= 0 || uint64(len(rest)-n) < l {
+			return payload{}, 0, errors.New("Malformed spool record")
+		}
+		fields[i] = rest[n : n+int(l)]
+		rest = rest[n+int(l):]
+	}
+
+	return NewPayload(string(fields[1]), string(fields[0]), fields[2]), int64(spoolRecordHeaderLength + len(data)), nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func tempSpool(t *testing.T, maxBytes int64, segmentBytes int64, policy string) (*spool, string) {
+	dir, err := ioutil.TempDir("", "log-iss-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := openSpool(dir, maxBytes, segmentBytes, policy, "log-iss.spool", metrics.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+func TestSpoolAppendNextCommit(t *testing.T) {
+	assert := assert.New(t)
+	s, dir := tempSpool(t, 1<<20, 100, spoolPolicyReject)
+	defer os.RemoveAll(dir)
+
+	bodies := []string{"one", "two", "three", "four", "five", "six", "seven", "eight", "nine", "ten"}
+	for i, b := range bodies {
+		assert.NoError(s.Append(NewPayload("1.2.3.4", string(rune('a'+i)), []byte(b))))
+	}
+	assert.True(len(s.segments) > 1, "expected segments to rotate")
+
+	for i, b := range bodies {
+		e, err := s.Next()
+		assert.NoError(err)
+		assert.Equal(b, string(e.payload.Body))
+		assert.Equal("1.2.3.4", e.payload.SourceAddr)
+		assert.Equal(string(rune('a'+i)), e.payload.RequestID)
+		assert.NoError(s.Commit(e))
+	}
+
+	assert.Equal(1, len(s.segments), "delivered segments should be removed")
+}
+
+// shortSpoolFile writes half of the next record before failing.
+type shortSpoolFile struct {
+	spoolFile
+}
+
+func (f *shortSpoolFile) Write(b []byte) (int, error) {
+	n, _ := f.spoolFile.Write(b[:len(b)/2])
+	return n, errors.New("No space left on device")
+}
+
+func TestSpoolAppendFailureIsRolledBack(t *testing.T) {
+	assert := assert.New(t)
+	s, dir := tempSpool(t, 1<<20, 1<<20, spoolPolicyReject)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(s.Append(NewPayload("1.2.3.4", "a", []byte("one"))))
+	w := s.w
+	s.w = &shortSpoolFile{w}
+	assert.Error(s.Append(NewPayload("1.2.3.4", "b", []byte("two"))))
+	s.w = w
+	assert.NoError(s.Append(NewPayload("1.2.3.4", "c", []byte("three"))))
+
+	for _, b := range []string{"one", "three"} {
+		e, err := s.Next()
+		assert.NoError(err)
+		assert.Equal(b, string(e.payload.Body))
+		assert.NoError(s.Commit(e))
+	}
+
+	valid, err := s.validLength(s.wID)
+	assert.NoError(err)
+	assert.Equal(s.sizes[s.wID], valid, "the segment holds no partial record")
+}
+
+func TestSpoolReplayAfterRestart(t *testing.T) {
+	assert := assert.New(t)
+	s, dir := tempSpool(t, 1<<20, 1<<10, spoolPolicyReject)
+	defer os.RemoveAll(dir)
+
+	for _, b := range []string{"one", "two", "three"} {
+		assert.NoError(s.Append(NewPayload("", "", []byte(b))))
+	}
+	e, err := s.Next()
+	assert.NoError(err)
+	assert.NoError(s.Commit(e))
+	// Read but never committed, so it must be replayed.
+	_, err = s.Next()
+	assert.NoError(err)
+
+	// Simulate a crash part way through writing a record.
+	f, err := os.OpenFile(s.segmentPath(s.wID), os.O_APPEND|os.O_WRONLY, 0600)
+	assert.NoError(err)
+	f.Write(encodeSpoolRecord(NewPayload("", "", []byte("partial")))[:10])
+	f.Close()
+
+	s, err = openSpool(dir, 1<<20, 1<<10, spoolPolicyReject, "log-iss.spool", metrics.NewRegistry())
+	assert.NoError(err)
+
+	for _, b := range []string{"two", "three"} {
+		e, err := s.Next()
+		assert.NoError(err)
+		assert.Equal(b, string(e.payload.Body))
+	}
+
+	assert.NoError(s.Append(NewPayload("", "", []byte("four"))))
+	e, err = s.Next()
+	assert.NoError(err)
+	assert.Equal("four", string(e.payload.Body))
+}
+
+func TestSpoolFullPolicies(t *testing.T) {
+	assert := assert.New(t)
+	record := int64(len(encodeSpoolRecord(NewPayload("", "", []byte("0123456789")))))
+
+	s, dir := tempSpool(t, 4*record, 2*record, spoolPolicyReject)
+	defer os.RemoveAll(dir)
+	for i := 0; i < 4; i++ {
+		assert.NoError(s.Append(NewPayload("", "", []byte("0123456789"))))
+	}
+	assert.Equal(errSpoolFull, s.Append(NewPayload("", "", []byte("0123456789"))))
+
+	s, dir = tempSpool(t, 4*record, 2*record, spoolPolicyDropOldest)
+	defer os.RemoveAll(dir)
+	for _, b := range []string{"aaaaaaaaaa", "bbbbbbbbbb", "cccccccccc", "dddddddddd", "eeeeeeeeee"} {
+		assert.NoError(s.Append(NewPayload("", "", []byte(b))))
+	}
+	for _, b := range []string{"cccccccccc", "dddddddddd", "eeeeeeeeee"} {
+		e, err := s.Next()
+		assert.NoError(err)
+		assert.Equal(b, string(e.payload.Body))
+	}
+	assert.Equal(2*record, s.dropped.Count())
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentSuffix))
+	assert.Equal(2, len(files))
+}
+
+func TestReadSpoolRecordChecksum(t *testing.T) {
+	assert := assert.New(t)
+
+	record := encodeSpoolRecord(NewPayload("1.2.3.4", "req", []byte("body")))
+	p, n, err := readSpoolRecord(bytes.NewReader(record), 0)
+	assert.NoError(err)
+	assert.Equal(int64(len(record)), n)
+	assert.Equal("body", string(p.Body))
+
+	record[len(record)-1] = 'x'
+	_, _, err = readSpoolRecord(bytes.NewReader(record), 0)
+	assert.Error(err)
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Largest syslog message accepted by the listeners. RFC5425 only requires
+	// 2048 octets, but logplex frames are routinely larger.
+	maxSyslogFrameLength = 64 * 1024
+
+	// Maximum number of frames handed to the FixerFunc at once.
+	maxSyslogBatchFrames = 500
+
+	// SD-ID of the structured data element carrying a listener's token, e.g.
+	// [auth token="secret"]. It must be the first element and is removed
+	// before the frame is forwarded.
+	syslogTokenSDID = "auth"
+
+	syslogCredentialStage = "syslog"
+)
+
+var errSyslogFrame = errors.New("Malformed syslog frame")
+
+// syslogListener describes one of the optional syslog ingest listeners.
+type syslogListener struct {
+	name      string
+	network   string
+	port      string
+	token     string
+	tlsConfig *tls.Config
+}
+
+// syslogServer accepts RFC5425/RFC6587 frames over TCP or TLS and RFC5426
+// datagrams over UDP, and delivers them exactly like POSTs to /logs.
+type syslogServer struct {
+	Config         IssConfig
+	FixerFunc      FixerFunc
+	shutdownCh     shutdownCh
+	deliverer      deliverer
+	isShuttingDown bool
+	listeners      []syslogListener
+	closers        map[io.Closer]struct{}
+	mu             sync.Mutex
+	connections    metrics.Counter // tracks the number of accepted connections
+	errors         metrics.Counter // tracks framing, fixing and delivery errors
+	malformed      metrics.Counter // tracks frames skipped by lenient parsing
+	dropped        metrics.Counter // tracks the number of datagrams dropped because the queue was full
+	authErrors     metrics.Counter // tracks the number of frames failing authentication
+	logsReceived   metrics.Counter // tracks the number of frames received
+	logsSent       metrics.Counter // tracks the number of frames delivered
+	sync.WaitGroup
+}
+
+func newSyslogServer(config IssConfig, fixerFunc FixerFunc, deliverer deliverer) (*syslogServer, error) {
+	s := &syslogServer{
+		Config:       config,
+		FixerFunc:    fixerFunc,
+		deliverer:    deliverer,
+		shutdownCh:   make(shutdownCh),
+		closers:      make(map[io.Closer]struct{}),
+		connections:  metrics.GetOrRegisterCounter("log-iss.syslog.connections", config.MetricsRegistry),
+		errors:       metrics.GetOrRegisterCounter("log-iss.syslog.errors", config.MetricsRegistry),
+		malformed:    metrics.GetOrRegisterCounter("log-iss.syslog.malformed", config.MetricsRegistry),
+		dropped:      metrics.GetOrRegisterCounter("log-iss.syslog.dropped", config.MetricsRegistry),
+		authErrors:   metrics.GetOrRegisterCounter("log-iss.syslog.auth.errors", config.MetricsRegistry),
+		logsReceived: metrics.GetOrRegisterCounter("log-iss.syslog.logs.received", config.MetricsRegistry),
+		logsSent:     metrics.GetOrRegisterCounter("log-iss.syslog.logs.sent", config.MetricsRegistry),
+	}
+
+	if config.SyslogTCPPort != "" {
+		if config.SyslogTCPToken == "" {
+			return nil, errors.New("SYSLOG_TCP_TOKEN must be set if SYSLOG_TCP_PORT is set")
+		}
+		s.listeners = append(s.listeners, syslogListener{name: "tcp", network: "tcp", port: config.SyslogTCPPort, token: config.SyslogTCPToken})
+	}
+
+	if config.SyslogTLSPort != "" {
+		if config.SyslogTlsConfig == nil {
+			return nil, errors.New("SYSLOG_TLS_CERT and SYSLOG_TLS_KEY must be set if SYSLOG_TLS_PORT is set")
+		}
+		if config.SyslogTLSToken == "" && config.SyslogTlsConfig.ClientCAs == nil {
+			return nil, errors.New("One of SYSLOG_TLS_TOKEN or SYSLOG_TLS_CLIENT_CA must be set if SYSLOG_TLS_PORT is set")
+		}
+		s.listeners = append(s.listeners, syslogListener{name: "tls", network: "tcp", port: config.SyslogTLSPort, token: config.SyslogTLSToken, tlsConfig: config.SyslogTlsConfig})
+	}
+
+	if config.SyslogUDPPort != "" {
+		if config.SyslogUDPToken == "" {
+			return nil, errors.New("SYSLOG_UDP_TOKEN must be set if SYSLOG_UDP_PORT is set")
+		}
+		s.listeners = append(s.listeners, syslogListener{name: "udp", network: "udp", port: config.SyslogUDPPort, token: config.SyslogUDPToken})
+	}
+
+	return s, nil
+}
+
+// Run opens all configured listeners and serves them until shutdown.
+func (s *syslogServer) Run() error {
+	for _, l := range s.listeners {
+		if l.network == "udp" {
+			pc, err := net.ListenPacket("udp", ":"+l.port)
+			if err != nil {
+				return err
+			}
+			s.track(pc)
+			go s.serveUDP(l, pc)
+		} else {
+			var ln net.Listener
+			var err error
+			if l.tlsConfig != nil {
+				ln, err = tls.Listen("tcp", ":"+l.port, l.tlsConfig)
+			} else {
+				ln, err = net.Listen("tcp", ":"+l.port)
+			}
+			if err != nil {
+				return err
+			}
+			s.track(ln)
+			go s.serveTCP(l, ln)
+		}
+		log.WithFields(log.Fields{"ns": "syslog", "at": "listen", "listener": l.name, "port": l.port}).Info()
+	}
+
+	go s.awaitShutdown()
+	return nil
+}
+
+func (s *syslogServer) track(c io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closers[c] = struct{}{}
+}
+
+func (s *syslogServer) untrack(c io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.closers, c)
+}
+
+func (s *syslogServer) awaitShutdown() {
+	<-s.shutdownCh
+	s.mu.Lock()
+	s.isShuttingDown = true
+	for c := range s.closers {
+		c.Close()
+	}
+	s.mu.Unlock()
+	log.WithFields(log.Fields{"ns": "syslog", "at": "shutdown"}).Info()
+}
+
+func (s *syslogServer) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.isShuttingDown
+}
+
+func (s *syslogServer) serveTCP(l syslogListener, ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return
+			}
+			s.errors.Inc(1)
+			log.WithFields(log.Fields{"ns": "syslog", "at": "accept", "listener": l.name, "message": err}).Error()
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		s.connections.Inc(1)
+		s.track(c)
+		go s.handleConn(l, c)
+	}
+}
+
+// Read frames from a stream connection, batching whatever is already buffered
+// before handing it off for delivery.
+func (s *syslogServer) handleConn(l syslogListener, c net.Conn) {
+	defer s.untrack(c)
+	defer c.Close()
+
+	remoteAddr := hostOnly(c.RemoteAddr())
+	c.SetDeadline(time.Now().Add(s.Config.SyslogHandshakeTimeout))
+	cred, token, err := s.connCredential(l, c)
+	if err != nil {
+		s.authErrors.Inc(1)
+		log.WithFields(log.Fields{"ns": "syslog", "at": "auth", "listener": l.name, "remote_addr": remoteAddr, "message": err}).Error()
+		return
+	}
+	c.SetDeadline(time.Time{})
+
+	br := bufio.NewReaderSize(c, maxSyslogFrameLength)
+	var batch bytes.Buffer
+	frames := 0
+	for {
+		if br.Buffered() == 0 {
+			// Close connections which go quiet, so half-open ones don't
+			// hold on to a goroutine forever.
+			c.SetReadDeadline(time.Now().Add(s.Config.SyslogIdleTimeout))
+		}
+		msg, err := readSyslogFrame(br)
+		if err != nil {
+			if err != io.EOF && !s.shuttingDown() {
+				s.errors.Inc(1)
+				log.WithFields(log.Fields{"ns": "syslog", "at": "read", "listener": l.name, "remote_addr": remoteAddr, "message": err}).Error()
+			}
+			break
+		}
+
+		if msg, err = authenticateFrame(token, msg); err != nil {
+			s.authErrors.Inc(1)
+			log.WithFields(log.Fields{"ns": "syslog", "at": "auth", "listener": l.name, "remote_addr": remoteAddr, "message": err}).Error()
+			break
+		}
+		writeSyslogFrame(&batch, msg)
+		frames++
+
+		if br.Buffered() == 0 || frames >= maxSyslogBatchFrames {
+			s.process(batch.Bytes(), remoteAddr, cred)
+			batch.Reset()
+			frames = 0
+		}
+	}
+
+	if frames > 0 {
+		s.process(batch.Bytes(), remoteAddr, cred)
+	}
+}
+
+type syslogDatagram struct {
+	remoteAddr string
+	msg        []byte
+}
+
+// Read datagrams, each holding a single message (RFC5426), and queue them for
+// a pool of workers so a slow delivery doesn't stall the socket.
+func (s *syslogServer) serveUDP(l syslogListener, pc net.PacketConn) {
+	cred := &credential{Name: "syslog-" + l.name, Stage: syslogCredentialStage}
+	queue := make(chan syslogDatagram, 1000)
+	defer close(queue)
+	for i := 0; i < s.Config.ForwardCount; i++ {
+		go s.processDatagrams(queue, cred)
+	}
+
+	buf := make([]byte, maxSyslogFrameLength)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if s.shuttingDown() {
+				return
+			}
+			s.errors.Inc(1)
+			log.WithFields(log.Fields{"ns": "syslog", "at": "read", "listener": l.name, "message": err}).Error()
+			continue
+		}
+
+		msg, err := authenticateFrame(l.token, bytes.TrimRight(buf[:n], "\r\n\x00"))
+		if err != nil {
+			s.authErrors.Inc(1)
+			log.WithFields(log.Fields{"ns": "syslog", "at": "auth", "listener": l.name, "remote_addr": hostOnly(addr), "message": err}).Error()
+			continue
+		}
+
+		select {
+		case queue <- syslogDatagram{remoteAddr: hostOnly(addr), msg: append([]byte(nil), msg...)}:
+		default:
+			s.dropped.Inc(1)
+		}
+	}
+}
+
+// Batch queued datagrams from the same source and deliver them.
+func (s *syslogServer) processDatagrams(queue chan syslogDatagram, cred *credential) {
+	var batch bytes.Buffer
+	for d := range queue {
+		batch.Reset()
+		writeSyslogFrame(&batch, d.msg)
+
+	drain:
+		for frames := 1; frames < maxSyslogBatchFrames; frames++ {
+			select {
+			case next, ok := <-queue:
+				if !ok {
+					break drain
+				}
+				if next.remoteAddr != d.remoteAddr {
+					s.process(batch.Bytes(), d.remoteAddr, cred)
+					batch.Reset()
+					d = next
+				}
+				writeSyslogFrame(&batch, next.msg)
+			default:
+				break drain
+			}
+		}
+
+		s.process(batch.Bytes(), d.remoteAddr, cred)
+	}
+}
+
+// Determine the credential for a stream connection, and the token its frames
+// must carry. TLS connections presenting a verified client certificate are
+// identified by its common name and need no token.
+func (s *syslogServer) connCredential(l syslogListener, c net.Conn) (*credential, string, error) {
+	if tc, ok := c.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			return nil, "", err
+		}
+		if certs := tc.ConnectionState().PeerCertificates; len(certs) > 0 {
+			return &credential{Name: certs[0].Subject.CommonName, Stage: syslogCredentialStage}, "", nil
+		}
+	}
+	if l.token == "" {
+		return nil, "", errors.New("No client certificate presented")
+	}
+	return &credential{Name: "syslog-" + l.name, Stage: syslogCredentialStage}, l.token, nil
+}
+
+// Check and strip token from the frame's structured data. If token is empty
+// the frame is only checked for a well formed header.
+func authenticateFrame(token string, msg []byte) ([]byte, error) {
+	header, rest, ok := splitSyslogHeader(msg)
+	if !ok {
+		return nil, errSyslogFrame
+	}
+	if token == "" {
+		return msg, nil
+	}
+
+	prefix := []byte("[" + syslogTokenSDID + ` token="`)
+	end := bytes.Index(rest, []byte(`"]`))
+	if !bytes.HasPrefix(rest, prefix) || end < len(prefix) ||
+		subtle.ConstantTimeCompare(rest[len(prefix):end], []byte(token)) != 1 {
+		return nil, errors.New("Missing or invalid token")
+	}
+	rest = rest[end+len(`"]`):]
+	if len(rest) == 0 || rest[0] == ' ' {
+		// The token was the only element, so STRUCTURED-DATA becomes NILVALUE.
+		rest = append([]byte("-"), rest...)
+	}
+
+	out := make([]byte, 0, len(header)+len(rest))
+	out = append(out, header...)
+	return append(out, rest...), nil
+}
+
+// Fix and deliver a batch of octet-counted frames.
+func (s *syslogServer) process(batch []byte, remoteAddr string, cred *credential) {
+	s.Add(1)
+	defer s.Done()
+
+	deliver := func(c fixResult) error {
+		p := NewPayload(remoteAddr, "", c.bytes)
+		p.Frames = c.numForwarded
+		p.Source = payloadSource{Credential: cred}
+		if err := s.deliverer.Deliver(p); err != nil {
+			return &deliveryError{err: err}
+		}
+		s.logsSent.Inc(c.numForwarded)
+		return nil
+	}
+
+	req, _ := http.NewRequest("POST", "/", nil)
+	r, err := s.FixerFunc(req, bytes.NewReader(batch), remoteAddr, "", s.Config.MetadataId, cred, &s.Config, deliver)
+	s.logsReceived.Inc(r.numLogs)
+	if r.malformed > 0 {
+		s.malformed.Inc(r.malformed)
+		log.WithFields(log.Fields{"ns": "syslog", "at": "malformed", "remote_addr": remoteAddr, "malformed": r.malformed, "frames": r.malformedFrames}).Warn()
+	}
+	if err != nil {
+		at := "fix"
+		if _, ok := err.(*deliveryError); ok {
+			at = "deliver"
+		}
+		s.errors.Inc(1)
+		log.WithFields(log.Fields{"ns": "syslog", "at": at, "remote_addr": remoteAddr, "message": err}).Error()
+	}
+}
+
+// Read a single frame using octet-counting (RFC5425, RFC6587 3.4.1) if it
+// starts with a digit, and LF-framing (RFC6587 3.4.2) otherwise.
+func readSyslogFrame(br *bufio.Reader) ([]byte, error) {
+	first, err := skipBlankLines(br)
+	if err != nil {
+		return nil, err
+	}
+
+	if first >= '0' && first <= '9' {
+		l, err := br.ReadString(' ')
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		n, err := strconv.Atoi(l[:len(l)-1])
+		if err != nil || n <= 0 || n > maxSyslogFrameLength {
+			return nil, fmt.Errorf("Invalid frame length %q", l[:len(l)-1])
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(br, msg); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		return msg, nil
+	}
+
+	line, err := br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, fmt.Errorf("Frame exceeds %d bytes", maxSyslogFrameLength)
+	}
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return nil, err
+	}
+	return append([]byte(nil), bytes.TrimRight(line, "\r\n")...), nil
+}
+
+// Discard empty LF-framed lines, returning the first byte of the next frame.
+func skipBlankLines(br *bufio.Reader) (byte, error) {
+	for {
+		first, err := br.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		if first[0] != '\r' && first[0] != '\n' {
+			return first[0], nil
+		}
+		br.Discard(1)
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Append msg to b as an octet-counted frame, the format FixerFuncs read.
+func writeSyslogFrame(b *bytes.Buffer, msg []byte) {
+	b.WriteString(strconv.Itoa(len(msg)))
+	b.WriteString(" ")
+	b.Write(msg)
+}
+
+// Split a syslog message after its MSGID, returning the header including the
+// trailing space and the remaining STRUCTURED-DATA and MSG.
+func splitSyslogHeader(msg []byte) ([]byte, []byte, bool) {
+	if len(msg) == 0 || msg[0] != '<' {
+		return nil, nil, false
+	}
+	i := 0
+	for fields := 0; fields < 6; fields++ {
+		n := bytes.IndexByte(msg[i:], ' ')
+		if n <= 0 {
+			return nil, nil, false
+		}
+		i += n + 1
+	}
+	return msg[:i], msg[i:], true
+}
+
+func hostOnly(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
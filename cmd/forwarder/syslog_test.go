@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingDeliverer struct {
+	sync.Mutex
+	payloads []payload
+}
+
+func (d *recordingDeliverer) Deliver(p payload) error {
+	d.Lock()
+	defer d.Unlock()
+	// Bodies are reused once Deliver returns.
+	p.Body = append([]byte(nil), p.Body...)
+	d.payloads = append(d.payloads, p)
+	return nil
+}
+
+func (d *recordingDeliverer) bodies() string {
+	d.Lock()
+	defer d.Unlock()
+	var b strings.Builder
+	for _, p := range d.payloads {
+		b.Write(p.Body)
+	}
+	return b.String()
+}
+
+func TestReadSyslogFrame(t *testing.T) {
+	assert := assert.New(t)
+
+	in := "63 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi" +
+		"<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hello\r\n" +
+		"\n" +
+		"<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - bye"
+	br := bufio.NewReader(strings.NewReader(in))
+
+	expected := []string{
+		"<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi",
+		"<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hello",
+		"<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - bye",
+	}
+	for _, e := range expected {
+		msg, err := readSyslogFrame(br)
+		assert.NoError(err)
+		assert.Equal(e, string(msg))
+	}
+
+	_, err := readSyslogFrame(br)
+	assert.Error(err)
+
+	_, err = readSyslogFrame(bufio.NewReader(strings.NewReader("99999999 <13>1")))
+	assert.Error(err)
+
+	_, err = readSyslogFrame(bufio.NewReader(strings.NewReader("20 <13>1 short")))
+	assert.Error(err)
+}
+
+func TestReadSyslogFrameBlankLines(t *testing.T) {
+	assert := assert.New(t)
+
+	in := strings.Repeat("\n", 20*1024*1024) + "63 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi"
+	br := bufio.NewReaderSize(strings.NewReader(in), maxSyslogFrameLength)
+	msg, err := readSyslogFrame(br)
+	assert.NoError(err)
+	assert.Equal("<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi", string(msg))
+
+	_, err = readSyslogFrame(bufio.NewReader(strings.NewReader(strings.Repeat("\r\n", 1024*1024))))
+	assert.Equal(io.EOF, err)
+}
+
+func TestAuthenticateFrame(t *testing.T) {
+	tests := map[string]struct {
+		token    string
+		in       string
+		expected string
+		err      bool
+	}{
+		"token is stripped": {
+			token:    "secret",
+			in:       `<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [auth token="secret"] hi`,
+			expected: `<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi`,
+		},
+		"other structured data is kept": {
+			token:    "secret",
+			in:       `<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [auth token="secret"][meta a="b"] hi`,
+			expected: `<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [meta a="b"] hi`,
+		},
+		"token without message": {
+			token:    "secret",
+			in:       `<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [auth token="secret"]`,
+			expected: `<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - -`,
+		},
+		"wrong token": {
+			token: "secret",
+			in:    `<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [auth token="guess"] hi`,
+			err:   true,
+		},
+		"token with a suffix": {
+			token: "secret",
+			in:    `<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [auth token="secrets"] hi`,
+			err:   true,
+		},
+		"unterminated token": {
+			token: "secret",
+			in:    `<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [auth token="secret hi`,
+			err:   true,
+		},
+		"missing token": {
+			token: "secret",
+			in:    `<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi`,
+			err:   true,
+		},
+		"no token required": {
+			in:       `<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi`,
+			expected: `<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - - hi`,
+		},
+		"malformed header": {
+			in:  `<13>1 2013-06-07T13:17:49.468822+00:00 host`,
+			err: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			out, err := authenticateFrame(test.token, []byte(test.in))
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, string(out))
+		})
+	}
+}
+
+func TestSyslogServerTCP(t *testing.T) {
+	assert := assert.New(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		assert.FailNow(err.Error())
+	}
+
+	d := &recordingDeliverer{}
+	s, err := newSyslogServer(*getConfig(), pipelineFix, d)
+	assert.NoError(err)
+
+	l := syslogListener{name: "tcp", network: "tcp", token: "secret"}
+	s.track(ln)
+	go s.serveTCP(l, ln)
+	go s.awaitShutdown()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		assert.FailNow(err.Error())
+	}
+	c.Write([]byte("84 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [auth token=\"secret\"] hi\n"))
+	c.Write([]byte("<13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [auth token=\"secret\"] hello\n"))
+	c.Close()
+
+	expected := "86 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"127.0.0.1\"] hi\n" +
+		"88 <13>1 2013-06-07T13:17:49.468822+00:00 host heroku web.7 - [origin ip=\"127.0.0.1\"] hello"
+	deadline := time.Now().Add(time.Second)
+	for d.bodies() != expected && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(expected, d.bodies())
+
+	s.shutdownCh <- struct{}{}
+}
+
+func TestSyslogServerClosesIdleConnections(t *testing.T) {
+	assert := assert.New(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		assert.FailNow(err.Error())
+	}
+
+	config := *getConfig()
+	config.SyslogIdleTimeout = 50 * time.Millisecond
+	s, err := newSyslogServer(config, pipelineFix, &recordingDeliverer{})
+	assert.NoError(err)
+
+	l := syslogListener{name: "tcp", network: "tcp", token: "secret"}
+	s.track(ln)
+	go s.serveTCP(l, ln)
+	go s.awaitShutdown()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		assert.FailNow(err.Error())
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = c.Read(make([]byte, 1))
+	assert.Equal(io.EOF, err, "the server closes the connection")
+
+	s.shutdownCh <- struct{}{}
+}
+
+func TestNewSyslogServerRequiresAuthentication(t *testing.T) {
+	config := *getConfig()
+	config.SyslogTCPPort = "6514"
+	_, err := newSyslogServer(config, pipelineFix, &recordingDeliverer{})
+	assert.Error(t, err)
+
+	config.SyslogTCPToken = "secret"
+	_, err = newSyslogServer(config, pipelineFix, &recordingDeliverer{})
+	assert.NoError(t, err)
+
+	config.SyslogTLSPort = "6515"
+	_, err = newSyslogServer(config, pipelineFix, &recordingDeliverer{})
+	assert.Error(t, err)
+}
@@ -4,15 +4,21 @@ import (
 	"crypto/hmac"
 	"crypto/sha512"
 	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/joeshaw/envdecode"
 )
 
 type AuthConfig struct {
-	HmacKey string `env:"HMAC_KEY"`
+	HmacKey   string   `env:"HMAC_KEY"`
+	HmacKeys  []string `env:"HMAC_KEYS"`
+	HmacKeyID string   `env:"HMAC_KEY_ID"`
 }
 
 func hmacEncode(key string, value string) string {
@@ -23,13 +29,117 @@ func hmacEncode(key string, value string) string {
 	return hex.EncodeToString(hash.Sum(nil))
 }
 
+// Parse HMAC_KEYS, key_id:key pairs, into keys by ID along with HMAC_KEY,
+// whose ID is empty.
+func parseHmacKeys(config AuthConfig) (map[string]string, error) {
+	keys := map[string]string{"": config.HmacKey}
+	for _, p := range config.HmacKeys {
+		kv := strings.SplitN(p, ":", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("HMAC_KEYS entries must be key_id:key")
+		}
+		if _, ok := keys[kv[0]]; ok {
+			return nil, fmt.Errorf("HMAC_KEYS has key_id %q more than once", kv[0])
+		}
+		keys[kv[0]] = kv[1]
+	}
+	return keys, nil
+}
+
+// Read a JSON array of credentials, each with its plaintext password, and
+// write them out along with a copy hashed with the key keyID, so both are
+// accepted while clients move to the new key. Passwords are checked against
+// the credentials' existing hmacs and left out of the output. With replace,
+// only the copies are written.
+func rehash(in io.Reader, out io.Writer, keys map[string]string, keyID string, replace bool) error {
+	key, ok := keys[keyID]
+	if !ok {
+		return fmt.Errorf("Unknown key_id %q", keyID)
+	}
+
+	var creds []map[string]interface{}
+	if err := json.NewDecoder(in).Decode(&creds); err != nil {
+		return fmt.Errorf("Unable to parse credentials: %s", err)
+	}
+
+	result := make([]map[string]interface{}, 0, 2*len(creds))
+	for i, c := range creds {
+		password, _ := c["password"].(string)
+		if password == "" {
+			return fmt.Errorf("Credential %d has no password", i)
+		}
+		delete(c, "password")
+		oldID, _ := c["key_id"].(string)
+		oldKey, ok := keys[oldID]
+		if !ok {
+			return fmt.Errorf("Credential %d has unknown key_id %q", i, oldID)
+		}
+		if c["hmac"] != hmacEncode(oldKey, password) {
+			return fmt.Errorf("Credential %d's password doesn't match its hmac", i)
+		}
+
+		if oldID == keyID {
+			result = append(result, c)
+			continue
+		}
+		if !replace {
+			result = append(result, c)
+		}
+		n := make(map[string]interface{}, len(c))
+		for k, v := range c {
+			n[k] = v
+		}
+		n["hmac"] = hmacEncode(key, password)
+		if keyID == "" {
+			delete(n, "key_id")
+		} else {
+			n["key_id"] = keyID
+		}
+		result = append(result, n)
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, string(b))
+	return err
+}
+
 func main() {
+	rehashFlag := flag.Bool("rehash", false, "Read a JSON array of credentials with passwords from stdin and add copies hashed with HMAC_KEY_ID")
+	replace := flag.Bool("replace", false, "With -rehash, only write the copies")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s PASSWORD\n       %s -rehash [-replace] < credentials.json\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
 	var config AuthConfig
 	err := envdecode.Decode(&config)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	keys, err := parseHmacKeys(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if *rehashFlag {
+		if err := rehash(os.Stdin, os.Stdout, keys, config.HmacKeyID, *replace); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
 
-	password := os.Args[1]
-	fmt.Printf(hmacEncode(config.HmacKey, password))
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	key, ok := keys[config.HmacKeyID]
+	if !ok {
+		log.Fatalf("Unknown HMAC_KEY_ID %q", config.HmacKeyID)
+	}
+	password := flag.Arg(0)
+	fmt.Printf(hmacEncode(key, password))
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRehash(t *testing.T) {
+	keys := map[string]string{"": "old", "2": "new"}
+	oldHmac := hmacEncode("old", "secret")
+	newHmac := hmacEncode("new", "secret")
+	in := `[{"name":"a","stage":"current","hmac":"` + oldHmac + `","password":"secret"}]`
+
+	tests := map[string]struct {
+		in      string
+		keyID   string
+		replace bool
+		out     string
+		err     string
+	}{
+		"adds a copy": {
+			in: in, keyID: "2",
+			out: `[{"hmac":"` + oldHmac + `","name":"a","stage":"current"},{"hmac":"` + newHmac + `","key_id":"2","name":"a","stage":"current"}]`,
+		},
+		"replaces": {
+			in: in, keyID: "2", replace: true,
+			out: `[{"hmac":"` + newHmac + `","key_id":"2","name":"a","stage":"current"}]`,
+		},
+		"already hashed with the key": {
+			in: in, keyID: "",
+			out: `[{"hmac":"` + oldHmac + `","name":"a","stage":"current"}]`,
+		},
+		"back to HMAC_KEY": {
+			in: `[{"hmac":"` + newHmac + `","key_id":"2","password":"secret"}]`, keyID: "", replace: true,
+			out: `[{"hmac":"` + oldHmac + `"}]`,
+		},
+		"wrong password": {
+			in: `[{"hmac":"` + oldHmac + `","password":"guess"}]`, keyID: "2",
+			err: "Credential 0's password doesn't match its hmac",
+		},
+		"no password":     {in: `[{"hmac":"` + oldHmac + `"}]`, keyID: "2", err: "Credential 0 has no password"},
+		"unknown key_id":  {in: `[{"hmac":"x","key_id":"9","password":"secret"}]`, keyID: "2", err: `Credential 0 has unknown key_id "9"`},
+		"unknown new key": {in: in, keyID: "3", err: `Unknown key_id "3"`},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := rehash(strings.NewReader(test.in), &out, keys, test.keyID, test.replace)
+			if test.err != "" {
+				assert.EqualError(t, err, test.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, test.out+"\n", out.String())
+		})
+	}
+}
+
+func TestParseHmacKeys(t *testing.T) {
+	keys, err := parseHmacKeys(AuthConfig{HmacKey: "old", HmacKeys: []string{"2:new", "3:newer:with:colons"}})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"": "old", "2": "new", "3": "newer:with:colons"}, keys)
+
+	_, err = parseHmacKeys(AuthConfig{HmacKey: "old", HmacKeys: []string{"secret"}})
+	assert.EqualError(t, err, "HMAC_KEYS entries must be key_id:key")
+	_, err = parseHmacKeys(AuthConfig{HmacKey: "old", HmacKeys: []string{"2:a", "2:b"}})
+	assert.EqualError(t, err, `HMAC_KEYS has key_id "2" more than once`)
+}